@@ -5,14 +5,13 @@ import (
 	"github.com/jerblack/base"
 	"io"
 	"log"
-	"math/rand"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -25,16 +24,17 @@ import (
 	enumerate conf files in wireguard folder
 		parse conf files into filename, basename, server localInIp
 
-	iterate randomly through confs
-		for each endpoint localInIp, create route through gateway
+	for each endpoint localInIp, create route through gateway
 
-	randomly select first connection
+	interfaces, routes and nat rules are set through netlink and nftables (see netlink.go)
+
+	select the best scoring server (see servers.go)
 		connect
-		verify connected
+		verify connected, wait for the first handshake
 		if connected, update cloudflare dns record with localInIp obtained from https://ipv4.am.i.mullvad.net
 
 	monitor connection
-		every minute ping heartbeat localInIp, on 3 successive fails go to next connection
+		every minute ping heartbeat localInIp, on 3 successive fails mark the server failed and go to next connection
 
 */
 
@@ -105,6 +105,12 @@ func (f *Forward) String() string {
 func (f *Forward) add() {
 	p("add forward: %s", f)
 	forwards[f.Host] = append(forwards[f.Host], f)
+	if natActive {
+		e := applyNat()
+		if e != nil {
+			p("failed to apply forward %s: %s", f, e)
+		}
+	}
 }
 func (f *Forward) remove() {
 	p("remove forward: %s", f)
@@ -119,31 +125,11 @@ func (f *Forward) remove() {
 	} else {
 		forwards[f.Host] = tmp
 	}
-}
-func (f *Forward) enable() {
-	p("enable forward: %s", f)
-	cmds := []string{
-		fmt.Sprintf("iptables -t nat -A PREROUTING -i mullvad+ -p %s --dport %s -j DNAT --to-destination %s:%s",
-			f.Proto, f.ExtPort, f.Ip, f.IntPort),
-		fmt.Sprintf("iptables -t nat -A POSTROUTING -p %s -d %s --dport %s -j SNAT --to-source %s",
-			f.Proto, f.Ip, f.IntPort, localInIp),
-	}
-	for _, cmd := range cmds {
-		e := run(strings.Split(cmd, " ")...)
-		chk(e)
-	}
-}
-func (f *Forward) disable() {
-	p("disable forward: %s", f)
-	cmds := []string{
-		fmt.Sprintf("iptables -t nat -D PREROUTING -i mullvad+ -p %s --dport %s -j DNAT --to-destination %s:%s",
-			f.Proto, f.ExtPort, f.Ip, f.IntPort),
-		fmt.Sprintf("iptables -t nat -D POSTROUTING -p %s -d %s --dport %s -j SNAT --to-source %s",
-			f.Proto, f.Ip, f.IntPort, localInIp),
-	}
-	for _, cmd := range cmds {
-		e := run(strings.Split(cmd, " ")...)
-		chk(e)
+	if natActive {
+		e := applyNat()
+		if e != nil {
+			p("failed to remove forward %s: %s", f, e)
+		}
 	}
 }
 func loadConfig() {
@@ -182,7 +168,7 @@ func loadConfig() {
 		if strings.HasPrefix(line, "#") || !strings.Contains(line, "=") {
 			continue
 		}
-		kv := strings.Split(line, "=")
+		kv := strings.SplitN(line, "=", 2)
 		k := strings.ToLower(strings.TrimSpace(kv[0]))
 		v := strings.TrimSpace(kv[1])
 		switch k {
@@ -217,6 +203,23 @@ func loadConfig() {
 		case "forward":
 			f := Forward{}
 			f.parse(v)
+		case "stats_file":
+			statsFile = v
+		case "throughput_url":
+			throughputUrl = v
+		case "prefer":
+			preferred = strings.Fields(v)
+		case "countries":
+			countries = strings.Fields(strings.ToLower(v))
+		case "netns":
+			netnsName = v
+		case "cooldown":
+			mins, e := strconv.Atoi(v)
+			if e != nil {
+				p("cooldown must be a number of minutes")
+				os.Exit(1)
+			}
+			cooldown = time.Duration(mins) * time.Minute
 		}
 	}
 	if nicOut == "" {
@@ -279,9 +282,6 @@ func readWgConfs() {
 	wgFiles, e := os.ReadDir(wgFolder)
 	chkFatal(e)
 
-	rand.Seed(time.Now().UnixNano())
-	rand.Shuffle(len(wgFiles), func(i, j int) { wgFiles[i], wgFiles[j] = wgFiles[j], wgFiles[i] })
-
 	for _, conf := range wgFiles {
 		fmt.Println(conf.Name())
 
@@ -309,26 +309,23 @@ func readWgConfs() {
 
 		}
 	}
+	filterCountries()
 }
 
 func makeRoutes() {
-	add := func(addr string) {
-		cmd := []string{"ip", "route", "add", addr, "via", gateway, "dev", nicOut}
-		e := run(cmd...)
-		chkFatal(e)
-	}
 	for _, conf := range confs {
-		add(conf.endpoint)
+		e := endpointRoute(conf.endpoint, true)
+		if e != nil {
+			p("failed to add route to %s: %s", conf.endpoint, e)
+		}
 	}
 }
 func deleteRoutes() {
-	rm := func(addr string) {
-		cmd := []string{"ip", "route", "del", addr, "via", gateway, "dev", nicOut}
-		e := run(cmd...)
-		chkFatal(e)
-	}
 	for _, conf := range confs {
-		rm(conf.endpoint)
+		e := endpointRoute(conf.endpoint, false)
+		if e != nil {
+			p("failed to delete route to %s: %s", conf.endpoint, e)
+		}
 	}
 }
 
@@ -367,23 +364,30 @@ func connect(conf WgConf) {
 	connFailed = make(chan bool)
 	nextPoker = make(chan bool)
 	p("connecting to wireguard server %s at %s", conf.name, conf.endpoint)
-	e := run("wg-quick", "up", conf.name)
+	e := wgUp(conf)
 	if e != nil {
 		p("failed to connect to vpn server: %s", e.Error())
+		serverFailed(conf.name)
+		return
+	}
+	if !waitHandshake(conf.name) {
+		p("no handshake with vpn server after %s", handshakeWait)
+		serverFailed(conf.name)
+		e = wgDown(conf)
+		chk(e)
 		return
 	}
 	p("setting up NAT and port forwarding")
 	enableNat()
-	//setLocalDns(conf.dns)
 	go updateDnsHostname()
+	go sampleServer(conf.name)
 
 	p("checking connection every 60 seconds")
 	go func() {
 		failed := 0
 		for {
 			time.Sleep(60 * time.Second)
-			cmd := exec.Command("ping", heartbeatIp, "-c", "1")
-			e = cmd.Run()
+			e := heartbeat(conf.name)
 			if e != nil {
 				failed++
 			} else {
@@ -398,6 +402,7 @@ func connect(conf WgConf) {
 	select {
 	case <-connFailed:
 		p("connection verification failed, moving to next server")
+		serverFailed(conf.name)
 	case <-nextPoker:
 		p("connection marked as failed through /next endpoint, moving to next server")
 	case <-signalChan:
@@ -406,7 +411,7 @@ func connect(conf WgConf) {
 		disableNat()
 		p("deleting routes to vpn server")
 		deleteRoutes()
-		e = run("wg-quick", "down", conf.name)
+		e = wgDown(conf)
 		chk(e)
 		os.Exit(0)
 
@@ -414,7 +419,7 @@ func connect(conf WgConf) {
 	p("disabling NAT")
 	disableNat()
 
-	e = run("wg-quick", "down", conf.name)
+	e = wgDown(conf)
 	chk(e)
 }
 func getHostname() {
@@ -423,41 +428,16 @@ func getHostname() {
 	localHostname = strings.ReplaceAll(string(txt), "\n", "")
 }
 
-func setLocalDns(dnsServer string) {
-	p("writing /etc/resolv.conf file")
-	resolvConf := fmt.Sprintf("nameserver %s", dnsServer)
-	e := os.WriteFile("/etc/resolv.conf", []byte(resolvConf), 0444)
-	chkFatal(e)
-
-	p("enabling DNS relay from %s to server at %s", localInIp, dnsServer)
-	cmds := []string{
-		fmt.Sprintf("iptables -t nat -A PREROUTING -p udp --dport 53 -j DNAT --to-destination %s:53", dnsServer),
-		fmt.Sprintf("iptables -t nat -A PREROUTING -p tcp --dport 53 -j DNAT --to-destination %s:53", dnsServer),
-	}
-	for _, cmd := range cmds {
-		e = run(strings.Split(cmd, " ")...)
-		chkFatal(e)
-	}
-}
-
 func enableNat() {
-	cmd := fmt.Sprintf("iptables -t nat -A POSTROUTING -o mullvad+ -s %s -j MASQUERADE", networkIdIn)
-	e := run(strings.Split(cmd, " ")...)
-	chkFatal(e)
-	cmd = fmt.Sprintf("iptables -t nat -A POSTROUTING -o mullvad+ -s %s -j MASQUERADE", "10.0.0.0/16")
-	e = run(strings.Split(cmd, " ")...)
-	chkFatal(e)
-	for _, forward := range forwards {
-		for _, f := range forward {
-			f.enable()
-		}
+	e := applyNat()
+	if e != nil {
+		p("failed to set up NAT: %s", e)
 	}
 }
 func disableNat() {
-	for _, forward := range forwards {
-		for _, f := range forward {
-			f.disable()
-		}
+	e := removeNat()
+	if e != nil {
+		p("failed to remove NAT: %s", e)
 	}
 }
 func main() {
@@ -471,6 +451,12 @@ func main() {
 	)
 
 	loadConfig()
+	loadStats()
+	e := openNet()
+	if e != nil {
+		p("could not open netlink: %s", e)
+		os.Exit(1)
+	}
 
 	copyWgConfs()
 	p("connection monitor has started")
@@ -483,14 +469,16 @@ func main() {
 	for _, c := range confs {
 		fmt.Printf("%+v\n", c)
 	}
+	printScores()
 	p("adding routes")
 	makeRoutes()
 
 	p("making first connection")
+	prev := ""
 	for {
-		for _, conf := range confs {
-			connect(conf)
-		}
+		conf := nextServer(prev)
+		connect(conf)
+		prev = conf.name
 	}
 }
 
@@ -499,4 +487,5 @@ var (
 	chk      = base.Chk
 	chkFatal = base.ChkFatal
 	run      = base.Run
+	isAny    = base.IsAny
 )
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	network control
+		the wireguard interface, its peers and addresses, routes and nat rules are set up through netlink, wgctrl and
+		nftables instead of wg-quick, ip and iptables. every step returns its error to the caller, which reports it,
+		and a connect that fails halfway is rolled back: the interface goes away with its addresses and routes, and
+		resolv.conf is put back.
+		nat and port forwards live in their own nftables table, ip connected, that is replaced in one transaction
+		whenever it changes, so the rules are never half applied. nft list table ip connected shows them.
+		with netns in connected.conf, every change is made in that named network namespace (ip netns add), so
+		interfaces and rules can be checked in a throwaway namespace without a real vpn. resolv.conf belongs to the
+		host, so dns isn't changed in a namespace.
+*/
+
+var (
+	netnsName  string
+	nlh        *netlink.Handle
+	nft        *nftables.Conn
+	wgc        *wgctrl.Client
+	natTable   = &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "connected"}
+	natActive  bool
+	oldResolv  []byte
+	tunnelName string // wireguard interface nat and forwards apply to, set by wgUp
+)
+
+// wgDevice is what a wireguard conf file sets up
+type wgDevice struct {
+	key   wgtypes.Key
+	addrs []*netlink.Addr
+	dns   []string
+	peers []wgtypes.PeerConfig
+}
+
+// openNet opens the netlink, nftables and wireguard handles, in netnsName if it is set
+func openNet() error {
+	ns := netns.None()
+	if netnsName != "" {
+		var e error
+		ns, e = netns.GetFromName(netnsName)
+		if e != nil {
+			return fmt.Errorf("network namespace %s: %w", netnsName, e)
+		}
+	}
+	var e error
+	nlh, e = netlink.NewHandleAt(ns)
+	if e != nil {
+		return e
+	}
+	if ns.IsOpen() {
+		nft, e = nftables.New(nftables.WithNetNSFd(int(ns)))
+	} else {
+		nft, e = nftables.New()
+	}
+	if e != nil {
+		return e
+	}
+	// wgctrl has no namespace option, its socket is opened inside the namespace and stays there
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if ns.IsOpen() {
+		orig, e := netns.Get()
+		if e != nil {
+			return e
+		}
+		defer orig.Close()
+		e = netns.Set(ns)
+		if e != nil {
+			return e
+		}
+		defer netns.Set(orig)
+	}
+	wgc, e = wgctrl.New()
+	return e
+}
+
+func parseWgConf(filename string) (*wgDevice, error) {
+	b, e := os.ReadFile(filename)
+	if e != nil {
+		return nil, e
+	}
+	var d wgDevice
+	var peer *wgtypes.PeerConfig
+	list := func(v string) []string {
+		var items []string
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "[Peer]" {
+			d.peers = append(d.peers, wgtypes.PeerConfig{ReplaceAllowedIPs: true})
+			peer = &d.peers[len(d.peers)-1]
+			continue
+		}
+		if strings.HasPrefix(line, "#") || !strings.Contains(line, "=") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		k, v := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		var e error
+		switch {
+		case peer == nil && k == "privatekey":
+			d.key, e = wgtypes.ParseKey(v)
+		case peer == nil && k == "address":
+			for _, a := range list(v) {
+				addr, e := netlink.ParseAddr(a)
+				if e != nil {
+					return nil, fmt.Errorf("%s: address %s: %w", filename, a, e)
+				}
+				d.addrs = append(d.addrs, addr)
+			}
+		case peer == nil && k == "dns":
+			d.dns = list(v)
+		case peer != nil && k == "publickey":
+			peer.PublicKey, e = wgtypes.ParseKey(v)
+		case peer != nil && k == "presharedkey":
+			var psk wgtypes.Key
+			psk, e = wgtypes.ParseKey(v)
+			peer.PresharedKey = &psk
+		case peer != nil && k == "allowedips":
+			for _, a := range list(v) {
+				_, n, e := net.ParseCIDR(a)
+				if e != nil {
+					return nil, fmt.Errorf("%s: allowed ip %s: %w", filename, a, e)
+				}
+				peer.AllowedIPs = append(peer.AllowedIPs, *n)
+			}
+		case peer != nil && k == "endpoint":
+			peer.Endpoint, e = net.ResolveUDPAddr("udp", v)
+		case peer != nil && k == "persistentkeepalive":
+			var secs int
+			secs, e = strconv.Atoi(v)
+			ka := time.Duration(secs) * time.Second
+			peer.PersistentKeepaliveInterval = &ka
+		}
+		if e != nil {
+			return nil, fmt.Errorf("%s: %s: %w", filename, k, e)
+		}
+	}
+	if len(d.peers) == 0 {
+		return nil, fmt.Errorf("%s: no peers", filename)
+	}
+	return &d, nil
+}
+
+// wgUp creates and configures the wireguard interface for a conf, routes its allowed ips through it and sets its
+// dns. on error everything done so far is undone.
+func wgUp(conf WgConf) (e error) {
+	d, e := parseWgConf(conf.filename)
+	if e != nil {
+		return e
+	}
+	if old, e := nlh.LinkByName(conf.name); e == nil {
+		p("removing leftover interface %s", conf.name)
+		e = nlh.LinkDel(old)
+		if e != nil {
+			return e
+		}
+	}
+	e = nlh.LinkAdd(&netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: conf.name}})
+	if e != nil {
+		return fmt.Errorf("create interface %s: %w", conf.name, e)
+	}
+	tunnelName = conf.name
+	defer func() {
+		if e != nil {
+			p("rolling back interface %s", conf.name)
+			chk(wgDown(conf))
+		}
+	}()
+	link, e := nlh.LinkByName(conf.name)
+	if e != nil {
+		return e
+	}
+	e = wgc.ConfigureDevice(conf.name, wgtypes.Config{PrivateKey: &d.key, ReplacePeers: true, Peers: d.peers})
+	if e != nil {
+		return fmt.Errorf("configure %s: %w", conf.name, e)
+	}
+	for _, a := range d.addrs {
+		e = nlh.AddrAdd(link, a)
+		if e != nil {
+			return fmt.Errorf("add address %s to %s: %w", a, conf.name, e)
+		}
+	}
+	e = nlh.LinkSetUp(link)
+	if e != nil {
+		return fmt.Errorf("set %s up: %w", conf.name, e)
+	}
+	e = tunnelRoutes(link, d.peers)
+	if e != nil {
+		return e
+	}
+	if len(d.dns) > 0 {
+		e = setDns(d.dns)
+	}
+	return e
+}
+
+// tunnelRoutes routes the allowed ips of the peers through the tunnel. a default route is added as two halves,
+// 0.0.0.0/1 and 128.0.0.0/1 (::/1 and 8000::/1), so it wins over the default route of the host without replacing
+// it, and the host keeps its own when the tunnel goes away.
+func tunnelRoutes(link netlink.Link, peers []wgtypes.PeerConfig) error {
+	for _, peer := range peers {
+		for _, allowed := range peer.AllowedIPs {
+			for _, n := range splitDefault(allowed) {
+				n := n
+				e := nlh.RouteReplace(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: &n, Scope: netlink.SCOPE_LINK})
+				if e != nil {
+					return fmt.Errorf("route %s through %s: %w", n.String(), link.Attrs().Name, e)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// splitDefault returns the two /1 halves of a default route, any other network as it is
+func splitDefault(n net.IPNet) []net.IPNet {
+	ones, bits := n.Mask.Size()
+	if ones != 0 || bits == 0 {
+		return []net.IPNet{n}
+	}
+	low := net.IPNet{IP: make(net.IP, bits/8), Mask: net.CIDRMask(1, bits)}
+	high := net.IPNet{IP: make(net.IP, bits/8), Mask: net.CIDRMask(1, bits)}
+	high.IP[0] = 0x80
+	return []net.IPNet{low, high}
+}
+
+// wgDown removes the wireguard interface of a conf, which takes its addresses and routes with it, and puts back
+// resolv.conf
+func wgDown(conf WgConf) error {
+	restoreDns()
+	link, e := nlh.LinkByName(conf.name)
+	if e != nil {
+		return fmt.Errorf("interface %s: %w", conf.name, e)
+	}
+	return nlh.LinkDel(link)
+}
+
+// lastHandshake returns the latest handshake of any peer on a wireguard interface
+func lastHandshake(name string) (time.Time, error) {
+	var last time.Time
+	dev, e := wgc.Device(name)
+	if e != nil {
+		return last, e
+	}
+	for _, peer := range dev.Peers {
+		if peer.LastHandshakeTime.After(last) {
+			last = peer.LastHandshakeTime
+		}
+	}
+	return last, nil
+}
+
+// setDns points resolv.conf at the vpn dns servers. resolv.conf isn't per namespace, so it is left alone with netns.
+func setDns(servers []string) error {
+	if netnsName != "" {
+		return nil
+	}
+	if oldResolv == nil {
+		b, e := os.ReadFile("/etc/resolv.conf")
+		if e != nil && !os.IsNotExist(e) {
+			return e
+		}
+		oldResolv = append([]byte{}, b...)
+	}
+	var conf string
+	for _, s := range servers {
+		conf += fmt.Sprintf("nameserver %s\n", s)
+	}
+	return os.WriteFile("/etc/resolv.conf", []byte(conf), 0644)
+}
+func restoreDns() {
+	if oldResolv == nil {
+		return
+	}
+	e := os.WriteFile("/etc/resolv.conf", oldResolv, 0644)
+	chk(e)
+	oldResolv = nil
+}
+
+// endpointRoute adds or removes the route to a vpn server through gateway on nic_out
+func endpointRoute(host string, add bool) error {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, e := net.LookupIP(host)
+		if e != nil || len(ips) == 0 {
+			return fmt.Errorf("could not resolve %s: %v", host, e)
+		}
+		ip = ips[0]
+	}
+	link, e := nlh.LinkByName(nicOut)
+	if e != nil {
+		return fmt.Errorf("interface %s: %w", nicOut, e)
+	}
+	r := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)},
+		Gw:        net.ParseIP(gateway),
+	}
+	if add {
+		return nlh.RouteReplace(r)
+	}
+	return nlh.RouteDel(r)
+}
+
+// applyNat replaces the connected nftables table with masquerading for the local networks and the port forwards, in
+// one transaction
+func applyNat() error {
+	var nets []*net.IPNet
+	for _, network := range []string{networkIdIn, "10.0.0.0/16"} {
+		_, n, e := net.ParseCIDR(network)
+		if e != nil {
+			return fmt.Errorf("network %s: %w", network, e)
+		}
+		nets = append(nets, n)
+	}
+	// adding the table first makes deleting it safe when it doesn't exist yet
+	nft.AddTable(natTable)
+	nft.DelTable(natTable)
+	nft.AddTable(natTable)
+	pre := nft.AddChain(&nftables.Chain{Name: "prerouting", Table: natTable, Type: nftables.ChainTypeNAT,
+		Hooknum: nftables.ChainHookPrerouting, Priority: nftables.ChainPriorityNATDest})
+	post := nft.AddChain(&nftables.Chain{Name: "postrouting", Table: natTable, Type: nftables.ChainTypeNAT,
+		Hooknum: nftables.ChainHookPostrouting, Priority: nftables.ChainPriorityNATSource})
+	for _, n := range nets {
+		exprs := ifname(expr.MetaKeyOIFNAME)
+		exprs = append(exprs, ipNet(12, n)...)
+		nft.AddRule(&nftables.Rule{Table: natTable, Chain: post, Exprs: append(exprs, &expr.Masq{})})
+	}
+	for _, forward := range forwards {
+		for _, f := range forward {
+			dnat, snat, e := f.rules()
+			if e != nil {
+				p("skipping forward %s: %s", f, e)
+				continue
+			}
+			nft.AddRule(&nftables.Rule{Table: natTable, Chain: pre, Exprs: dnat})
+			nft.AddRule(&nftables.Rule{Table: natTable, Chain: post, Exprs: snat})
+		}
+	}
+	e := nft.Flush()
+	if e == nil {
+		natActive = true
+	}
+	return e
+}
+
+// removeNat deletes the connected nftables table
+func removeNat() error {
+	natActive = false
+	nft.AddTable(natTable)
+	nft.DelTable(natTable)
+	return nft.Flush()
+}
+
+// rules returns the dnat rule for traffic coming in on the tunnel and the snat rule for its replies
+func (f *Forward) rules() (dnat, snat []expr.Any, e error) {
+	ip := net.ParseIP(f.Ip).To4()
+	if ip == nil {
+		return nil, nil, fmt.Errorf("invalid ip %s", f.Ip)
+	}
+	local := net.ParseIP(localInIp).To4()
+	if local == nil {
+		return nil, nil, fmt.Errorf("invalid ip_in %s", localInIp)
+	}
+	var proto byte
+	switch strings.ToLower(f.Proto) {
+	case "tcp":
+		proto = unix.IPPROTO_TCP
+	case "udp":
+		proto = unix.IPPROTO_UDP
+	default:
+		return nil, nil, fmt.Errorf("invalid proto %s", f.Proto)
+	}
+	ext, e := strconv.ParseUint(f.ExtPort, 10, 16)
+	if e != nil {
+		return nil, nil, fmt.Errorf("invalid ext_port %s", f.ExtPort)
+	}
+	internal, e := strconv.ParseUint(f.IntPort, 10, 16)
+	if e != nil {
+		return nil, nil, fmt.Errorf("invalid int_port %s", f.IntPort)
+	}
+	dnat = ifname(expr.MetaKeyIIFNAME)
+	dnat = append(dnat, port(proto, uint16(ext))...)
+	dnat = append(dnat,
+		&expr.Immediate{Register: 1, Data: ip},
+		&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(uint16(internal))},
+		&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1, RegProtoMin: 2},
+	)
+	snat = ipNet(16, &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)})
+	snat = append(snat, port(proto, uint16(internal))...)
+	snat = append(snat,
+		&expr.Immediate{Register: 1, Data: local},
+		&expr.NAT{Type: expr.NATTypeSourceNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1},
+	)
+	return dnat, snat, nil
+}
+
+// ifname matches the interface named tunnelName, the trailing nul keeps it from matching longer names
+func ifname(key expr.MetaKey) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(tunnelName + "\x00")},
+	}
+}
+
+// ipNet matches the ip source (offset 12) or destination (offset 16) address against a network
+func ipNet(offset uint32, n *net.IPNet) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: 4},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: n.Mask, Xor: []byte{0, 0, 0, 0}},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: n.IP.To4()},
+	}
+}
+
+// port matches the protocol and destination port
+func port(proto byte, dport uint16) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(dport)},
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// withNetns creates a named network namespace for the test and opens the netlink, nftables and wireguard handles
+// in it, like netns in connected.conf does. skipped without root.
+func withNetns(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("network namespaces need root")
+	}
+	name := fmt.Sprintf("connected-test-%d", os.Getpid())
+	runtime.LockOSThread()
+	orig, e := netns.Get()
+	if e != nil {
+		runtime.UnlockOSThread()
+		t.Fatal(e)
+	}
+	// NewNamed moves the thread into the new namespace, go back before anything else runs on it
+	ns, e := netns.NewNamed(name)
+	if e == nil {
+		ns.Close()
+		e = netns.Set(orig)
+	}
+	orig.Close()
+	runtime.UnlockOSThread()
+	if e != nil {
+		_ = netns.DeleteNamed(name)
+		t.Skipf("could not create network namespace %s: %s", name, e)
+	}
+	oldName := netnsName
+	netnsName = name
+	t.Cleanup(func() {
+		if wgc != nil {
+			_ = wgc.Close()
+		}
+		if nlh != nil {
+			nlh.Delete()
+		}
+		nlh, nft, wgc = nil, nil, nil
+		netnsName = oldName
+		_ = netns.DeleteNamed(name)
+	})
+	if e = openNet(); e != nil {
+		t.Fatal(e)
+	}
+}
+
+// fakeUplink adds nic_out as a dummy interface in the namespace with a default route through gateway
+func fakeUplink(t *testing.T) {
+	t.Helper()
+	oldNic, oldGateway := nicOut, gateway
+	t.Cleanup(func() { nicOut, gateway = oldNic, oldGateway })
+	nicOut, gateway = "eth0", "192.168.1.1"
+	link := addLink(t, nicOut)
+	addr, _ := netlink.ParseAddr("192.168.1.2/24")
+	e := nlh.AddrAdd(link, addr)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = nlh.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Gw: net.ParseIP(gateway)}); e != nil {
+		t.Fatal(e)
+	}
+}
+
+// addLink adds an interface that is up, a dummy or an empty bridge on kernels without dummy interfaces
+func addLink(t *testing.T, name string) netlink.Link {
+	t.Helper()
+	attrs := netlink.LinkAttrs{Name: name}
+	e := nlh.LinkAdd(&netlink.Dummy{LinkAttrs: attrs})
+	if e != nil {
+		e = nlh.LinkAdd(&netlink.Bridge{LinkAttrs: attrs})
+	}
+	if e != nil {
+		t.Fatalf("add interface %s: %s", name, e)
+	}
+	link, e := nlh.LinkByName(name)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = nlh.LinkSetUp(link); e != nil {
+		t.Fatal(e)
+	}
+	return link
+}
+
+// routes returns the ipv4 and ipv6 routes in the main table by destination, "default" for the default routes
+func routes(t *testing.T) map[string]netlink.Route {
+	t.Helper()
+	rs := make(map[string]netlink.Route)
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		list, e := nlh.RouteList(nil, family)
+		if e != nil {
+			t.Fatal(e)
+		}
+		for _, r := range list {
+			key := "default"
+			if r.Dst != nil {
+				key = r.Dst.String()
+			}
+			rs[key] = r
+		}
+	}
+	return rs
+}
+
+// checkTunnelRoutes checks that the default route of the host is still there and the halves go through link
+func checkTunnelRoutes(t *testing.T, link netlink.Link) {
+	t.Helper()
+	rs := routes(t)
+	if r, ok := rs["default"]; !ok || !r.Gw.Equal(net.ParseIP(gateway)) {
+		t.Errorf("default route through %s is gone: %v", gateway, rs)
+	}
+	for _, dst := range []string{"0.0.0.0/1", "128.0.0.0/1", "::/1", "8000::/1", "10.64.0.1/32"} {
+		r, ok := rs[dst]
+		if !ok {
+			t.Errorf("no route to %s", dst)
+		} else if r.LinkIndex != link.Attrs().Index {
+			t.Errorf("route to %s goes through interface %d, want %s", dst, r.LinkIndex, link.Attrs().Name)
+		}
+	}
+	if _, ok := rs["0.0.0.0/0"]; ok {
+		t.Error("default route was replaced")
+	}
+}
+
+func allowedIps(t *testing.T) []net.IPNet {
+	t.Helper()
+	var nets []net.IPNet
+	for _, a := range []string{"0.0.0.0/0", "::/0", "10.64.0.1/32"} {
+		_, n, e := net.ParseCIDR(a)
+		if e != nil {
+			t.Fatal(e)
+		}
+		nets = append(nets, *n)
+	}
+	return nets
+}
+
+func TestSplitDefault(t *testing.T) {
+	tests := []struct {
+		network string
+		want    []string
+	}{
+		{"0.0.0.0/0", []string{"0.0.0.0/1", "128.0.0.0/1"}},
+		{"::/0", []string{"::/1", "8000::/1"}},
+		{"10.64.0.0/10", []string{"10.64.0.0/10"}},
+		{"fc00:bbbb:bbbb:bb01::/64", []string{"fc00:bbbb:bbbb:bb01::/64"}},
+	}
+	for _, tt := range tests {
+		_, n, e := net.ParseCIDR(tt.network)
+		if e != nil {
+			t.Fatal(e)
+		}
+		var got []string
+		for _, s := range splitDefault(*n) {
+			got = append(got, s.String())
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("splitDefault(%s) = %v, want %v", tt.network, got, tt.want)
+		}
+	}
+}
+
+func TestSetDnsNetns(t *testing.T) {
+	before, _ := os.ReadFile("/etc/resolv.conf")
+	oldName := netnsName
+	netnsName = "connected-test"
+	defer func() { netnsName = oldName }()
+	if e := setDns([]string{"10.64.0.1"}); e != nil {
+		t.Fatal(e)
+	}
+	restoreDns()
+	after, _ := os.ReadFile("/etc/resolv.conf")
+	if !bytes.Equal(before, after) || oldResolv != nil {
+		t.Error("setDns changed resolv.conf with netns set")
+	}
+}
+
+func TestApplyNat(t *testing.T) {
+	withNetns(t)
+	oldNet, oldLocal, oldForwards, oldTunnel := networkIdIn, localInIp, forwards, tunnelName
+	defer func() { networkIdIn, localInIp, forwards, tunnelName = oldNet, oldLocal, oldForwards, oldTunnel }()
+	networkIdIn, localInIp, tunnelName = "192.168.1.0/24", "192.168.1.2", "se-sto-wg-001"
+	forwards = map[string][]*Forward{
+		"plex": {
+			{Host: "plex", Proto: "tcp", ExtPort: "32400", IntPort: "32400", Ip: "192.168.1.10"},
+			{Host: "plex", Proto: "udp", ExtPort: "1900", IntPort: "1900", Ip: "192.168.1.10"},
+			{Host: "plex", Proto: "icmp", ExtPort: "1", IntPort: "1", Ip: "192.168.1.10"},
+		},
+	}
+	// applied twice, the second replaces the first
+	for i := 0; i < 2; i++ {
+		if e := applyNat(); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if !natActive {
+		t.Error("natActive not set")
+	}
+	table, e := nft.ListTableOfFamily(natTable.Name, natTable.Family)
+	if e != nil {
+		t.Fatalf("table %s: %s", natTable.Name, e)
+	}
+	// masquerade for both local networks and snat for each valid forward, dnat for each valid forward
+	for chain, want := range map[string]int{"prerouting": 2, "postrouting": 4} {
+		c, e := nft.ListChain(table, chain)
+		if e != nil {
+			t.Fatalf("chain %s: %s", chain, e)
+		}
+		rules, e := nft.GetRules(table, c)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if len(rules) != want {
+			t.Errorf("chain %s has %d rules, want %d", chain, len(rules), want)
+		}
+		// dnat and masquerade match the tunnel interface, snat matches the forwarded host
+		matched := 0
+		for _, r := range rules {
+			if cmp, ok := r.Exprs[1].(*expr.Cmp); ok && string(cmp.Data) == tunnelName+"\x00" {
+				matched++
+			}
+		}
+		if matched != 2 {
+			t.Errorf("chain %s has %d rules for interface %s, want 2", chain, matched, tunnelName)
+		}
+	}
+
+	if e = removeNat(); e != nil {
+		t.Fatal(e)
+	}
+	if _, e = nft.ListTableOfFamily(natTable.Name, natTable.Family); e == nil {
+		t.Error("table still there after removeNat")
+	}
+	if natActive {
+		t.Error("natActive still set")
+	}
+}
+
+func TestTunnelRoutes(t *testing.T) {
+	withNetns(t)
+	fakeUplink(t)
+	link := addLink(t, "mullvad-test")
+	e := tunnelRoutes(link, []wgtypes.PeerConfig{{AllowedIPs: allowedIps(t)}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	checkTunnelRoutes(t, link)
+
+	if e = nlh.LinkDel(link); e != nil {
+		t.Fatal(e)
+	}
+	if _, ok := routes(t)["default"]; !ok {
+		t.Error("no default route after the tunnel went away")
+	}
+}
+
+func TestWgUp(t *testing.T) {
+	withNetns(t)
+	// needs the wireguard kernel module
+	probe := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: "wgprobe"}}
+	if e := nlh.LinkAdd(probe); e != nil {
+		t.Skipf("no wireguard interfaces: %s", e)
+	}
+	_ = nlh.LinkDel(probe)
+	fakeUplink(t)
+
+	key, e := wgtypes.GeneratePrivateKey()
+	if e != nil {
+		t.Fatal(e)
+	}
+	peer, e := wgtypes.GeneratePrivateKey()
+	if e != nil {
+		t.Fatal(e)
+	}
+	conf := WgConf{filename: filepath.Join(t.TempDir(), "mullvad-se4.conf"), name: "mullvad-se4"}
+	text := fmt.Sprintf("[Interface]\nPrivateKey = %s\nAddress = 10.64.0.2/32,fc00:bbbb:bbbb:bb01::2/128\n"+
+		"DNS = 10.64.0.1\n\n[Peer]\nPublicKey = %s\nAllowedIPs = 0.0.0.0/0,::/0,10.64.0.1/32\n"+
+		"Endpoint = 192.168.1.50:51820\n", key, peer.PublicKey())
+	if e = os.WriteFile(conf.filename, []byte(text), 0600); e != nil {
+		t.Fatal(e)
+	}
+	resolv, _ := os.ReadFile("/etc/resolv.conf")
+
+	if e = wgUp(conf); e != nil {
+		t.Fatal(e)
+	}
+	link, e := nlh.LinkByName(conf.name)
+	if e != nil {
+		t.Fatal(e)
+	}
+	addrs, e := nlh.AddrList(link, netlink.FAMILY_ALL)
+	if e != nil {
+		t.Fatal(e)
+	}
+	found := 0
+	for _, a := range addrs {
+		if isAny(a.IPNet.String(), "10.64.0.2/32", "fc00:bbbb:bbbb:bb01::2/128") {
+			found++
+		}
+	}
+	if found != 2 {
+		t.Errorf("interface has %v, want 10.64.0.2/32 and fc00:bbbb:bbbb:bb01::2/128", addrs)
+	}
+	dev, e := wgc.Device(conf.name)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if dev.PrivateKey != key || len(dev.Peers) != 1 || dev.Peers[0].PublicKey != peer.PublicKey() {
+		t.Error("wireguard device doesn't have the key and peer from the conf")
+	}
+	checkTunnelRoutes(t, link)
+	if b, _ := os.ReadFile("/etc/resolv.conf"); !bytes.Equal(b, resolv) {
+		t.Error("resolv.conf changed in a namespace run")
+	}
+
+	if e = wgDown(conf); e != nil {
+		t.Fatal(e)
+	}
+	if _, e = nlh.LinkByName(conf.name); e == nil {
+		t.Error("interface still there after wgDown")
+	}
+	if _, ok := routes(t)["default"]; !ok {
+		t.Error("no default route after wgDown")
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	server selection
+		stats are kept for every server and saved to stats_file (default /var/lib/connected/stats.json) so they
+		survive restarts:
+			handshake   time from bringing the interface up to the first wireguard handshake
+			latency     ping to heartbeat_ip through the tunnel, averaged over every heartbeat
+			throughput  download speed of throughput_url, if set, sampled once per connection
+			failures    failed connections in a row, with the time of the last one
+		the next server is the one with the best score. servers that were never used score untriedScore so they get
+		tried. a failed server is skipped for cooldown minutes (default 10), doubled for every failure in a row up to
+		maxCooldown. when every server is cooling down, connected waits for the one that comes off cooldown first.
+		prefer in connected.conf lists servers by conf name that are used before any other when they aren't cooling
+		down. countries limits the servers to those countries, taken from the conf names (mullvad-se4, se-sto-wg-001
+		are se).
+*/
+
+var (
+	statsFile     = "/var/lib/connected/stats.json"
+	throughputUrl string
+	preferred     []string
+	countries     []string
+	cooldown      = 10 * time.Minute
+	maxCooldown   = 6 * time.Hour
+	untriedScore  = 70.0
+	handshakeWait = 15 * time.Second
+	sampleTime    = 15 * time.Second
+	sampleBytes   = int64(50 << 20)
+	stats         = Stats{Servers: make(map[string]*ServerStats)}
+	reCountry     = regexp.MustCompile(`^([a-z]{2})(\d|-|$)`)
+	rePingAvg     = regexp.MustCompile(`= [\d.]+/([\d.]+)/`)
+	rePingTime    = regexp.MustCompile(`time=([\d.]+) ms`)
+)
+
+type Stats struct {
+	sync.Mutex
+	Servers map[string]*ServerStats `json:"servers"`
+}
+
+type ServerStats struct {
+	Handshake   float64   `json:"handshake_ms"`
+	Latency     float64   `json:"latency_ms"`
+	Throughput  float64   `json:"throughput_kbps"`
+	Failures    int       `json:"failures"`
+	TotalFails  int       `json:"total_failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LastUsed    time.Time `json:"last_used"`
+}
+
+// score is up to 100 for a fast server that hasn't failed, plus up to 20 for throughput
+func (s *ServerStats) score() float64 {
+	if s == nil {
+		return untriedScore
+	}
+	if s.LastUsed.IsZero() {
+		return untriedScore - 15*float64(s.Failures)
+	}
+	score := 100.0
+	if s.Latency > 0 {
+		score -= math.Min(40, s.Latency/5)
+	}
+	if s.Handshake > 0 {
+		score -= math.Min(20, s.Handshake/250)
+	}
+	if s.Throughput > 0 {
+		score += math.Min(20, s.Throughput/5000)
+	}
+	return score - 15*float64(s.Failures)
+}
+
+// coolUntil returns when a server can be used again after failing, zero if it didn't fail
+func (s *ServerStats) coolUntil() time.Time {
+	if s == nil || s.Failures == 0 {
+		return time.Time{}
+	}
+	d := cooldown
+	for i := 1; i < s.Failures && d < maxCooldown; i++ {
+		d *= 2
+	}
+	if d > maxCooldown {
+		d = maxCooldown
+	}
+	return s.LastFailure.Add(d)
+}
+
+func loadStats() {
+	// servers with the same score are picked at random
+	rand.Seed(time.Now().UnixNano())
+	b, e := os.ReadFile(statsFile)
+	if e != nil {
+		if !os.IsNotExist(e) {
+			p("could not read server stats from %s: %s", statsFile, e)
+		}
+		return
+	}
+	e = json.Unmarshal(b, &stats)
+	if e != nil {
+		p("could not parse server stats in %s: %s", statsFile, e)
+	}
+	if stats.Servers == nil {
+		stats.Servers = make(map[string]*ServerStats)
+	}
+}
+
+// saveStats writes the stats, with stats locked
+func saveStats() {
+	b, e := json.MarshalIndent(&stats, "", "  ")
+	if e != nil {
+		chk(e)
+		return
+	}
+	e = os.MkdirAll(filepath.Dir(statsFile), 0755)
+	if e == nil {
+		e = os.WriteFile(statsFile, b, 0644)
+	}
+	chk(e)
+}
+
+// update changes the stats of a server and saves them
+func update(name string, f func(s *ServerStats)) {
+	stats.Lock()
+	defer stats.Unlock()
+	s, ok := stats.Servers[name]
+	if !ok {
+		s = &ServerStats{}
+		stats.Servers[name] = s
+	}
+	f(s)
+	saveStats()
+}
+
+func serverFailed(name string) {
+	update(name, func(s *ServerStats) {
+		s.Failures++
+		s.TotalFails++
+		s.LastFailure = time.Now()
+		p("server %s failed %d times in a row, cooling down until %s", name, s.Failures,
+			s.coolUntil().Format("15:04:05"))
+	})
+}
+
+func getStats(name string) *ServerStats {
+	stats.Lock()
+	defer stats.Unlock()
+	if s, ok := stats.Servers[name]; ok {
+		c := *s
+		return &c
+	}
+	return nil
+}
+
+// country returns the country code in a conf name, "" if there is none
+func country(name string) string {
+	name = strings.TrimPrefix(strings.ToLower(name), "mullvad-")
+	m := reCountry.FindStringSubmatch(name)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// filterCountries drops the confs not in countries
+func filterCountries() {
+	if len(countries) == 0 {
+		return
+	}
+	var keep []WgConf
+	for _, c := range confs {
+		if isAny(country(c.name), countries...) {
+			keep = append(keep, c)
+		}
+	}
+	if len(keep) == 0 {
+		p("no conf files for countries %v, using all of them", countries)
+		return
+	}
+	confs = keep
+}
+
+// nextServer returns the server to connect to next. prev is skipped when there are others.
+func nextServer(prev string) WgConf {
+	var candidates []WgConf
+	for _, c := range confs {
+		if c.name != prev || len(confs) == 1 {
+			candidates = append(candidates, c)
+		}
+	}
+	// shuffle so servers with the same score take turns
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+
+	now := time.Now()
+	var ready, pinned []WgConf
+	for _, c := range candidates {
+		if getStats(c.name).coolUntil().After(now) {
+			continue
+		}
+		ready = append(ready, c)
+		if isAny(c.name, preferred...) {
+			pinned = append(pinned, c)
+		}
+	}
+	if len(ready) == 0 {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return getStats(candidates[i].name).coolUntil().Before(getStats(candidates[j].name).coolUntil())
+		})
+		until := getStats(candidates[0].name).coolUntil()
+		p("all servers are cooling down, waiting until %s for %s", until.Format("15:04:05"), candidates[0].name)
+		time.Sleep(time.Until(until))
+		return candidates[0]
+	}
+	if len(pinned) > 0 {
+		ready = pinned
+	}
+	sort.SliceStable(ready, func(i, j int) bool {
+		return getStats(ready[i].name).score() > getStats(ready[j].name).score()
+	})
+	p("next server %s, score %.1f", ready[0].name, getStats(ready[0].name).score())
+	return ready[0]
+}
+
+func printScores() {
+	for _, c := range confs {
+		s := getStats(c.name)
+		var notes string
+		if isAny(c.name, preferred...) {
+			notes += ", preferred"
+		}
+		if t := s.coolUntil(); t.After(time.Now()) {
+			notes += ", cooling down until " + t.Format("15:04:05")
+		}
+		p("server %s score %.1f%s", c.name, s.score(), notes)
+	}
+}
+
+// waitHandshake waits for the first handshake on a wireguard interface and records how long it took. wireguard
+// only starts a handshake when there is traffic, so heartbeat_ip is pinged while waiting.
+func waitHandshake(name string) bool {
+	start := time.Now()
+	ping := exec.Command("ping", heartbeatIp, "-i", "1", "-w", strconv.Itoa(int(handshakeWait.Seconds())))
+	if e := ping.Start(); e == nil {
+		defer func() {
+			_ = ping.Process.Kill()
+			_ = ping.Wait()
+		}()
+	}
+	for time.Since(start) < handshakeWait {
+		last, e := lastHandshake(name)
+		if e == nil && !last.IsZero() {
+			ms := float64(time.Since(start).Milliseconds())
+			p("handshake with %s after %.0f ms", name, ms)
+			update(name, func(s *ServerStats) {
+				s.Handshake = ms
+				s.LastUsed = time.Now()
+			})
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+// sampleServer measures latency and throughput of a new connection
+func sampleServer(name string) {
+	out, e := exec.Command("ping", heartbeatIp, "-c", "3", "-q").Output()
+	if e == nil {
+		if m := rePingAvg.FindStringSubmatch(string(out)); m != nil {
+			ms, _ := strconv.ParseFloat(m[1], 64)
+			p("latency through %s: %.1f ms", name, ms)
+			update(name, func(s *ServerStats) {
+				s.Latency = ms
+			})
+		}
+	}
+	if throughputUrl == "" {
+		return
+	}
+	client := http.Client{Timeout: sampleTime}
+	start := time.Now()
+	rsp, e := client.Get(throughputUrl)
+	if e != nil {
+		p("throughput sample failed: %s", e)
+		return
+	}
+	defer rsp.Body.Close()
+	n, _ := io.CopyN(io.Discard, rsp.Body, sampleBytes)
+	secs := time.Since(start).Seconds()
+	if n == 0 || secs == 0 {
+		return
+	}
+	kbps := float64(n) * 8 / 1000 / secs
+	p("throughput through %s: %.0f kbps", name, kbps)
+	update(name, func(s *ServerStats) {
+		s.Throughput = kbps
+	})
+}
+
+// heartbeat pings heartbeat_ip once, keeping a running average of the latency
+func heartbeat(name string) error {
+	out, e := exec.Command("ping", heartbeatIp, "-c", "1").Output()
+	if e != nil {
+		return e
+	}
+	if m := rePingTime.FindStringSubmatch(string(out)); m != nil {
+		ms, _ := strconv.ParseFloat(m[1], 64)
+		update(name, func(s *ServerStats) {
+			if s.Latency == 0 {
+				s.Latency = ms
+			} else {
+				s.Latency = 0.8*s.Latency + 0.2*ms
+			}
+			// a working connection clears the failures in a row
+			s.Failures = 0
+		})
+	}
+	return nil
+}
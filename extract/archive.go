@@ -0,0 +1,745 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+/*
+	archives
+		every archive format is handled through the Archive interface
+			Format       rar, zip, 7z, tar, gz, bz2, xz, zst or iso
+			First        volume extraction starts from
+			Volumes      all volumes in the set, removed after extraction
+			IsEncrypted  files or headers in the archive are encrypted
+			TryPassword  check a password against an encrypted archive, Extract uses it if it works
+			List         files and folders in the archive, used to pick the destination (see dest.go)
+			Extract      extract everything into a folder, skipping or renaming members as the Plan says
+		detect recognizes archive volumes by name and checks the format from the magic bytes at the start of the
+		file, so name.001 can be a rar, zip or 7z volume. archiveSets groups the volumes in a folder into sets.
+			rar  name.rar name.r00 name.s00, name.part01.rar, name.000 name.001        unrar
+			zip  name.zip, name.z01 .. name.zip (split), name.001 .. (split with hjsplit/7z)  archive/zip
+			7z   name.7z, name.7z.001 ..                                              github.com/bodgit/sevenzip
+			tar  name.tar .tar.gz .tgz .tar.bz2 .tbz2 .tar.xz .txz .tar.zst, single files compressed with
+			     .gz .bz2 .xz .zst are decompressed next to the archive
+			iso  name.iso, name.img with an iso9660 or udf volume (see disc.go)
+*/
+
+const (
+	fmtRar    = "rar"
+	fmtZip    = "zip"
+	fmt7z     = "7z"
+	fmtTar    = "tar"
+	fmtGz     = "gz"
+	fmtBz2    = "bz2"
+	fmtXz     = "xz"
+	fmtZst    = "zst"
+	fmtIso    = "iso"
+	fmtVolume = "volume" // numbered volume with no magic bytes, format comes from the first volume of its set
+)
+
+type Archive interface {
+	Format() string
+	First() string
+	Volumes() []string
+	IsEncrypted() bool
+	TryPassword(pw string) bool
+	List() ([]Member, error)
+	Extract(dst string, pl *Plan) error
+}
+
+var (
+	magics = []struct {
+		format string
+		offset int
+		magic  []byte
+	}{
+		{fmtRar, 0, []byte("Rar!\x1a\x07")},
+		{fmtZip, 0, []byte("PK\x03\x04")},
+		{fmtZip, 0, []byte("PK\x05\x06")},
+		{fmtZip, 0, []byte("PK\x07\x08")}, // first volume of a split zip
+		{fmt7z, 0, []byte("7z\xbc\xaf\x27\x1c")},
+		{fmtGz, 0, []byte("\x1f\x8b")},
+		{fmtBz2, 0, []byte("BZh")},
+		{fmtXz, 0, []byte("\xfd7zXZ\x00")},
+		{fmtZst, 0, []byte("\x28\xb5\x2f\xfd")},
+		{fmtTar, 257, []byte("ustar")},
+		{fmtIso, 32769, []byte("CD001")}, // iso9660 primary volume descriptor in sector 16
+		{fmtIso, 32769, []byte("BEA01")}, // udf volume recognition sequence
+	}
+	rePartRar = regexp.MustCompile(`^(.+)\.part(\d+)\.rar$`)
+	reRar     = regexp.MustCompile(`^(.+)\.rar$`)
+	reRarVol  = regexp.MustCompile(`^(.+)\.([rs])(\d{2})$`)
+	reZip     = regexp.MustCompile(`^(.+)\.zip$`)
+	reZipVol  = regexp.MustCompile(`^(.+)\.z(\d{2})$`)
+	re7z      = regexp.MustCompile(`^(.+)\.7z$`)
+	re7zVol   = regexp.MustCompile(`^(.+)\.7z\.(\d{3})$`)
+	reNumVol  = regexp.MustCompile(`^(.+)\.(\d{3})$`)
+	reIso     = regexp.MustCompile(`^(.+)\.(iso|img)$`)
+	reTar     = regexp.MustCompile(`\.(tar|tgz|tbz2|txz|tar\.gz|tar\.bz2|tar\.xz|tar\.zst|gz|bz2|xz|zst)$`)
+)
+
+// magicFormat returns the archive format from the magic bytes at the start of a file, or ""
+func magicFormat(path string) string {
+	f, e := os.Open(path)
+	if e != nil {
+		return ""
+	}
+	defer f.Close()
+	size := 0
+	for _, m := range magics {
+		if m.offset+len(m.magic) > size {
+			size = m.offset + len(m.magic)
+		}
+	}
+	buf := make([]byte, size)
+	n, _ := io.ReadFull(f, buf)
+	buf = buf[:n]
+	for _, m := range magics {
+		end := m.offset + len(m.magic)
+		if len(buf) >= end && bytes.Equal(buf[m.offset:end], m.magic) {
+			return m.format
+		}
+	}
+	return ""
+}
+
+// parseVolume returns the set a volume belongs to, the format implied by its name and its position in the set
+func parseVolume(path string) (set, format string, order int, ok bool) {
+	name := strings.ToLower(filepath.Base(path))
+	num := func(s string) int {
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	if m := rePartRar.FindStringSubmatch(name); m != nil {
+		return m[1] + ".rar", fmtRar, num(m[2]), true
+	}
+	if m := reRar.FindStringSubmatch(name); m != nil {
+		return m[1] + ".rar", fmtRar, -1, true
+	}
+	if m := reRarVol.FindStringSubmatch(name); m != nil {
+		order = num(m[3])
+		if m[2] == "s" {
+			order += 100
+		}
+		return m[1] + ".rar", fmtRar, order, true
+	}
+	if m := reZip.FindStringSubmatch(name); m != nil {
+		// the .zip of a split set is the last volume
+		return m[1] + ".zip", fmtZip, 1000, true
+	}
+	if m := reZipVol.FindStringSubmatch(name); m != nil {
+		return m[1] + ".zip", fmtZip, num(m[2]), true
+	}
+	if m := re7zVol.FindStringSubmatch(name); m != nil {
+		return m[1] + ".7z", fmt7z, num(m[2]), true
+	}
+	if m := re7z.FindStringSubmatch(name); m != nil {
+		return m[1] + ".7z", fmt7z, 0, true
+	}
+	if m := reNumVol.FindStringSubmatch(name); m != nil {
+		return m[1] + ".###", "", num(m[2]), true
+	}
+	if reIso.MatchString(name) {
+		return name, fmtIso, 0, true
+	}
+	if reTar.MatchString(name) {
+		return name, fmtTar, 0, true
+	}
+	return "", "", 0, false
+}
+
+// detect returns the format of an archive volume, or "" if the file isn't one
+func detect(path string) string {
+	st, e := os.Stat(path)
+	if e != nil {
+		chk(e)
+		return ""
+	} else if st.IsDir() {
+		return ""
+	}
+	_, format, _, ok := parseVolume(path)
+	if !ok {
+		return ""
+	}
+	magic := magicFormat(path)
+	switch format {
+	case fmtIso:
+		// .img is also used for raw disk images
+		if magic == fmtIso {
+			return fmtIso
+		}
+		return ""
+	case fmtTar:
+		if isAny(magic, fmtTar, fmtGz, fmtBz2, fmtXz, fmtZst) {
+			return magic
+		}
+		return ""
+	case "":
+		if isAny(magic, fmtRar, fmtZip, fmt7z) {
+			return magic
+		}
+		return fmtVolume
+	}
+	if isAny(magic, fmtRar, fmtZip, fmt7z) {
+		return magic
+	}
+	// continuation volumes of split zip and 7z sets have no magic bytes
+	return format
+}
+
+// archiveSets groups archive volumes into sets and returns an Archive for each set
+func archiveSets(paths []string) []Archive {
+	type volume struct {
+		path, format string
+		order        int
+	}
+	sets := make(map[string][]volume)
+	var keys []string
+	for _, path := range paths {
+		set, _, order, ok := parseVolume(path)
+		if !ok {
+			continue
+		}
+		key := filepath.Join(filepath.Dir(path), set)
+		if _, seen := sets[key]; !seen {
+			keys = append(keys, key)
+		}
+		sets[key] = append(sets[key], volume{path: path, format: detect(path), order: order})
+	}
+	sort.Strings(keys)
+
+	var archives []Archive
+	for _, key := range keys {
+		vols := sets[key]
+		sort.SliceStable(vols, func(a, b int) bool {
+			return vols[a].order < vols[b].order
+		})
+		var paths []string
+		for _, v := range vols {
+			paths = append(paths, v.path)
+		}
+		switch vols[0].format {
+		case fmtRar:
+			archives = append(archives, &rarArchive{volumes: paths})
+		case fmtZip:
+			spanned := false
+			for _, path := range paths {
+				if reZipVol.MatchString(strings.ToLower(path)) {
+					spanned = true
+				}
+			}
+			archives = append(archives, &zipArchive{volumes: paths, spanned: spanned})
+		case fmt7z:
+			archives = append(archives, &sevenZipArchive{volumes: paths})
+		case fmtIso:
+			archives = append(archives, &discImage{path: paths[0]})
+		case fmtTar, fmtGz, fmtBz2, fmtXz, fmtZst:
+			archives = append(archives, &tarArchive{path: paths[0], format: vols[0].format})
+		default:
+			p("no archive found at start of volume set, skipping: %s", vols[0].path)
+		}
+	}
+	return archives
+}
+
+// safePath joins an archive member name to dst and refuses names that would end up outside of dst
+func safePath(dst, name string) (string, error) {
+	path := filepath.Join(dst, filepath.FromSlash(name))
+	rel, e := filepath.Rel(dst, path)
+	if e != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive member outside of destination folder: %s", name)
+	}
+	return path, nil
+}
+
+// writeMember writes one file from an archive to dst under the name the plan gives it and returns its path,
+// or "" if the plan skips it
+func writeMember(dst, name string, mode os.FileMode, r io.Reader, pl *Plan) (string, error) {
+	if !mode.IsDir() {
+		var ok bool
+		if name, ok = pl.target(name); !ok {
+			return "", nil
+		}
+	}
+	path, e := safePath(dst, name)
+	if e != nil {
+		return "", e
+	}
+	if mode.IsDir() {
+		return path, os.MkdirAll(path, 0755)
+	}
+	e = os.MkdirAll(filepath.Dir(path), 0755)
+	if e != nil {
+		return "", e
+	}
+	perm := mode.Perm()
+	if perm == 0 {
+		perm = 0644
+	}
+	f, e := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if e != nil {
+		return "", e
+	}
+	_, e = io.Copy(f, r)
+	if e2 := f.Close(); e == nil {
+		e = e2
+	}
+	return path, e
+}
+
+type rarArchive struct {
+	volumes  []string
+	password string
+}
+
+func (a *rarArchive) Format() string    { return fmtRar }
+func (a *rarArchive) First() string     { return a.volumes[0] }
+func (a *rarArchive) Volumes() []string { return a.volumes }
+func (a *rarArchive) IsEncrypted() bool {
+	out, _ := exec.Command(unrar, "l", "-p-", a.First()).CombinedOutput()
+	s := string(out)
+	// encrypted files are marked with * in the listing
+	if regexp.MustCompile(`(?m)^\s*\*`).MatchString(s) {
+		return true
+	}
+	if regexp.MustCompile(`Details: .+encrypted headers`).MatchString(s) {
+		return true
+	}
+	return strings.Contains(s, "password is incorrect")
+}
+func (a *rarArchive) TryPassword(pw string) bool {
+	// test extracts to memory, a wrong password fails the crc or the header check
+	if exec.Command(unrar, "t", "-idq", "-p"+pw, a.First()).Run() != nil {
+		return false
+	}
+	a.password = pw
+	return true
+}
+func (a *rarArchive) List() ([]Member, error) {
+	pw := "-p-"
+	if a.password != "" {
+		pw = "-p" + a.password
+	}
+	out, e := exec.Command(unrar, "lt", pw, a.First()).Output()
+	if e != nil {
+		return nil, e
+	}
+	// technical listing, one "key: value" block per member
+	var members []Member
+	for _, line := range strings.Split(string(out), "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), ": ")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "Name":
+			members = append(members, Member{Name: v, Size: -1})
+		case "Type":
+			if len(members) > 0 {
+				members[len(members)-1].Dir = v == "Directory"
+			}
+		case "Size":
+			if len(members) > 0 {
+				members[len(members)-1].Size, _ = strconv.ParseInt(v, 10, 64)
+			}
+		}
+	}
+	if len(members) == 0 {
+		return nil, errors.New("no members in listing")
+	}
+	return members, nil
+}
+func (a *rarArchive) Extract(dst string, pl *Plan) error {
+	return runPlanned(dst, pl, func(dst string, only, exclude []string) error {
+		cmd := []string{unrar, "x", "-o+", "-y"}
+		if a.password != "" {
+			cmd = append(cmd, "-p"+a.password)
+		}
+		for _, n := range exclude {
+			cmd = append(cmd, "-x"+n)
+		}
+		cmd = append(cmd, a.First())
+		cmd = append(cmd, only...)
+		return run(append(cmd, strings.TrimSuffix(dst, "/")+"/")...)
+	})
+}
+
+type zipArchive struct {
+	volumes  []string
+	password string
+	spanned  bool // name.z01 .. name.zip set with offsets relative to each volume
+}
+
+func (a *zipArchive) Format() string    { return fmtZip }
+func (a *zipArchive) First() string     { return a.volumes[0] }
+func (a *zipArchive) Volumes() []string { return a.volumes }
+
+// open returns a zip reader over all volumes of the set
+func (a *zipArchive) open() (*zip.Reader, io.Closer, error) {
+	vr, e := openVolumes(a.volumes)
+	if e != nil {
+		return nil, nil, e
+	}
+	if a.spanned {
+		e = vr.rebuildDirectory()
+		if e != nil {
+			vr.Close()
+			return nil, nil, e
+		}
+	}
+	zr, e := zip.NewReader(vr, vr.Size())
+	if e != nil {
+		vr.Close()
+		return nil, nil, e
+	}
+	return zr, vr, nil
+}
+func (a *zipArchive) IsEncrypted() bool {
+	// bit 13 of the first local header means the central directory is encrypted
+	if b, e := readHead(a.First(), 12); e == nil {
+		off := 0
+		if bytes.HasPrefix(b, []byte("PK\x07\x08")) {
+			b, _ = readHead(a.First(), 16)
+			off = 4
+		}
+		if len(b) >= off+8 && bytes.Equal(b[off:off+4], []byte("PK\x03\x04")) {
+			flags := uint16(b[off+6]) | uint16(b[off+7])<<8
+			if flags&0x2000 != 0 {
+				return true
+			}
+		}
+	}
+	zr, c, e := a.open()
+	if e != nil {
+		return false
+	}
+	defer c.Close()
+	for _, f := range zr.File {
+		if isZipEncrypted(f) {
+			return true
+		}
+	}
+	return false
+}
+func (a *zipArchive) TryPassword(pw string) bool {
+	zr, c, e := a.open()
+	if e != nil {
+		return false
+	}
+	defer c.Close()
+	// read the smallest encrypted file to the end so the crc or auth code is checked
+	var small *zip.File
+	for _, f := range zr.File {
+		if isZipEncrypted(f) && (small == nil || f.CompressedSize64 < small.CompressedSize64) {
+			small = f
+		}
+	}
+	if small == nil {
+		return false
+	}
+	rc, e := openEncrypted(small, pw)
+	if e != nil {
+		return false
+	}
+	defer rc.Close()
+	_, e = io.Copy(io.Discard, rc)
+	if e != nil {
+		return false
+	}
+	a.password = pw
+	return true
+}
+func (a *zipArchive) List() ([]Member, error) {
+	zr, c, e := a.open()
+	if e != nil {
+		return nil, e
+	}
+	defer c.Close()
+	var members []Member
+	for _, f := range zr.File {
+		members = append(members, Member{Name: f.Name, Size: int64(f.UncompressedSize64), Dir: f.Mode().IsDir()})
+	}
+	return members, nil
+}
+func (a *zipArchive) Extract(dst string, pl *Plan) error {
+	zr, c, e := a.open()
+	if e != nil {
+		return e
+	}
+	defer c.Close()
+	for _, f := range zr.File {
+		var rc io.ReadCloser
+		if isZipEncrypted(f) {
+			rc, e = openEncrypted(f, a.password)
+		} else {
+			rc, e = f.Open()
+		}
+		if e != nil {
+			return fmt.Errorf("%s: %w", f.Name, e)
+		}
+		path, e := writeMember(dst, f.Name, f.Mode(), rc, pl)
+		rc.Close()
+		if e != nil {
+			return fmt.Errorf("%s: %w", f.Name, e)
+		}
+		if path != "" && !f.Mode().IsDir() {
+			_ = os.Chtimes(path, f.Modified, f.Modified)
+		}
+	}
+	return nil
+}
+
+type sevenZipArchive struct {
+	volumes  []string
+	password string
+}
+
+func (a *sevenZipArchive) Format() string    { return fmt7z }
+func (a *sevenZipArchive) First() string     { return a.volumes[0] }
+func (a *sevenZipArchive) Volumes() []string { return a.volumes }
+func (a *sevenZipArchive) IsEncrypted() bool {
+	r, e := sevenzip.OpenReader(a.First())
+	var re *sevenzip.ReadError
+	if e != nil {
+		return errors.As(e, &re) && re.Encrypted
+	}
+	defer r.Close()
+	// with unencrypted headers, encryption only shows when a file is read
+	for _, f := range r.File {
+		if f.UncompressedSize == 0 {
+			continue
+		}
+		rc, e := f.Open()
+		if e == nil {
+			_, e = rc.Read(make([]byte, 1))
+			rc.Close()
+		}
+		return e != nil && errors.As(e, &re) && re.Encrypted
+	}
+	return false
+}
+func (a *sevenZipArchive) TryPassword(pw string) bool {
+	r, e := sevenzip.OpenReaderWithPassword(a.First(), pw)
+	if e != nil {
+		return false
+	}
+	defer r.Close()
+	// read the smallest file to the end so the crc is checked
+	var small *sevenzip.File
+	for _, f := range r.File {
+		if f.UncompressedSize > 0 && (small == nil || f.UncompressedSize < small.UncompressedSize) {
+			small = f
+		}
+	}
+	if small != nil {
+		rc, e := small.Open()
+		if e != nil {
+			return false
+		}
+		_, e = io.Copy(io.Discard, rc)
+		rc.Close()
+		if e != nil {
+			return false
+		}
+	}
+	a.password = pw
+	return true
+}
+func (a *sevenZipArchive) List() ([]Member, error) {
+	r, e := sevenzip.OpenReaderWithPassword(a.First(), a.password)
+	if e != nil {
+		return nil, e
+	}
+	defer r.Close()
+	var members []Member
+	for _, f := range r.File {
+		members = append(members, Member{Name: f.Name, Size: int64(f.UncompressedSize), Dir: f.Mode().IsDir()})
+	}
+	return members, nil
+}
+func (a *sevenZipArchive) Extract(dst string, pl *Plan) error {
+	r, e := sevenzip.OpenReaderWithPassword(a.First(), a.password)
+	if e != nil {
+		return e
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		rc, e := f.Open()
+		if e != nil {
+			return fmt.Errorf("%s: %w", f.Name, e)
+		}
+		path, e := writeMember(dst, f.Name, f.Mode(), rc, pl)
+		rc.Close()
+		if e != nil {
+			return fmt.Errorf("%s: %w", f.Name, e)
+		}
+		if path != "" && !f.Mode().IsDir() {
+			_ = os.Chtimes(path, f.Modified, f.Modified)
+		}
+	}
+	return nil
+}
+
+type tarArchive struct {
+	path   string
+	format string // tar or the compression around it
+}
+
+func (a *tarArchive) Format() string    { return a.format }
+func (a *tarArchive) First() string     { return a.path }
+func (a *tarArchive) Volumes() []string { return []string{a.path} }
+func (a *tarArchive) IsEncrypted() bool { return false }
+func (a *tarArchive) TryPassword(pw string) bool {
+	return false
+}
+
+// open returns the decompressed stream and a func that closes it
+func (a *tarArchive) open() (io.Reader, func(), error) {
+	f, e := os.Open(a.path)
+	if e != nil {
+		return nil, nil, e
+	}
+	closer := func() { f.Close() }
+	var r io.Reader
+	switch a.format {
+	case fmtGz:
+		r, e = gzip.NewReader(f)
+	case fmtBz2:
+		r = bzip2.NewReader(f)
+	case fmtXz:
+		r, e = xz.NewReader(f)
+	case fmtZst:
+		var zr *zstd.Decoder
+		zr, e = zstd.NewReader(f)
+		if e == nil {
+			r = zr
+			closer = func() {
+				zr.Close()
+				f.Close()
+			}
+		}
+	default:
+		r = f
+	}
+	if e != nil {
+		f.Close()
+		return nil, nil, e
+	}
+	return r, closer, nil
+}
+
+// stream returns the decompressed stream and whether it is a tar, compressed files that aren't tars are single
+// files
+func (a *tarArchive) stream() (io.Reader, bool, func(), error) {
+	r, closer, e := a.open()
+	if e != nil {
+		return nil, false, nil, e
+	}
+	head := make([]byte, 262)
+	n, e := io.ReadFull(r, head)
+	if e != nil && !errors.Is(e, io.ErrUnexpectedEOF) && !errors.Is(e, io.EOF) {
+		closer()
+		return nil, false, nil, e
+	}
+	head = head[:n]
+	r = io.MultiReader(bytes.NewReader(head), r)
+	return r, len(head) == 262 && bytes.Equal(head[257:262], []byte("ustar")), closer, nil
+}
+
+// fileName is the name a compressed file that isn't a tar is written as, the archive name without its extension
+func (a *tarArchive) fileName() string {
+	return strings.TrimSuffix(filepath.Base(a.path), filepath.Ext(a.path))
+}
+func (a *tarArchive) List() ([]Member, error) {
+	r, isTar, closer, e := a.stream()
+	if e != nil {
+		return nil, e
+	}
+	defer closer()
+	if !isTar {
+		return []Member{{Name: a.fileName(), Size: -1}}, nil
+	}
+	var members []Member
+	tr := tar.NewReader(r)
+	for {
+		h, e := tr.Next()
+		if errors.Is(e, io.EOF) {
+			return members, nil
+		}
+		if e != nil {
+			return nil, e
+		}
+		if h.Typeflag == tar.TypeDir || h.Typeflag == tar.TypeReg {
+			members = append(members, Member{Name: h.Name, Size: h.Size, Dir: h.Typeflag == tar.TypeDir})
+		}
+	}
+}
+func (a *tarArchive) Extract(dst string, pl *Plan) error {
+	r, isTar, closer, e := a.stream()
+	if e != nil {
+		return e
+	}
+	defer closer()
+
+	// compressed files that aren't tars are written next to the archive without the compression extension
+	if !isTar {
+		_, e = writeMember(dst, a.fileName(), 0644, r, pl)
+		return e
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		h, e := tr.Next()
+		if errors.Is(e, io.EOF) {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+		switch h.Typeflag {
+		case tar.TypeDir, tar.TypeReg:
+			path, e := writeMember(dst, h.Name, h.FileInfo().Mode(), tr, pl)
+			if e != nil {
+				return fmt.Errorf("%s: %w", h.Name, e)
+			}
+			if path != "" && h.Typeflag == tar.TypeReg {
+				_ = os.Chtimes(path, h.ModTime, h.ModTime)
+			}
+		default:
+			p("skipping %s in %s, links and special files are not extracted", h.Name, a.path)
+		}
+	}
+}
+
+// readHead returns the first n bytes of a file
+func readHead(path string, n int) ([]byte, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	b := make([]byte, n)
+	n, e = io.ReadFull(f, b)
+	if errors.Is(e, io.ErrUnexpectedEOF) {
+		e = nil
+	}
+	return b[:n], e
+}
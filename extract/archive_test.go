@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseVolume(t *testing.T) {
+	tests := []struct {
+		path   string
+		set    string
+		format string
+		order  int
+		ok     bool
+	}{
+		{"/a/Movie.part01.rar", "movie.rar", fmtRar, 1, true},
+		{"/a/Movie.part12.rar", "movie.rar", fmtRar, 12, true},
+		{"/a/Movie.rar", "movie.rar", fmtRar, -1, true},
+		{"/a/movie.r00", "movie.rar", fmtRar, 0, true},
+		{"/a/movie.r15", "movie.rar", fmtRar, 15, true},
+		{"/a/movie.s01", "movie.rar", fmtRar, 101, true},
+		{"/a/movie.zip", "movie.zip", fmtZip, 1000, true},
+		{"/a/movie.z01", "movie.zip", fmtZip, 1, true},
+		{"/a/movie.7z", "movie.7z", fmt7z, 0, true},
+		{"/a/movie.7z.002", "movie.7z", fmt7z, 2, true},
+		{"/a/movie.001", "movie.###", "", 1, true},
+		{"/a/Disc.ISO", "disc.iso", fmtIso, 0, true},
+		{"/a/disc.img", "disc.img", fmtIso, 0, true},
+		{"/a/src.tar.gz", "src.tar.gz", fmtTar, 0, true},
+		{"/a/src.tgz", "src.tgz", fmtTar, 0, true},
+		{"/a/log.zst", "log.zst", fmtTar, 0, true},
+		{"/a/movie.mkv", "", "", 0, false},
+		{"/a/movie.nfo", "", "", 0, false},
+	}
+	for _, tt := range tests {
+		set, format, order, ok := parseVolume(tt.path)
+		if set != tt.set || format != tt.format || order != tt.order || ok != tt.ok {
+			t.Errorf("parseVolume(%q) = %q, %q, %d, %v, want %q, %q, %d, %v", tt.path, set, format, order, ok,
+				tt.set, tt.format, tt.order, tt.ok)
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	dir := t.TempDir()
+	iso := make([]byte, 32774)
+	copy(iso[32769:], "CD001")
+	tar := make([]byte, 512)
+	copy(tar[257:], "ustar")
+	tests := []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{"movie.rar", []byte("Rar!\x1a\x07\x01\x00"), fmtRar},
+		{"movie.r00", []byte("continued rar data"), fmtRar},
+		{"movie.zip", []byte("PK\x03\x04rest"), fmtZip},
+		{"split.zip", []byte("PK\x07\x08PK\x03\x04"), fmtZip},
+		{"split.z01", []byte("continued zip data"), fmtZip},
+		{"movie.7z", []byte("7z\xbc\xaf\x27\x1c"), fmt7z},
+		{"movie.7z.002", []byte("continued 7z data"), fmt7z},
+		{"hj.001", []byte("PK\x03\x04rest"), fmtZip},
+		{"hj.002", []byte("continued data"), fmtVolume},
+		{"disc.iso", iso, fmtIso},
+		{"disk.img", []byte("raw disk image"), ""},
+		{"src.tar", tar, fmtTar},
+		{"src.tar.gz", []byte("\x1f\x8b\x08"), fmtGz},
+		{"src.tar.xz", []byte("\xfd7zXZ\x00"), fmtXz},
+		{"notes.tar.gz", []byte("not gzip"), ""},
+		{"movie.mkv", []byte("\x1a\x45\xdf\xa3"), ""},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		if e := os.WriteFile(path, tt.content, 0644); e != nil {
+			t.Fatal(e)
+		}
+		if got := detect(path); got != tt.want {
+			t.Errorf("detect(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if got := detect(dir); got != "" {
+		t.Errorf("detect(folder) = %q, want \"\"", got)
+	}
+}
+
+func TestArchiveSets(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for _, n := range []string{"movie.r01", "movie.rar", "movie.r00", "other.part2.rar", "other.part1.rar"} {
+		path := filepath.Join(dir, n)
+		if e := os.WriteFile(path, []byte("Rar!\x1a\x07\x01\x00"), 0644); e != nil {
+			t.Fatal(e)
+		}
+		paths = append(paths, path)
+	}
+	sets := archiveSets(paths)
+	if len(sets) != 2 {
+		t.Fatalf("got %d sets, want 2", len(sets))
+	}
+	want := [][]string{{"movie.rar", "movie.r00", "movie.r01"}, {"other.part1.rar", "other.part2.rar"}}
+	for i, s := range sets {
+		vols := s.Volumes()
+		if len(vols) != len(want[i]) {
+			t.Fatalf("set %d has %d volumes, want %d", i, len(vols), len(want[i]))
+		}
+		for j, v := range vols {
+			if filepath.Base(v) != want[i][j] {
+				t.Errorf("set %d volume %d = %s, want %s", i, j, filepath.Base(v), want[i][j])
+			}
+		}
+	}
+}
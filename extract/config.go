@@ -0,0 +1,146 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+	extract.conf
+		optional config file, loaded from the path given with -conf, the EXTRACT_CONF environment variable, or
+		/etc/extract.conf. format is one "key = value" per line, lines starting with # are ignored.
+*/
+
+var (
+	possibleConfs = []string{
+		"/etc/extract.conf",
+	}
+	confFile string
+)
+
+func loadConfig() {
+	if confFile == "" {
+		confFile = os.Getenv("EXTRACT_CONF")
+	}
+	var conf string
+	if confFile != "" {
+		b, e := os.ReadFile(confFile)
+		if e != nil {
+			p("could not read conf file %s: %s", confFile, e)
+			os.Exit(1)
+		}
+		conf = string(b)
+	} else {
+		for _, c := range possibleConfs {
+			b, e := os.ReadFile(c)
+			if e == nil {
+				confFile = c
+				conf = string(b)
+				break
+			}
+		}
+	}
+	if conf == "" {
+		return
+	}
+	p("loading config from %s", confFile)
+
+	replaced := make(map[string]bool)
+	// the first line of a junk list key replaces the defaults
+	replace := func(k string) bool {
+		if replaced[k] {
+			return false
+		}
+		replaced[k] = true
+		return true
+	}
+	reEq := regexp.MustCompile(`\s*=\s*`)
+	for _, line := range strings.Split(conf, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") || !strings.Contains(line, "=") {
+			continue
+		}
+		kv := reEq.Split(line, 2)
+		k, v := strings.ToLower(kv[0]), kv[1]
+		switch k {
+		case "verify":
+			verify = isTrue(v)
+		case "par2":
+			par2 = v
+		case "problem_folder":
+			if probPath == "" {
+				probPath = v
+			}
+		case "password_file":
+			passwordFile = v
+		case "quarantine_folder":
+			if quarPath == "" {
+				quarPath = v
+			}
+		case "seven_zip":
+			sevenZip = v
+		case "mkvmerge":
+			mkvmerge = v
+		case "disc_main_title":
+			discMainTitle = isTrue(v)
+		case "max_depth":
+			maxDepth = atoiConf(k, v)
+		case "junk_ext":
+			if replace(k) {
+				junkExts = nil
+			}
+			junkExts = append(junkExts, strings.Fields(strings.ToLower(v))...)
+		case "junk_folder":
+			if replace(k) {
+				junkSubs = nil
+			}
+			junkSubs = append(junkSubs, strings.Fields(strings.ToLower(v))...)
+		case "junk_regex", "sample_regex":
+			re, e := regexp.Compile(v)
+			if e != nil {
+				p("invalid %s in %s: %s", k, confFile, e)
+				os.Exit(1)
+			}
+			if k == "junk_regex" {
+				junkRegexes = append(junkRegexes, re)
+			} else {
+				if replace(k) {
+					sampleRegexes = nil
+				}
+				sampleRegexes = append(sampleRegexes, re)
+			}
+		case "sample_max_mb":
+			sampleMaxMb = int64(atoiConf(k, v))
+		case "recycle_folder":
+			if recyclePath == "" {
+				setRecycle(v)
+			}
+		case "recycle_days":
+			recycleDays = atoiConf(k, v)
+		case "dest_mode":
+			if destMode == "" {
+				destMode = strings.ToLower(v)
+			}
+		case "collision":
+			if collision == "" {
+				collision = strings.ToLower(v)
+			}
+		default:
+			p("unknown key in %s: %s", confFile, k)
+		}
+	}
+}
+
+func atoiConf(k, v string) int {
+	i, e := strconv.Atoi(v)
+	if e != nil {
+		p("%s in %s must be a number", k, confFile)
+		os.Exit(1)
+	}
+	return i
+}
+func isTrue(v string) bool {
+	return regexp.MustCompile(`(?i)^(true|t|yes|y|1)$`).MatchString(v)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+	destination and collisions
+		dest_mode in extract.conf or -dest picks the folder a set is extracted into
+			same   the folder the archive is in (default)
+			set    a folder named after the set, next to the archive
+			smart  a folder named after the set when the archive has more than one top level entry, otherwise the
+			       folder the archive is in
+		disc images always go into a folder named after the image.
+		before extracting, the archive is listed and every file that already exists in the destination is handled by
+		collision in extract.conf or -collision
+			skip       keep the existing file, don't extract the one from the archive
+			rename     extract the file from the archive as name.1.ext, name.2.ext ..
+			overwrite  replace the existing file (default)
+			larger     keep whichever file is larger
+		sets that can't be listed are extracted with overwrite.
+*/
+
+var (
+	destMode  string
+	collision string
+	destModes = []string{"same", "set", "smart"}
+	policies  = []string{"skip", "rename", "overwrite", "larger"}
+)
+
+// setDest checks dest mode and collision policy from the command line or extract.conf and sets the defaults
+func setDest() {
+	if destMode == "" {
+		destMode = "same"
+	}
+	if collision == "" {
+		collision = "overwrite"
+	}
+	if !isAny(destMode, destModes...) {
+		fmt.Printf("dest mode must be one of %s, not %s.\n", strings.Join(destModes, ", "), destMode)
+		os.Exit(1)
+	}
+	if !isAny(collision, policies...) {
+		fmt.Printf("collision policy must be one of %s, not %s.\n", strings.Join(policies, ", "), collision)
+		os.Exit(1)
+	}
+}
+
+// Member is a file or folder in an archive, Size is -1 when the archive doesn't record it
+type Member struct {
+	Name string
+	Size int64
+	Dir  bool
+}
+
+// Plan says which archive members are left out and which are written under another name, nil writes everything
+type Plan struct {
+	skip   map[string]bool
+	rename map[string]string
+}
+
+// target returns the name a member is written as, false if it is skipped
+func (pl *Plan) target(name string) (string, bool) {
+	if pl == nil {
+		return name, true
+	}
+	key := memberKey(name)
+	if pl.skip[key] {
+		return "", false
+	}
+	if to, ok := pl.rename[key]; ok {
+		return to, true
+	}
+	return name, true
+}
+
+// memberKey cleans an archive member name so names from different listings compare equal
+func memberKey(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// setName returns the name of a set without volume numbers and archive extensions, in its original case
+func setName(a Archive) string {
+	name := filepath.Base(a.First())
+	set, format, _, ok := parseVolume(name)
+	switch {
+	case !ok:
+		return strings.TrimSuffix(name, filepath.Ext(name))
+	case format == fmtIso:
+		return strings.TrimSuffix(name, filepath.Ext(name))
+	case format == fmtTar:
+		return reTar.ReplaceAllString(name, "")
+	}
+	return name[:len(set)-len(filepath.Ext(set))]
+}
+
+// destination returns the folder a set is extracted into and its members, nil if it couldn't be listed
+func destination(a Archive) (string, []Member) {
+	dir := filepath.Dir(a.First())
+	members, e := a.List()
+	if e != nil {
+		p("could not list %s, extracting with overwrite: %s", a.First(), e)
+		members = nil
+	}
+	if a.Format() == fmtIso {
+		return filepath.Join(dir, setName(a)), members
+	}
+	switch destMode {
+	case "set":
+		return filepath.Join(dir, setName(a)), members
+	case "smart":
+		top := make(map[string]bool)
+		for _, m := range members {
+			top[strings.SplitN(memberKey(m.Name), "/", 2)[0]] = true
+		}
+		if len(top) > 1 {
+			return filepath.Join(dir, setName(a)), members
+		}
+	}
+	return dir, members
+}
+
+// collisionPlan checks every member against the files already in dst and returns what the collision policy does
+// with them
+func collisionPlan(a Archive, dst string, members []Member) *Plan {
+	if members == nil {
+		return nil
+	}
+	pl := &Plan{skip: make(map[string]bool), rename: make(map[string]string)}
+	// names that will exist after extract, so two renames don't pick the same name
+	taken := make(map[string]bool)
+	for _, m := range members {
+		taken[memberKey(m.Name)] = true
+	}
+	for _, m := range members {
+		if m.Dir {
+			continue
+		}
+		key := memberKey(m.Name)
+		existing, e := safePath(dst, key)
+		if e != nil {
+			continue
+		}
+		st, e := os.Stat(existing)
+		if e != nil {
+			continue
+		}
+		action := collision
+		if st.IsDir() && action != "rename" {
+			action = "skip"
+		}
+		var reason string
+		switch action {
+		case "skip":
+			pl.skip[key] = true
+			reason = "exists, skipped"
+		case "rename":
+			to := altName(dst, key, taken)
+			taken[to] = true
+			pl.rename[key] = to
+			reason = "exists, extracted as " + to
+		case "larger":
+			if m.Size < 0 || m.Size <= st.Size() {
+				pl.skip[key] = true
+				reason = "exists and is larger, kept"
+			} else {
+				reason = "exists and is smaller, overwritten"
+			}
+		default:
+			reason = "exists, overwritten"
+		}
+		p("%s from %s: %s", existing, a.First(), reason)
+		manifest.Collisions = append(manifest.Collisions, ManifestEntry{Path: existing, Reason: reason})
+	}
+	return pl
+}
+
+// altName returns name.1.ext, name.2.ext .. for the first name that doesn't exist in dst and isn't taken
+func altName(dst, key string, taken map[string]bool) string {
+	ext := path.Ext(key)
+	stem := strings.TrimSuffix(key, ext)
+	for i := 1; ; i++ {
+		name := fmt.Sprintf("%s.%d%s", stem, i, ext)
+		if taken[name] {
+			continue
+		}
+		if _, e := os.Stat(filepath.Join(dst, filepath.FromSlash(name))); os.IsNotExist(e) {
+			return name
+		}
+	}
+}
+
+// runPlanned extracts with an external tool that can't rename members. skipped and renamed members are left out
+// of the first run, then renamed members are extracted into a temporary folder and moved to their new names.
+func runPlanned(dst string, pl *Plan, extract func(dst string, only, exclude []string) error) error {
+	var exclude, renamed []string
+	if pl != nil {
+		for n := range pl.skip {
+			exclude = append(exclude, n)
+		}
+		for n := range pl.rename {
+			renamed = append(renamed, n)
+		}
+	}
+	sort.Strings(renamed)
+	exclude = append(exclude, renamed...)
+	e := extract(dst, nil, exclude)
+	if e != nil || len(renamed) == 0 {
+		return e
+	}
+	tmp, e := os.MkdirTemp(dst, ".extract-")
+	if e != nil {
+		return e
+	}
+	defer os.RemoveAll(tmp)
+	e = extract(tmp, renamed, nil)
+	if e != nil {
+		return e
+	}
+	for _, n := range renamed {
+		from, _ := safePath(tmp, n)
+		to, e := safePath(dst, pl.rename[n])
+		if e == nil {
+			e = os.Rename(from, to)
+		}
+		if e != nil {
+			return fmt.Errorf("%s: %w", n, e)
+		}
+	}
+	return nil
+}
+
+// run7z extracts with 7z, for images the built-in readers can't handle
+func run7z(src, dst string, pl *Plan) error {
+	return runPlanned(dst, pl, func(dst string, only, exclude []string) error {
+		cmd := []string{sevenZip, "x", "-y", "-aoa", "-o" + dst}
+		for _, n := range exclude {
+			cmd = append(cmd, "-x!"+n)
+		}
+		cmd = append(cmd, src)
+		return run(append(cmd, only...)...)
+	})
+}
+
+// has7z reports whether the 7z command can be found
+func has7z() bool {
+	_, e := exec.LookPath(sevenZip)
+	return e == nil
+}
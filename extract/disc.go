@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/kdomanski/iso9660"
+)
+
+/*
+	disc images and disc structures
+		.iso and .img files with an iso9660 or udf volume are extracted into a folder named after the image.
+		iso9660 images are read with github.com/kdomanski/iso9660. udf images (most blu-ray images) and images
+		the iso9660 reader fails on are extracted with 7z (seven_zip in extract.conf).
+		BDMV and VIDEO_TS folders are reported. with disc_main_title in extract.conf, the main title is muxed into
+		a single mkv next to the disc structure with mkvmerge and the structure is removed after.
+			blu-ray  longest playlist in BDMV/PLAYLIST
+			dvd      title set with the largest VOB files in VIDEO_TS
+	nesting
+		files extracted from an archive are one level deeper than the archive. archives max_depth levels deep
+		(default 3) are not extracted, so an archive bomb can't unpack forever.
+*/
+
+var (
+	sevenZip      = "7z"
+	mkvmerge      = "mkvmerge"
+	discMainTitle bool
+	maxDepth      = 3
+	depths        = make(map[string]int) // nesting depth of extracted files
+	discs         []string
+	discsSeen     = make(map[string]bool)
+	reVob         = regexp.MustCompile(`(?i)^VTS_(\d{2})_([1-9])\.VOB$`)
+)
+
+type discImage struct {
+	path string
+}
+
+func (a *discImage) Format() string             { return fmtIso }
+func (a *discImage) First() string              { return a.path }
+func (a *discImage) Volumes() []string          { return []string{a.path} }
+func (a *discImage) IsEncrypted() bool          { return false }
+func (a *discImage) TryPassword(pw string) bool { return false }
+func (a *discImage) List() ([]Member, error) {
+	if isUdf(a.path) && has7z() {
+		return nil, errors.New("udf image")
+	}
+	var members []Member
+	e := a.walkIso(func(name string, c *iso9660.File) error {
+		members = append(members, Member{Name: filepath.ToSlash(name), Size: c.Size(), Dir: c.IsDir()})
+		return nil
+	})
+	return members, e
+}
+
+// Extract extracts into dst, which is the folder named after the image (see destination in dest.go)
+func (a *discImage) Extract(dst string, pl *Plan) error {
+	e7z := has7z()
+	if isUdf(a.path) {
+		if e7z {
+			return run7z(a.path, dst, pl)
+		}
+		p("%s is a udf image and %s was not found, reading the iso9660 part only", a.path, sevenZip)
+	}
+	e := a.extractIso(dst, pl)
+	if e != nil && e7z {
+		p("iso9660 extract failed, trying %s: %s", sevenZip, e)
+		return run7z(a.path, dst, pl)
+	}
+	return e
+}
+func (a *discImage) extractIso(dst string, pl *Plan) error {
+	return a.walkIso(func(name string, c *iso9660.File) error {
+		if c.IsDir() {
+			_, e := writeMember(dst, name, os.ModeDir, nil, pl)
+			return e
+		}
+		path, e := writeMember(dst, name, c.Mode(), c.Reader(), pl)
+		if path != "" && e == nil {
+			_ = os.Chtimes(path, c.ModTime(), c.ModTime())
+		}
+		return e
+	})
+}
+
+// walkIso calls fn for every file and folder in the iso9660 volume, folders before their contents
+func (a *discImage) walkIso(fn func(name string, c *iso9660.File) error) error {
+	f, e := os.Open(a.path)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	img, e := iso9660.OpenImage(f)
+	if e != nil {
+		return e
+	}
+	root, e := img.RootDir()
+	if e != nil {
+		return e
+	}
+	var walk func(dir *iso9660.File, rel string) error
+	walk = func(dir *iso9660.File, rel string) error {
+		children, e := dir.GetChildren()
+		if e != nil {
+			return e
+		}
+		for _, c := range children {
+			name := filepath.Join(rel, c.Name())
+			e = fn(name, c)
+			if e == nil && c.IsDir() {
+				e = walk(c, name)
+			}
+			if e != nil {
+				return fmt.Errorf("%s: %w", name, e)
+			}
+		}
+		return nil
+	}
+	return walk(root, "")
+}
+
+// isUdf reports whether an image has a udf volume, which is after the volume recognition sequence at sector 16
+func isUdf(path string) bool {
+	b, e := readHead(path, 32768+8*2048)
+	if e != nil || len(b) < 32768 {
+		return false
+	}
+	for off := 32768; off+6 <= len(b); off += 2048 {
+		if bytes.Equal(b[off+1:off+5], []byte("NSR0")) {
+			return true
+		}
+	}
+	return false
+}
+
+// listFiles returns every file below dir
+func listFiles(dir string) map[string]bool {
+	files := make(map[string]bool)
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files[path] = true
+		}
+		return nil
+	})
+	return files
+}
+
+// setDepth marks every file in dir that isn't in before as one level deeper than the archive it came from
+// and returns the new files
+func setDepth(a Archive, dir string, before map[string]bool) []string {
+	d := depths[a.First()] + 1
+	var files []string
+	for f := range listFiles(dir) {
+		if !before[f] {
+			depths[f] = d
+			files = append(files, f)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+func isDiscFolder(path string) bool {
+	return isAny(strings.ToUpper(filepath.Base(path)), "BDMV", "VIDEO_TS")
+}
+
+// handleDisc reports a BDMV or VIDEO_TS folder and muxes its main title if disc_main_title is set
+func handleDisc(disc string) {
+	discsSeen[disc] = true
+	root := filepath.Dir(disc)
+	kind := "dvd"
+	if strings.EqualFold(filepath.Base(disc), "BDMV") {
+		kind = "blu-ray"
+	}
+	p("found %s structure: %s", kind, disc)
+	if !discMainTitle {
+		reported = append(reported, fmt.Sprintf("%s: %s structure, not muxed", disc, kind))
+		return
+	}
+	var inputs []string
+	var e error
+	if kind == "blu-ray" {
+		inputs, e = bluRayMainTitle(disc)
+	} else {
+		inputs, e = dvdMainTitle(disc)
+	}
+	if e != nil {
+		reported = append(reported, fmt.Sprintf("%s: could not find main title: %s", disc, e))
+		return
+	}
+	out := getAltPath(filepath.Join(root, filepath.Base(root)+".mkv"))
+	p("muxing main title of %s to %s", disc, out)
+	cmd := []string{mkvmerge, "-o", out}
+	for i, in := range inputs {
+		if i > 0 {
+			cmd = append(cmd, "+")
+		}
+		cmd = append(cmd, in)
+	}
+	e = run(cmd...)
+	var exitErr *exec.ExitError
+	// mkvmerge exits with 1 for warnings
+	if errors.As(e, &exitErr) && exitErr.ExitCode() == 1 {
+		e = nil
+	}
+	if e != nil {
+		_ = os.Remove(out)
+		reported = append(reported, fmt.Sprintf("%s: mkvmerge failed: %s", disc, e))
+		return
+	}
+	manifest.Created = append(manifest.Created, ManifestEntry{Path: out, Reason: "main title of " + disc})
+	if !deleteArchive {
+		return
+	}
+	others := []string{"CERTIFICATE"}
+	if kind == "dvd" {
+		others = []string{"AUDIO_TS"}
+	}
+	removeFolder(disc, kind+" structure muxed")
+	for _, name := range others {
+		if path := findFold(root, name); path != "" {
+			removeFolder(path, kind+" structure muxed")
+		}
+	}
+}
+
+// findFold returns the entry in dir with name in any case, or ""
+func findFold(dir, name string) string {
+	entries, _ := os.ReadDir(dir)
+	for _, en := range entries {
+		if strings.EqualFold(en.Name(), name) {
+			return filepath.Join(dir, en.Name())
+		}
+	}
+	return ""
+}
+
+// bluRayMainTitle returns the playlist with the longest duration
+func bluRayMainTitle(bdmv string) ([]string, error) {
+	dir := findFold(bdmv, "PLAYLIST")
+	entries, _ := os.ReadDir(dir)
+	best, longest := "", uint64(0)
+	for _, en := range entries {
+		if !strings.EqualFold(filepath.Ext(en.Name()), ".mpls") {
+			continue
+		}
+		pl := filepath.Join(dir, en.Name())
+		out, e := exec.Command(mkvmerge, "-J", pl).Output()
+		if e != nil {
+			continue
+		}
+		var info struct {
+			Container struct {
+				Properties struct {
+					PlaylistDuration uint64 `json:"playlist_duration"`
+				} `json:"properties"`
+			} `json:"container"`
+		}
+		if json.Unmarshal(out, &info) != nil {
+			continue
+		}
+		if d := info.Container.Properties.PlaylistDuration; d > longest {
+			best, longest = pl, d
+		}
+	}
+	if best == "" {
+		return nil, errors.New("no readable playlists")
+	}
+	return []string{best}, nil
+}
+
+// dvdMainTitle returns the VOB files of the largest title set in order
+func dvdMainTitle(videoTs string) ([]string, error) {
+	entries, e := os.ReadDir(videoTs)
+	if e != nil {
+		return nil, e
+	}
+	sets := make(map[string][]string)
+	sizes := make(map[string]int64)
+	for _, en := range entries {
+		m := reVob.FindStringSubmatch(en.Name())
+		if m == nil {
+			continue
+		}
+		info, e := en.Info()
+		if e != nil {
+			continue
+		}
+		sets[m[1]] = append(sets[m[1]], filepath.Join(videoTs, en.Name()))
+		sizes[m[1]] += info.Size()
+	}
+	best := ""
+	for ts := range sets {
+		if best == "" || sizes[ts] > sizes[best] {
+			best = ts
+		}
+	}
+	if best == "" {
+		return nil, errors.New("no title set VOB files")
+	}
+	sort.Strings(sets[best])
+	return sets[best], nil
+}
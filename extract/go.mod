@@ -1,5 +1,25 @@
 module github.com/jerblack/server_tools/extract
 
-go 1.17
+// klauspost/compress v1.18.0, used for zstd, needs go 1.22
+go 1.22
 
-require github.com/jerblack/base v0.0.0-20211006050340-165cc5ecafa5
+require (
+	github.com/bodgit/sevenzip v1.6.0
+	github.com/jerblack/base v0.0.0-20211006050340-165cc5ecafa5
+	github.com/kdomanski/iso9660 v0.4.0
+	github.com/klauspost/compress v1.18.0
+	github.com/ulikunitz/xz v0.5.12
+	golang.org/x/crypto v0.21.0
+)
+
+require (
+	github.com/andybalholm/brotli v1.1.1 // indirect
+	github.com/bodgit/plumbing v1.3.0 // indirect
+	github.com/bodgit/windows v1.0.1 // indirect
+	github.com/hashicorp/errwrap v1.1.0 // indirect
+	github.com/hashicorp/go-multierror v1.1.1 // indirect
+	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
+	github.com/pierrec/lz4/v4 v4.1.21 // indirect
+	go4.org v0.0.0-20200411211856-f5505b9728dd // indirect
+	golang.org/x/text v0.21.0 // indirect
+)
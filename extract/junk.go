@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+	junk rules
+		defaults below, changed in extract.conf. the first junk_ext, junk_folder or sample_regex line replaces the
+		defaults for that key, later lines add to it. junk_regex only adds.
+			junk_ext       file name endings that are junk
+			junk_folder    folder names that are junk
+			junk_regex     regex matched against lowercase file names, matching files are junk
+			sample_regex   regex matched against lowercase paths of sample videos
+			sample_max_mb  sample videos larger than this are never junk, nor are junk folders with a file larger than
+			               this. default 300
+	recycle
+		with -recycle <path>, the RECYCLE environment variable or recycle_folder in extract.conf, files and folders
+		are moved to the recycle folder instead of being deleted. entries in the recycle folder older than
+		recycle_days (default 0, keep forever) are removed when extract starts.
+*/
+
+var (
+	junkExts = []string{".sfv", ".srr", ".url", ".diz", ".nzb", ".par2",
+		".ds_store", "thumbs.db"}
+	junkSubs      = []string{"sample", "screens", "proof"}
+	junkRegexes   []*regexp.Regexp
+	sampleRegexes = []*regexp.Regexp{
+		regexp.MustCompile(`\.sample\.(asf|avi|mkv|mp4|m4v|mov|mpg|mpeg|ogg|webm|wmv)$`),
+		regexp.MustCompile(`sample-.+\.(asf|avi|mkv|mp4|m4v|mov|mpg|mpeg|ogg|webm|wmv)$`),
+	}
+	sampleMaxMb = int64(300)
+	recyclePath string
+	recycleDays int
+)
+
+func isSample(path string, size int64) bool {
+	if size > sampleMaxMb*1000*1000 {
+		return false
+	}
+	s := strings.ToLower(path)
+	for _, re := range sampleRegexes {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// junkRegex returns the junk_regex a file name matches, or ""
+func junkRegex(path string) string {
+	name := strings.ToLower(filepath.Base(path))
+	for _, re := range junkRegexes {
+		if re.MatchString(name) {
+			return re.String()
+		}
+	}
+	return ""
+}
+
+// hasLargeFile reports whether a folder has a file larger than sample_max_mb
+func hasLargeFile(dir string) bool {
+	large := false
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && info.Size() > sampleMaxMb*1000*1000 {
+			large = true
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return large
+}
+
+// recycle moves a file or folder into the recycle folder and touches it so its age counts from now
+func recycle(path string) error {
+	dst := getAltPath(filepath.Join(recyclePath, filepath.Base(path)))
+	st, e := os.Stat(path)
+	if e != nil {
+		return e
+	}
+	if st.IsDir() {
+		e = os.Rename(path, dst)
+		if e != nil {
+			mvTree(path, dst, true)
+			e = os.RemoveAll(path)
+		}
+	} else {
+		e = mvFile(path, dst)
+	}
+	if e != nil {
+		return e
+	}
+	now := time.Now()
+	return os.Chtimes(dst, now, now)
+}
+
+// cleanRecycle removes entries from the recycle folder that were recycled more than recycle_days ago
+func cleanRecycle() {
+	if recyclePath == "" || recycleDays <= 0 || dryRun {
+		return
+	}
+	entries, e := os.ReadDir(recyclePath)
+	if e != nil {
+		chk(e)
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -recycleDays)
+	for _, en := range entries {
+		info, e := en.Info()
+		if e != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		path := filepath.Join(recyclePath, en.Name())
+		p("removing from recycle folder, older than %d days: %s", recycleDays, path)
+		chk(os.RemoveAll(path))
+	}
+}
+
+// setRecycle checks the recycle folder and creates it if needed
+func setRecycle(path string) {
+	path, e := filepath.Abs(path)
+	chkFatal(e)
+	st, e := os.Stat(path)
+	if os.IsNotExist(e) {
+		e = os.MkdirAll(path, 0755)
+		if e != nil {
+			chk(e)
+			fmt.Println("path specified with -recycle is not valid (doesn't exist and can't be created).")
+			os.Exit(1)
+		}
+	} else if e != nil || !st.IsDir() {
+		fmt.Println("path specified with -recycle is not a folder.")
+		os.Exit(1)
+	}
+	recyclePath = path
+}
@@ -4,19 +4,19 @@ import (
 	"fmt"
 	"github.com/jerblack/base"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
-	"strconv"
 	"strings"
+	"time"
 )
 
 /*
-	extract all zip and rar files in path and recursively through subfolders
+	extract all archives in path and recursively through subfolders (see archive.go)
+		verify and repair archives with sfv and par2 files before extract (see verify.go)
+		extract disc images and report or mux BDMV and VIDEO_TS structures (see disc.go)
 		delete archives after extract
 	delete junk files and folders
 
-	requires: unrar unzip file
+	requires: unrar, par2 (optional, for par2 verification and repair)
 
 	name formats
 	name.rar
@@ -39,32 +39,40 @@ import (
 	...
 	name.000 (zip)
 	name.001 (zip)
+	----
+	name.7z
+	name.7z.001
+	...
+	name.tar name.tar.gz name.tgz name.tar.bz2 name.tar.xz name.tar.zst
+	name.gz name.bz2 name.xz name.zst
 
 */
 
 var (
-	startPath string
-	unrar     = "unrar"
-	unzip     = "unzip"
-	count     = 0
-	rars      map[string][]string
-	zips      map[string][]string
-	encs      map[string][]string
-	junkExts  = []string{".sfv", ".srr", ".url", ".diz", ".nzb", ".par2",
-		".ds_store", "thumbs.db"}
-	junkSubs    = []string{"sample", "screens", "proof"}
+	startPath   string
+	unrar       = "unrar"
+	count       = 0
+	archives    []Archive
+	encs        []Archive
+	failed      = make(map[string]bool) // first volumes of sets that failed to extract
+	done        = make(map[string]bool) // first volumes of extracted sets, still on disk with -a
 	junkFiles   map[string][]string
 	junkFolders map[string][]string
+	reported    []string // sets moved aside or left in place, listed at the end of the run
 )
 
 func getFiles() {
-	archiveCount := 0
 	junkCount := 0
-	rars = make(map[string][]string)
-	zips = make(map[string][]string)
-	encs = make(map[string][]string)
+	volumes := make(map[string][]string)
+	archives = nil
+	encs = nil
 	junkFiles = make(map[string][]string)
 	junkFolders = make(map[string][]string)
+	junkReasons = make(map[string]string)
+	checks = make(map[string][]string)
+	setChecks = make(map[string][]string)
+	nzbPasswords = make(map[string][]string)
+	discs = nil
 
 	walk := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -72,54 +80,45 @@ func getFiles() {
 		}
 		d := filepath.Dir(path)
 
-		if isRar(path) {
-			archiveCount++
-			if isRarEncrypted(path) {
-				p("found encrypted rar: %s", path)
-				encs[d] = append(encs[d], path)
-			} else {
-				p("found rar: %s", path)
-				rars[d] = append(rars[d], path)
-			}
-		} else if isZip(path) {
-			archiveCount++
-			if isZipEncrypted(path) {
-				p("found encrypted zip: %s", path)
-				encs[d] = append(encs[d], path)
-			} else {
-				p("found zip: %s", path)
-				zips[d] = append(zips[d], path)
-			}
-
+		if detect(path) != "" {
+			volumes[d] = append(volumes[d], path)
+		} else if verify && !info.IsDir() && isCheckFile(path) {
+			checks[d] = append(checks[d], path)
 		} else {
 			s := strings.ToLower(path)
 			if !info.IsDir() {
+				if strings.HasSuffix(s, ".nzb") {
+					nzbPasswords[d] = append(nzbPasswords[d], readNzbPasswords(path)...)
+				}
 				for _, ext := range junkExts {
 					if strings.HasSuffix(s, ext) {
 						junkCount++
-						p("found %s file: %s", ext, path)
-						junkFiles[d] = append(junkFiles[d], path)
+						addJunk(d, path, ext+" file", false)
 					}
 				}
-				if isSample(path) {
+				if isSample(path, info.Size()) {
+					junkCount++
+					addJunk(d, path, "sample video", false)
+				}
+				if re := junkRegex(path); re != "" {
 					junkCount++
-					p("found sample video: %s", path)
-					junkFiles[d] = append(junkFiles[d], path)
+					addJunk(d, path, "match for junk_regex "+re, false)
 				}
 
-			} else {
+			} else if path != startPath {
+				if isDiscFolder(path) && !discsSeen[path] {
+					discs = append(discs, path)
+				}
 				last := filepath.Base(s)
 				for _, folder := range junkSubs {
-					if last == folder {
+					if last == folder && !hasLargeFile(path) {
 						junkCount++
-						p("found %s folder: %s", folder, path)
-						junkFolders[d] = append(junkFolders[d], path)
+						addJunk(d, path, folder+" folder", true)
 					}
 				}
 				if isDirEmpty(path) {
 					junkCount++
-					p("found empty folder: %s", path)
-					junkFolders[d] = append(junkFolders[d], path)
+					addJunk(d, path, "empty folder", true)
 				}
 
 			}
@@ -130,144 +129,121 @@ func getFiles() {
 	err := filepath.Walk(startPath, walk)
 	chkFatal(err)
 
-	if (archiveCount > 0 && deleteArchive) || (junkCount > 0 && deleteJunk) {
-		extract()
-	}
-}
-
-func isZip(path string) bool {
-	f, e := os.Stat(path)
-	if e != nil {
-		chk(e)
-		return false
-	} else if f.IsDir() {
-		return false
-	}
-
-	s := strings.ToLower(path)
-	if strings.HasSuffix(s, ".zip") {
-		return true
-	}
-
-	r1 := regexp.MustCompile(`.z\d{2}$`)
-	if r1.MatchString(s) {
-		return true
-	}
-
-	r2 := regexp.MustCompile(`.\d{3}$`)
-	if r2.MatchString(s) {
-		out, e := exec.Command("file", "--mime", path).Output()
-		if e == nil && strings.Contains(string(out), "application/zip;") {
-			return true
+	owned := make(map[string]bool)
+	for d, vols := range volumes {
+		for _, a := range archiveSets(vols) {
+			setChecks[a.First()] = ownChecks(a, checks[d])
+			for _, c := range setChecks[a.First()] {
+				owned[c] = true
+			}
+			if failed[a.First()] || done[a.First()] {
+				continue
+			}
+			if maxDepth > 0 && depths[a.First()] >= maxDepth {
+				reason := fmt.Sprintf("nested %d archives deep, not extracted", depths[a.First()])
+				p("%s: %s", a.First(), reason)
+				reported = append(reported, fmt.Sprintf("%s: %s", a.First(), reason))
+				manifest.Failed = append(manifest.Failed, manifestSet(a, reason))
+				failed[a.First()] = true
+				continue
+			}
+			if a.IsEncrypted() {
+				p("found encrypted %s: %s", a.Format(), a.First())
+				encs = append(encs, a)
+			} else {
+				p("found %s with %d volumes: %s", a.Format(), len(a.Volumes()), a.First())
+				archives = append(archives, a)
+			}
 		}
 	}
-	return false
-}
-func isRar(path string) bool {
-	f, e := os.Stat(path)
-	if e != nil {
-		chk(e)
-		return false
-	} else if f.IsDir() {
-		return false
-	}
-
-	s := strings.ToLower(path)
-
-	if strings.HasSuffix(s, ".rar") {
-		return true
-	}
-	//r1 := regexp.MustCompile(`.part\d+.rar$`)
-	r2 := regexp.MustCompile(`.[rs]\d{2}$`)
-	r3 := regexp.MustCompile(`.\d{3}$`)
-	if r2.MatchString(s) {
-		return true
-	}
-
-	if r3.MatchString(s) {
-		out, e := exec.Command("file", "--mime", path).Output()
-		if e == nil && strings.Contains(string(out), "x-rar") {
-			return true
+	// verification files that don't belong to any set are junk
+	for d, cs := range checks {
+		for _, c := range cs {
+			if !owned[c] {
+				junkCount++
+				addJunk(d, c, "unused verification file", false)
+			}
 		}
 	}
-	return false
-}
-func isZipEncrypted(zip string) bool {
-	args := []string{"-v", zip}
-	out, _ := exec.Command(unzip, args...).Output()
-	s := string(out)
-	if strings.Contains(s, "Unk:099") {
-		return true
-	}
-
-	return false
-}
-func isRarEncrypted(rar string) bool {
-	args := []string{"l", "-p-", rar}
-	out, _ := exec.Command(unrar, args...).Output()
-	s := string(out)
-	if strings.Contains(s, "\n*") {
-		return true
-	}
-	if strings.Contains(s, "\nDetails: .+ encrypted headers") {
-		return true
-	}
+	archiveCount := len(archives) + len(encs)
 
-	return false
-}
-func isSample(path string) bool {
-	s := strings.ToLower(path)
-	r1 := regexp.MustCompile(`\.sample\.(asf|avi|mkv|mp4|m4v|mov|mpg|mpeg|ogg|webm|wmv)$`)
-	if r1.MatchString(s) {
-		return true
+	if dryRun {
+		plan()
+		return
 	}
-	r2 := regexp.MustCompile(`sample-.+\.(asf|avi|mkv|mp4|m4v|mov|mpg|mpeg|ogg|webm|wmv)$`)
-	if r2.MatchString(s) {
-		return true
+	if archiveCount > 0 || (junkCount > 0 && deleteJunk) || len(discs) > 0 {
+		extract()
 	}
-	return false
 }
 
 func extract() {
 
 	/*
-		find first rar/zip
-		start extract from first archive
-		after extract, delete archives listed in array
-		delete enc files
+		verify each archive set, move damaged sets to the problem folder
+		sets repaired by par2 are read again to pick up recreated volumes, par2's exit code is trusted
+		try passwords on encrypted sets, move sets no password opens to the quarantine folder
+		extract each archive set from its first volume
+		after extract, delete volumes and verification files of extracted sets
+		report disc structures and mux their main title
 		delete all junk files and folders
 		call getFiles again, will loop until no more qualifying files
+		sets that fail to extract are left in place and skipped from then on
 	*/
-	for path := range rars {
-		frs := firstRar(path)
-		if frs != nil {
-			for _, r := range frs {
-				p("extracting rar file: %s", r)
-				extractRar(r)
-			}
+	var extracted []Archive
+	encrypted := make(map[Archive]bool)
+	for _, a := range encs {
+		encrypted[a] = true
+	}
+	for _, a := range append(append([]Archive{}, archives...), encs...) {
+		enc := encrypted[a]
+		repaired, reason := verifySet(a)
+		if repaired {
+			a = rescanSet(a)
 		}
-	}
-	for path := range zips {
-		fzs := firstZip(path)
-		if fzs != nil {
-			for _, z := range fzs {
-				p("extracting zip file: %s", z)
-				extractZip(z)
-			}
+		if reason != "" {
+			moveToProblem(a, reason)
+			continue
 		}
-	}
+		if enc && !unlock(a) {
+			quarantine(a, "encrypted and no password found")
+			continue
+		}
+		p("extracting %s file: %s", a.Format(), a.First())
+		dst, members := destination(a)
+		pl := collisionPlan(a, dst, members)
+		before := listFiles(dst)
+		e := a.Extract(dst, pl)
+		if e != nil {
+			p("failed to extract %s, leaving archive in place: %s", a.First(), e)
+			failed[a.First()] = true
+			manifest.Failed = append(manifest.Failed, manifestSet(a, e.Error()))
+			continue
+		}
+		ms := manifestSet(a, "")
+		ms.Encrypted = enc
+		ms.Dst = dst
+		ms.Files = setDepth(a, dst, before)
+		manifest.Extracted = append(manifest.Extracted, ms)
+		extracted = append(extracted, a)
+		done[a.First()] = true
+	}
+	for _, d := range discs {
+		handleDisc(d)
+	}
+	archives = extracted
+	encs = nil
 	clean()
 	getFiles()
 }
 func clean() {
 	if deleteArchive {
-		for _, fileMaps := range []map[string][]string{rars, zips, encs} {
-			for _, fMap := range fileMaps {
-				for _, f := range fMap {
-					p("removing file: %s", f)
-					err := os.Remove(f)
-					chk(err)
+		for _, a := range archives {
+			for _, f := range append(append([]string{}, a.Volumes()...), setChecks[a.First()]...) {
+				// par2 removes its own files after a repair
+				if _, err := os.Stat(f); os.IsNotExist(err) {
+					continue
 				}
+				removeFile(f, "extracted archive")
 			}
 		}
 	}
@@ -275,144 +251,129 @@ func clean() {
 	if !deleteJunk {
 		return
 	}
-	for _, fileMaps := range []map[string][]string{junkFiles} {
-		for _, fMap := range fileMaps {
-			for _, f := range fMap {
-				p("removing file: %s", f)
-				err := os.Remove(f)
-				chk(err)
-			}
+	for _, fMap := range junkFiles {
+		for _, f := range fMap {
+			removeFile(f, junkReasons[f])
 		}
 	}
 	for _, junkFolder := range junkFolders {
 		for _, jf := range junkFolder {
-			p("removing folder: %s", jf)
-
-			err := os.RemoveAll(jf)
-			chk(err)
+			removeFolder(jf, junkReasons[jf])
 		}
 	}
 }
-
-func extractRar(rar string) {
-	cmd := []string{unrar, "x", "-o+", "-y", rar, dstFolder(rar)}
-	e := run(cmd...)
-	chk(e)
-}
-func extractZip(zip string) {
-	cmd := []string{unzip, "-o", zip, "-d", dstFolder(zip)}
-	e := run(cmd...)
-	chk(e)
-}
-
-func firstZip(path string) []string {
-	list := zips[path]
-	var zips, zeroes, ones []string
-
-	for _, path := range list {
-		s := strings.ToLower(path)
-		if strings.HasSuffix(s, ".zip") {
-			zips = append(zips, path)
-		}
-		if strings.HasSuffix(s, ".000") {
-			zeroes = append(zeroes, path)
-		}
-		if strings.HasSuffix(s, ".001") {
-			ones = append(ones, path)
-		}
-	}
-	if len(zips) > 0 {
-		return zips
-	}
-	if len(zeroes) > 0 {
-		return zeroes
+func removeFile(f, reason string) {
+	var err error
+	if recyclePath != "" {
+		p("recycling file: %s", f)
+		err = recycle(f)
+	} else {
+		p("removing file: %s", f)
+		err = os.Remove(f)
+	}
+	chk(err)
+	if err == nil {
+		manifest.Deleted = append(manifest.Deleted, ManifestEntry{Path: f, Reason: reason})
 	}
-	if len(ones) > 0 {
-		return ones
+}
+func removeFolder(f, reason string) {
+	var err error
+	// nothing to keep in an empty folder
+	if recyclePath != "" && !isDirEmpty(f) {
+		p("recycling folder: %s", f)
+		err = recycle(f)
+	} else {
+		p("removing folder: %s", f)
+		err = os.RemoveAll(f)
+	}
+	chk(err)
+	if err == nil {
+		manifest.Deleted = append(manifest.Deleted, ManifestEntry{Path: f, Folder: true, Reason: reason})
 	}
-
-	return nil
 }
-func firstRar(path string) []string {
-	list := rars[path]
-	reg := `.part(?P<num>\d+).rar$`
-	lowNum := -1
-	var lowPaths, rars, zeroes, ones []string
-
-	for _, path := range list {
-		s := strings.ToLower(path)
-		groups := getParams(reg, s)
 
-		if num, hasVal := groups["num"]; hasVal {
-			n, _ := strconv.Atoi(num)
-			if lowNum == -1 || n < lowNum {
-				lowNum = n
-				lowPaths = []string{path}
-			} else if lowNum == n {
-				lowPaths = append(lowPaths, path)
-			}
-		}
-		if strings.HasSuffix(s, ".rar") {
-			rars = append(rars, path)
-		}
-		if strings.HasSuffix(s, ".000") {
-			zeroes = append(zeroes, path)
-		}
-		if strings.HasSuffix(s, ".001") {
-			ones = append(ones, path)
-		}
-	}
-	if lowNum != -1 {
-		return lowPaths
-	}
-	if len(rars) > 0 {
-		return rars
-	}
-	if len(zeroes) > 0 {
-		return zeroes
+// moveSet moves a set and its verification files into a folder with a reason file and reports it at the end of
+// the run. without a folder the set is left in place.
+func moveSet(a Archive, folder, reason string) {
+	p("%s: %s", a.First(), reason)
+	failed[a.First()] = true
+	if folder == "" {
+		reported = append(reported, fmt.Sprintf("%s: %s, left in place", a.First(), reason))
+		manifest.Failed = append(manifest.Failed, manifestSet(a, reason))
+		return
 	}
-	if len(ones) > 0 {
-		return ones
+	name := strings.TrimSuffix(filepath.Base(a.First()), filepath.Ext(a.First()))
+	dst := getAltPath(filepath.Join(folder, name))
+	p("moving set to %s", dst)
+	for _, f := range append(append([]string{}, a.Volumes()...), setChecks[a.First()]...) {
+		e := mvFile(f, filepath.Join(dst, filepath.Base(f)))
+		chk(e)
 	}
-
-	return nil
-}
-func dstFolder(f string) string {
-	//if extract into folder with same name as archive
-	//re := regexp.MustCompile(`(?i).part\d+.rar$`)
-	//if re.MatchString(f) {
-	//	return re.ReplaceAllString(f, "/")
-	//}
-	//re = regexp.MustCompile(`(?i).(zip|rar|\d+)$`)
-	//return re.ReplaceAllString(f, "/")
-
-	//if extract into same folder archive lives
-	return filepath.Dir(f) + "/"
+	e := os.WriteFile(filepath.Join(dst, "reason.txt"), []byte(fmt.Sprintf("%s\n%s\n", a.First(), reason)), 0644)
+	chk(e)
+	reported = append(reported, fmt.Sprintf("%s: %s, moved to %s", a.First(), reason, dst))
+	ms := manifestSet(a, reason)
+	ms.Dst = dst
+	manifest.Moved = append(manifest.Moved, ms)
 }
 
 var deleteArchive = true
 var deleteJunk = true
 
-var help = `extract [-h][-a][-j][folder path]
-  extract all zip and rar files in current folder and all subfolders, delete archives on successful extraction, 
+var help = `extract [-h][-n][-a][-j][-v][-dest mode][-collision policy][-manifest path][-recycle path][-prob path]
+        [-quarantine path][-conf path][folder path]
+  extract all rar, zip, 7z and tar files in current folder and all subfolders, delete archives on successful extraction, 
   and delete junk files.
   -h  print this message
+  -n  dry run. report which archives would be extracted and which files and folders would be deleted and why,
+      without changing anything.
+  -manifest  -manifest <path>
+      write a json record of what was extracted, deleted, moved and failed to this file when finished.
   -a  DO NOT delete archive files after extract.
-      These files are deleted by default.
+      These files are deleted by default. archives found inside extracted archives are extracted too.
   -j  DO NOT delete junk files after extract.
       These files are deleted by default.
       files:
         ".sfv", ".srr", ".url", ".diz", ".nzb", ".par2", ".ds_store", 
-        "thumbs.db", "*sample*"
+        "thumbs.db", "*sample*" up to 300 MB
       folders:
         "sample", "screens", "proof"
+      junk rules can be changed with junk_ext, junk_folder, junk_regex, sample_regex and sample_max_mb in extract.conf
+      .sfv and .par2 files that belong to an archive set are used to verify it and deleted with the archive.
+  -v  DO NOT verify archives with .sfv and .par2 files before extract.
+  -dest  -dest <same|set|smart>
+      extract into the folder the archive is in (same, default), a folder named after the archive (set), or a folder
+      named after the archive only when it has more than one top level entry (smart). dest_mode in extract.conf.
+  -collision  -collision <skip|rename|overwrite|larger>
+      what to do with files from an archive that already exist in the destination: keep the existing file (skip),
+      extract as name.1.ext (rename), replace it (overwrite, default) or keep the larger one (larger).
+      collision in extract.conf.
+  -prob  -prob <path>
+      move archive sets that fail verification and can't be repaired to this folder, with a reason.txt.
+      without -prob or problem_folder in extract.conf, damaged sets are left in place.
+  -quarantine  -quarantine <path>
+      move encrypted archive sets that no known password opens to this folder, with a reason.txt.
+      passwords are read from {{password}} in file and folder names, .nzb files and password_file in extract.conf.
+      without -quarantine or quarantine_folder in extract.conf, the problem folder is used.
+  -recycle  -recycle <path>
+      move files and folders to this folder instead of deleting them. RECYCLE environment variable or
+      recycle_folder in extract.conf can also be used. recycle_days in extract.conf removes old entries.
+  -conf  -conf <path to extract.conf>
+      load settings from this file. if not specified, EXTRACT_CONF environment variable or /etc/extract.conf is used
+      disc images are extracted into a folder named after the image. BDMV and VIDEO_TS folders are reported, 
+      or muxed into a single mkv with disc_main_title in extract.conf.
    extract runs recursively in the current folder by default unless a folder path is provided, 
    in which case it runs recursively from there. 
 `
 
 func main() {
 	startPath, _ = os.Getwd()
-	for _, arg := range os.Args {
+	if r := os.Getenv("RECYCLE"); r != "" {
+		setRecycle(r)
+	}
+	noVerify := false
+	for i := 1; i < len(os.Args); i++ {
+		arg := os.Args[i]
 		lower := strings.ToLower(arg)
 		if lower == "-h" || lower == "-?" {
 			fmt.Println(help)
@@ -423,6 +384,43 @@ func main() {
 		} else if lower == "-j" {
 			fmt.Println("-j set: don't delete junk")
 			deleteJunk = false
+		} else if lower == "-v" {
+			fmt.Println("-v set: don't verify archives")
+			noVerify = true
+		} else if lower == "-n" {
+			fmt.Println("-n set: dry run, nothing will be changed")
+			dryRun = true
+		} else if isAny(lower, "-dest", "-collision") {
+			if i+1 >= len(os.Args) {
+				fmt.Printf("must specify a value with %s.\n", lower)
+				os.Exit(1)
+			}
+			if lower == "-dest" {
+				destMode = strings.ToLower(os.Args[i+1])
+			} else {
+				collision = strings.ToLower(os.Args[i+1])
+			}
+			i++
+		} else if isAny(lower, "-prob", "-quarantine", "-conf", "-manifest", "-recycle") {
+			if i+1 >= len(os.Args) {
+				fmt.Printf("must specify path with %s.\n", lower)
+				os.Exit(1)
+			}
+			path, e := filepath.Abs(os.Args[i+1])
+			chkFatal(e)
+			switch lower {
+			case "-prob":
+				probPath = path
+			case "-quarantine":
+				quarPath = path
+			case "-manifest":
+				manifestPath = path
+			case "-recycle":
+				setRecycle(path)
+			default:
+				confFile = path
+			}
+			i++
 		} else {
 			f, e := os.Stat(arg)
 			if e == nil && f.IsDir() {
@@ -431,35 +429,34 @@ func main() {
 		}
 	}
 
+	loadConfig()
+	setDest()
+	loadPasswords()
+	cleanRecycle()
+	if noVerify {
+		verify = false
+	}
 	p("extract called in: %s", startPath)
+	manifest.Started = time.Now()
 
 	getFiles()
-	extract()
-}
-
-/**
- * Parses url with the given regular expression and returns the
- * group values defined in the expression.
- *
- */
-func getParams(regEx, s string) (paramsMap map[string]string) {
-
-	var compRegEx = regexp.MustCompile(regEx)
-	match := compRegEx.FindStringSubmatch(s)
-
-	paramsMap = make(map[string]string)
-	for i, name := range compRegEx.SubexpNames() {
-		if i > 0 && i <= len(match) {
-			paramsMap[name] = match[i]
+	if len(reported) > 0 {
+		p("%d sets need attention:", len(reported))
+		for _, r := range reported {
+			p("  %s", r)
 		}
 	}
-	return paramsMap
+	writeManifest()
 }
 
 var (
 	p          = base.P
+	isAny      = base.IsAny
 	chk        = base.Chk
 	chkFatal   = base.ChkFatal
 	isDirEmpty = base.IsDirEmpty
 	run        = base.Run
+	mvFile     = base.MvFile
+	getAltPath = base.GetAltPath
+	mvTree     = base.MvTree
 )
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+/*
+	dry run and manifest
+		-n scans once and reports what would be done without extracting, moving or deleting anything.
+		-manifest <path> writes a json record of what was done (or with -n, what would be done) when extract
+		finishes, so callers can check the result.
+			extracted  sets extracted, with the volumes, destination and the files that came out
+			deleted    files and folders removed, with the reason
+			moved      sets moved to the problem or quarantine folder, with the reason
+			failed     sets left in place, with the reason
+			created    files made from disc structures
+			collisions files that already existed where a set was extracted, and what was done with them
+*/
+
+var (
+	dryRun       bool
+	manifestPath string
+	manifest     = Manifest{Extracted: []ManifestSet{}, Deleted: []ManifestEntry{}, Moved: []ManifestSet{},
+		Failed: []ManifestSet{}, Created: []ManifestEntry{}, Collisions: []ManifestEntry{}}
+	junkReasons map[string]string // reason each junk file or folder was found
+)
+
+type Manifest struct {
+	Path       string          `json:"path"`
+	DryRun     bool            `json:"dry_run"`
+	Started    time.Time       `json:"started"`
+	Finished   time.Time       `json:"finished"`
+	Extracted  []ManifestSet   `json:"extracted"`
+	Deleted    []ManifestEntry `json:"deleted"`
+	Moved      []ManifestSet   `json:"moved"`
+	Failed     []ManifestSet   `json:"failed"`
+	Created    []ManifestEntry `json:"created"`
+	Collisions []ManifestEntry `json:"collisions"`
+}
+type ManifestSet struct {
+	Format    string   `json:"format"`
+	First     string   `json:"first"`
+	Volumes   []string `json:"volumes"`
+	Encrypted bool     `json:"encrypted,omitempty"`
+	Dst       string   `json:"dst,omitempty"`
+	Files     []string `json:"files,omitempty"`
+	Reason    string   `json:"reason,omitempty"`
+}
+type ManifestEntry struct {
+	Path   string `json:"path"`
+	Folder bool   `json:"folder,omitempty"`
+	Reason string `json:"reason"`
+}
+
+func manifestSet(a Archive, reason string) ManifestSet {
+	return ManifestSet{Format: a.Format(), First: a.First(), Volumes: a.Volumes(), Reason: reason}
+}
+
+// addJunk records a junk file or folder found in folder d
+func addJunk(d, path, reason string, folder bool) {
+	p("found %s: %s", reason, path)
+	if _, ok := junkReasons[path]; ok {
+		return
+	}
+	junkReasons[path] = reason
+	if folder {
+		junkFolders[d] = append(junkFolders[d], path)
+	} else {
+		junkFiles[d] = append(junkFiles[d], path)
+	}
+}
+
+// plan prints and records what a run would do without -n
+func plan() {
+	for _, a := range archives {
+		dst, members := destination(a)
+		p("would extract %s to %s", a.First(), dst)
+		for _, v := range a.Volumes() {
+			p("  volume: %s", v)
+		}
+		for _, c := range setChecks[a.First()] {
+			p("  verify with: %s", c)
+		}
+		collisionPlan(a, dst, members)
+		ms := manifestSet(a, "")
+		ms.Dst = dst
+		manifest.Extracted = append(manifest.Extracted, ms)
+		if deleteArchive {
+			for _, f := range append(append([]string{}, a.Volumes()...), setChecks[a.First()]...) {
+				manifest.Deleted = append(manifest.Deleted, ManifestEntry{Path: f, Reason: "extracted archive"})
+			}
+		}
+	}
+	for _, a := range encs {
+		p("would try %d passwords on encrypted %s: %s", len(candidates(a)), a.Format(), a.First())
+		for _, v := range a.Volumes() {
+			p("  volume: %s", v)
+		}
+		ms := manifestSet(a, "")
+		ms.Encrypted = true
+		// encrypted sets can't be listed before a password is found
+		ms.Dst = filepath.Dir(a.First())
+		manifest.Extracted = append(manifest.Extracted, ms)
+	}
+	for _, d := range discs {
+		if discMainTitle {
+			p("would mux main title of %s", d)
+		} else {
+			p("would report disc structure %s", d)
+		}
+	}
+	if !deleteJunk {
+		return
+	}
+	for _, junk := range []struct {
+		paths  map[string][]string
+		folder bool
+	}{{junkFiles, false}, {junkFolders, true}} {
+		var dirs []string
+		for d := range junk.paths {
+			dirs = append(dirs, d)
+		}
+		sort.Strings(dirs)
+		for _, d := range dirs {
+			for _, f := range junk.paths[d] {
+				p("would delete %s: %s", f, junkReasons[f])
+				manifest.Deleted = append(manifest.Deleted, ManifestEntry{Path: f, Folder: junk.folder,
+					Reason: junkReasons[f]})
+			}
+		}
+	}
+}
+
+func writeManifest() {
+	if manifestPath == "" {
+		return
+	}
+	manifest.Path = startPath
+	manifest.DryRun = dryRun
+	manifest.Finished = time.Now()
+	b, e := json.MarshalIndent(manifest, "", "  ")
+	if e != nil {
+		chk(e)
+		return
+	}
+	e = os.WriteFile(manifestPath, b, 0644)
+	if e != nil {
+		p("could not write manifest %s: %s", manifestPath, e)
+		return
+	}
+	p("wrote manifest to %s", manifestPath)
+}
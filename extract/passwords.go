@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+/*
+	passwords
+		encrypted sets are tried with candidate passwords, in this order
+			{{password}} in the name of a volume or of the folder the set is in
+			<meta type="password"> in the head of .nzb files in the same folder
+			each line of password_file from extract.conf, lines starting with # are ignored
+		sets that no password opens are moved to the quarantine folder (-quarantine or quarantine_folder in
+		extract.conf, the problem folder if not set) with a reason.txt and listed at the end of the run.
+		encrypted sets are never deleted unless they were extracted.
+*/
+
+var (
+	passwordFile   string
+	quarPath       string
+	filePasswords  []string
+	nzbPasswords   map[string][]string // passwords from nzb files by folder
+	reNamePassword = regexp.MustCompile(`\{\{(.+?)\}\}`)
+)
+
+type nzbMeta struct {
+	Head struct {
+		Meta []struct {
+			Type  string `xml:"type,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"meta"`
+	} `xml:"head"`
+}
+
+func loadPasswords() {
+	if passwordFile == "" {
+		return
+	}
+	b, e := os.ReadFile(passwordFile)
+	if e != nil {
+		p("could not read password file %s: %s", passwordFile, e)
+		return
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		filePasswords = append(filePasswords, line)
+	}
+	p("loaded %d passwords from %s", len(filePasswords), passwordFile)
+}
+
+// readNzbPasswords returns the passwords in the meta section of an nzb file
+func readNzbPasswords(path string) []string {
+	f, e := os.Open(path)
+	if e != nil {
+		chk(e)
+		return nil
+	}
+	defer f.Close()
+	var nzb nzbMeta
+	d := xml.NewDecoder(f)
+	// nzb files declare a dtd and are sometimes not strictly valid
+	d.Strict = false
+	e = d.Decode(&nzb)
+	if e != nil {
+		p("could not read nzb %s: %s", path, e)
+		return nil
+	}
+	var pws []string
+	for _, m := range nzb.Head.Meta {
+		if strings.EqualFold(m.Type, "password") && strings.TrimSpace(m.Value) != "" {
+			pws = append(pws, strings.TrimSpace(m.Value))
+		}
+	}
+	return pws
+}
+
+// candidates returns the passwords to try on a set, without duplicates
+func candidates(a Archive) []string {
+	var pws []string
+	seen := make(map[string]bool)
+	add := func(pw ...string) {
+		for _, s := range pw {
+			if !seen[s] {
+				seen[s] = true
+				pws = append(pws, s)
+			}
+		}
+	}
+	dir := filepath.Dir(a.First())
+	for _, name := range append([]string{filepath.Base(dir)}, a.Volumes()...) {
+		for _, m := range reNamePassword.FindAllStringSubmatch(filepath.Base(name), -1) {
+			add(m[1])
+		}
+	}
+	add(nzbPasswords[dir]...)
+	add(filePasswords...)
+	return pws
+}
+
+// unlock tries every candidate password on an encrypted set and returns true if one works
+func unlock(a Archive) bool {
+	pws := candidates(a)
+	if len(pws) == 0 {
+		p("no passwords to try for %s", a.First())
+		return false
+	}
+	p("trying %d passwords on %s", len(pws), a.First())
+	for _, pw := range pws {
+		if a.TryPassword(pw) {
+			p("found password for %s", a.First())
+			return true
+		}
+	}
+	return false
+}
+
+// quarantine moves an encrypted set that no password opens out of the way
+func quarantine(a Archive, reason string) {
+	folder := quarPath
+	if folder == "" {
+		folder = probPath
+	}
+	moveSet(a, folder, reason)
+}
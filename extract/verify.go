@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	verification
+		before a set is extracted it is checked against the .par2 and .sfv files in its folder that list any of its
+		volumes.
+			par2  par2 verify, then par2 repair if blocks are damaged or volumes are missing. a repaired set is
+			      read again to pick up volumes par2 recreated. par2 deletes its own files after a repair and its
+			      exit code is trusted, the set is not verified again.
+			sfv   crc32 of every listed volume. sfv can only detect damage, not repair it.
+		par2 is used when both are present. verification files are deleted with the archive after extraction,
+		verification files that don't belong to any archive set are junk.
+		sets that fail verification are moved with their verification files into the problem folder (-prob or
+		problem_folder in extract.conf) with a reason.txt. without a problem folder they are left in place.
+*/
+
+var (
+	verify     = true
+	par2       = "par2"
+	probPath   string
+	checks     map[string][]string // verification files by folder
+	setChecks  map[string][]string // verification files of each set by first volume
+	reCheck    = regexp.MustCompile(`(?i)\.(sfv|par2)$`)
+	rePar2Stem = regexp.MustCompile(`(?i)(\.vol\d+[+-]\d+)?\.par2$`)
+	reSfvLine  = regexp.MustCompile(`^(.+?)\s+([0-9a-fA-F]{8})$`)
+)
+
+var par2FileDesc = []byte("PAR 2.0\x00FileDesc")
+
+func isCheckFile(path string) bool {
+	return reCheck.MatchString(path)
+}
+
+// ownChecks returns the verification files in files that list any volume of the set. par2 files are returned as
+// groups with the index file first.
+func ownChecks(a Archive, files []string) []string {
+	vols := make(map[string]bool)
+	for _, v := range a.Volumes() {
+		vols[strings.ToLower(filepath.Base(v))] = true
+	}
+	covers := func(names []string) bool {
+		for _, n := range names {
+			if vols[strings.ToLower(filepath.Base(n))] {
+				return true
+			}
+		}
+		return false
+	}
+	var owned []string
+	for _, group := range par2Groups(files) {
+		if covers(par2Names(group)) {
+			owned = append(owned, group...)
+		}
+	}
+	for _, f := range files {
+		if strings.HasSuffix(strings.ToLower(f), ".sfv") {
+			sums, e := readSfv(f)
+			if e != nil {
+				chk(e)
+				continue
+			}
+			var names []string
+			for n := range sums {
+				names = append(names, n)
+			}
+			if covers(names) {
+				owned = append(owned, f)
+			}
+		}
+	}
+	return owned
+}
+
+// par2Groups groups par2 files that belong to the same recovery set, index file first
+func par2Groups(files []string) [][]string {
+	groups := make(map[string][]string)
+	var stems []string
+	for _, f := range files {
+		if !strings.HasSuffix(strings.ToLower(f), ".par2") {
+			continue
+		}
+		stem := strings.ToLower(rePar2Stem.ReplaceAllString(f, ""))
+		if _, ok := groups[stem]; !ok {
+			stems = append(stems, stem)
+		}
+		groups[stem] = append(groups[stem], f)
+	}
+	sort.Strings(stems)
+	var out [][]string
+	for _, stem := range stems {
+		g := groups[stem]
+		sort.SliceStable(g, func(i, j int) bool {
+			return len(g[i]) < len(g[j])
+		})
+		out = append(out, g)
+	}
+	return out
+}
+
+// par2Names returns the names of the files protected by a par2 recovery set, read from the file description
+// packets of the first file in the group that has them
+func par2Names(group []string) []string {
+	for _, f := range group {
+		names, e := readPar2Names(f)
+		if e != nil {
+			p("could not read par2 file %s: %s", f, e)
+			continue
+		}
+		if len(names) > 0 {
+			return names
+		}
+	}
+	return nil
+}
+func readPar2Names(path string) ([]string, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	var names []string
+	seen := make(map[string]bool)
+	head := make([]byte, 64)
+	for {
+		_, e = io.ReadFull(f, head)
+		if errors.Is(e, io.EOF) {
+			return names, nil
+		} else if e != nil {
+			return names, e
+		}
+		if !bytes.Equal(head[:8], []byte("PAR2\x00PKT")) {
+			return names, errors.New("invalid par2 packet header")
+		}
+		length := int64(binary.LittleEndian.Uint64(head[8:]))
+		if length < 64 || length%4 != 0 {
+			return names, errors.New("invalid par2 packet length")
+		}
+		if !bytes.Equal(head[48:64], par2FileDesc) {
+			_, e = f.Seek(length-64, io.SeekCurrent)
+			if e != nil {
+				return names, e
+			}
+			continue
+		}
+		// file id, md5, md5 of first 16k, length, then the name padded with zeros
+		body := make([]byte, length-64)
+		_, e = io.ReadFull(f, body)
+		if e != nil {
+			return names, e
+		}
+		if len(body) < 56 {
+			return names, errors.New("par2 file description packet too short")
+		}
+		name := string(bytes.TrimRight(body[56:], "\x00"))
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+}
+
+// readSfv returns the crc32 of each file listed in an sfv file by name
+func readSfv(path string) (map[string]uint32, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	sums := make(map[string]uint32)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		m := reSfvLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		crc, _ := strconv.ParseUint(m[2], 16, 32)
+		sums[strings.TrimSpace(m[1])] = uint32(crc)
+	}
+	return sums, sc.Err()
+}
+func fileCrc(path string) (uint32, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return 0, e
+	}
+	defer f.Close()
+	h := crc32.NewIEEE()
+	_, e = io.Copy(h, f)
+	return h.Sum32(), e
+}
+
+// verifySet checks a set against its verification files. repaired is true if par2 repaired the set, reason is
+// set if the set is damaged and can't be repaired
+func verifySet(a Archive) (repaired bool, reason string) {
+	files := setChecks[a.First()]
+	if len(files) == 0 {
+		return false, ""
+	}
+	for _, group := range par2Groups(files) {
+		index := group[0]
+		p("verifying %s with %s", a.First(), filepath.Base(index))
+		code, e := runPar2("v", "-q", index)
+		if e != nil {
+			p("could not run %s, skipping par2 verification: %s", par2, e)
+			break
+		}
+		switch code {
+		case 0:
+			p("par2 verified: %s", a.First())
+			return false, ""
+		case 1:
+			p("damaged or missing volumes in %s, repairing with par2", a.First())
+			code, e = runPar2("r", "-q", "-p", index)
+			if e == nil && code == 0 {
+				p("par2 repaired: %s", a.First())
+				return true, ""
+			}
+			return false, fmt.Sprintf("par2 repair of %s failed with exit code %d", filepath.Base(index), code)
+		default:
+			return false, fmt.Sprintf("par2 verify of %s failed with exit code %d, not enough recovery data to "+
+				"repair", filepath.Base(index), code)
+		}
+	}
+
+	dir := filepath.Dir(a.First())
+	vols := make(map[string]string)
+	for _, v := range a.Volumes() {
+		vols[strings.ToLower(filepath.Base(v))] = v
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(strings.ToLower(f), ".sfv") {
+			continue
+		}
+		sums, e := readSfv(f)
+		if e != nil {
+			return false, fmt.Sprintf("could not read %s: %s", filepath.Base(f), e)
+		}
+		p("verifying %s with %s", a.First(), filepath.Base(f))
+		for name, want := range sums {
+			path, ok := vols[strings.ToLower(filepath.Base(name))]
+			if !ok {
+				if _, e := os.Stat(filepath.Join(dir, name)); e != nil && sameSet(name, a.First()) {
+					return false, fmt.Sprintf("%s lists %s, which is missing", filepath.Base(f), name)
+				}
+				continue
+			}
+			got, e := fileCrc(path)
+			if e != nil {
+				return false, fmt.Sprintf("could not read %s: %s", name, e)
+			}
+			if got != want {
+				return false, fmt.Sprintf("crc mismatch in %s: expected %08X, got %08X", name, want, got)
+			}
+		}
+		p("sfv verified: %s", a.First())
+	}
+	return false, ""
+}
+
+// sameSet reports whether a file name listed in an sfv is a volume of the same set as first
+func sameSet(name, first string) bool {
+	set, _, _, ok := parseVolume(name)
+	firstSet, _, _, _ := parseVolume(first)
+	return ok && set == firstSet
+}
+
+// runPar2 runs par2 and returns its exit code. error is only set if par2 couldn't be run.
+func runPar2(args ...string) (int, error) {
+	e := run(append([]string{par2}, args...)...)
+	var exitErr *exec.ExitError
+	if errors.As(e, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	return 0, e
+}
+
+// rescanSet reads the volumes of a set from its folder again, after par2 recreated missing ones. par2 deletes its
+// own files after a repair, so verification files that are gone are dropped from the set.
+func rescanSet(a Archive) Archive {
+	dir := filepath.Dir(a.First())
+	entries, e := os.ReadDir(dir)
+	if e != nil {
+		chk(e)
+		return a
+	}
+	var vols []string
+	for _, en := range entries {
+		path := filepath.Join(dir, en.Name())
+		if !en.IsDir() && detect(path) != "" {
+			vols = append(vols, path)
+		}
+	}
+	for _, s := range archiveSets(vols) {
+		if isAny(a.First(), s.Volumes()...) {
+			var checks []string
+			for _, c := range setChecks[a.First()] {
+				if _, e := os.Stat(c); e == nil {
+					checks = append(checks, c)
+				}
+			}
+			setChecks[s.First()] = checks
+			return s
+		}
+	}
+	return a
+}
+
+// moveToProblem moves a damaged set and its verification files into the problem folder
+func moveToProblem(a Archive, reason string) {
+	moveSet(a, probPath, reason)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+/*
+	encrypted zip
+		archive/zip can't decrypt, so encrypted files are read raw with OpenRaw, decrypted here and decompressed.
+			zip 2.0 (zipcrypto)  flag bit 0, 12 byte header with a check byte
+			winzip aes           method 99, 0x9901 extra field with key strength and the real method.
+			                     pbkdf2-sha1 key, aes-ctr with a little endian counter and an hmac-sha1 auth code.
+		pkware strong encryption (flag bit 6) and encrypted central directories are not supported.
+*/
+
+var (
+	errWrongPassword = errors.New("wrong password")
+	errChecksum      = errors.New("checksum error")
+)
+
+func isZipEncrypted(f *zip.File) bool {
+	return f.Flags&0x1 != 0 || f.Method == 99
+}
+
+// openEncrypted returns a reader of the decrypted and decompressed contents of f
+func openEncrypted(f *zip.File, pw string) (io.ReadCloser, error) {
+	raw, e := f.OpenRaw()
+	if e != nil {
+		return nil, e
+	}
+	method := f.Method
+	checkCrc := true
+	var data io.Reader
+	var final func() error
+
+	if f.Method == 99 {
+		strength, actual, vendor, ok := aesExtra(f.Extra)
+		if !ok {
+			return nil, errors.New("winzip aes file without aes extra field")
+		}
+		method = actual
+		// ae-2 stores no crc, the auth code replaces it
+		checkCrc = vendor == 1
+		data, final, e = aesReader(raw, int64(f.CompressedSize64), pw, strength)
+	} else {
+		check := byte(f.CRC32 >> 24)
+		if f.Flags&0x8 != 0 {
+			// crc isn't known when the header is written, the high byte of the dos time is used instead
+			check = byte(f.ModifiedTime >> 8)
+		}
+		data, e = zipCryptoReader(raw, int64(f.CompressedSize64), pw, check)
+	}
+	if e != nil {
+		return nil, e
+	}
+
+	var rc io.ReadCloser
+	switch method {
+	case zip.Store:
+		rc = io.NopCloser(data)
+	case zip.Deflate:
+		rc = flate.NewReader(data)
+	case 12:
+		rc = io.NopCloser(bzip2.NewReader(data))
+	default:
+		return nil, fmt.Errorf("unsupported compression method %d", method)
+	}
+	return &checkReader{rc: rc, hash: crc32.NewIEEE(), want: f.CRC32, check: checkCrc, final: final,
+		drain: data}, nil
+}
+
+// checkReader checks the crc and the aes auth code of a file once it has been read to the end
+type checkReader struct {
+	rc    io.ReadCloser
+	hash  hash.Hash32
+	want  uint32
+	check bool
+	final func() error
+	drain io.Reader
+}
+
+func (r *checkReader) Read(b []byte) (int, error) {
+	n, e := r.rc.Read(b)
+	r.hash.Write(b[:n])
+	if e != io.EOF {
+		return n, e
+	}
+	if r.final != nil {
+		// the decompressor may stop before the end of the encrypted data, the auth code covers all of it
+		_, _ = io.Copy(io.Discard, r.drain)
+		if e := r.final(); e != nil {
+			return n, e
+		}
+	}
+	if r.check && r.hash.Sum32() != r.want {
+		return n, errChecksum
+	}
+	return n, io.EOF
+}
+func (r *checkReader) Close() error {
+	return r.rc.Close()
+}
+
+type zipCrypto struct {
+	k0, k1, k2 uint32
+}
+
+func newZipCrypto(pw string) *zipCrypto {
+	z := &zipCrypto{305419896, 591751049, 878082192}
+	for _, b := range []byte(pw) {
+		z.update(b)
+	}
+	return z
+}
+func (z *zipCrypto) update(b byte) {
+	z.k0 = crc32.IEEETable[byte(z.k0)^b] ^ z.k0>>8
+	z.k1 = (z.k1+z.k0&0xff)*134775813 + 1
+	z.k2 = crc32.IEEETable[byte(z.k2)^byte(z.k1>>24)] ^ z.k2>>8
+}
+
+type zipCryptoStream struct {
+	z *zipCrypto
+	r io.Reader
+}
+
+func (s *zipCryptoStream) Read(b []byte) (int, error) {
+	n, e := s.r.Read(b)
+	for i := 0; i < n; i++ {
+		t := s.z.k2 | 2
+		b[i] ^= byte(t * (t ^ 1) >> 8)
+		s.z.update(b[i])
+	}
+	return n, e
+}
+
+// zipCryptoReader checks the password against the encryption header and returns a reader of the decrypted data
+func zipCryptoReader(raw io.Reader, size int64, pw string, check byte) (io.Reader, error) {
+	if size < 12 {
+		return nil, errors.New("encrypted file too short")
+	}
+	s := &zipCryptoStream{z: newZipCrypto(pw), r: io.LimitReader(raw, size)}
+	head := make([]byte, 12)
+	_, e := io.ReadFull(s, head)
+	if e != nil {
+		return nil, e
+	}
+	if head[11] != check {
+		return nil, errWrongPassword
+	}
+	return s, nil
+}
+
+// aesExtra returns key strength, compression method and vendor version from the 0x9901 extra field
+func aesExtra(extra []byte) (strength int, method uint16, vendor uint16, ok bool) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		if id == 0x9901 && size >= 7 {
+			d := extra[4:]
+			return int(d[4]), binary.LittleEndian.Uint16(d[5:]), binary.LittleEndian.Uint16(d), true
+		}
+		extra = extra[4+size:]
+	}
+	return 0, 0, 0, false
+}
+
+// aesCtr is aes in counter mode with the little endian counter winzip uses
+type aesCtr struct {
+	block   cipher.Block
+	counter [16]byte
+	stream  [16]byte
+	pos     int
+}
+
+func (c *aesCtr) xor(b []byte) {
+	for i := range b {
+		if c.pos == 16 {
+			for j := range c.counter {
+				c.counter[j]++
+				if c.counter[j] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.stream[:], c.counter[:])
+			c.pos = 0
+		}
+		b[i] ^= c.stream[c.pos]
+		c.pos++
+	}
+}
+
+type aesStream struct {
+	ctr *aesCtr
+	mac hash.Hash
+	r   io.Reader
+}
+
+func (s *aesStream) Read(b []byte) (int, error) {
+	n, e := s.r.Read(b)
+	s.mac.Write(b[:n])
+	s.ctr.xor(b[:n])
+	return n, e
+}
+
+// aesReader checks the password against the verifier and returns a reader of the decrypted data and a func that
+// checks the auth code once all data has been read
+func aesReader(raw io.Reader, size int64, pw string, strength int) (io.Reader, func() error, error) {
+	if strength < 1 || strength > 3 {
+		return nil, nil, fmt.Errorf("unknown aes strength %d", strength)
+	}
+	keyLen := 8 + 8*strength
+	saltLen := 4 + 4*strength
+	dataLen := size - int64(saltLen) - 2 - 10
+	if dataLen < 0 {
+		return nil, nil, errors.New("encrypted file too short")
+	}
+	head := make([]byte, saltLen+2)
+	_, e := io.ReadFull(raw, head)
+	if e != nil {
+		return nil, nil, e
+	}
+	key := pbkdf2.Key([]byte(pw), head[:saltLen], 1000, 2*keyLen+2, sha1.New)
+	if !bytes.Equal(key[2*keyLen:], head[saltLen:]) {
+		return nil, nil, errWrongPassword
+	}
+	block, e := aes.NewCipher(key[:keyLen])
+	if e != nil {
+		return nil, nil, e
+	}
+	s := &aesStream{ctr: &aesCtr{block: block, pos: 16}, mac: hmac.New(sha1.New, key[keyLen:2*keyLen]),
+		r: io.LimitReader(raw, dataLen)}
+	final := func() error {
+		code := make([]byte, 10)
+		_, e := io.ReadFull(raw, code)
+		if e != nil {
+			return e
+		}
+		if !hmac.Equal(s.mac.Sum(nil)[:10], code) {
+			return errChecksum
+		}
+		return nil
+	}
+	return s, final, nil
+}
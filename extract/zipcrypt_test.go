@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// the fixtures in testdata hold hello.txt (stored) and fox.txt (deflated), encrypted with the password secret.
+// zipcrypto_infozip.zip is from zip -P and sets the data descriptor flag, so its check byte is from the file time.
+// the others are written by hand, aes256_badmac.zip only holds fox.txt with a damaged auth code.
+var (
+	fixtureHello = "hello from an encrypted archive\n"
+	fixtureFox   = strings.Repeat("the quick brown fox jumps over the lazy dog\n", 40)
+)
+
+func TestOpenEncrypted(t *testing.T) {
+	tests := []struct {
+		fixture string
+		pw      string
+		want    error
+	}{
+		{"zipcrypto.zip", "secret", nil},
+		{"zipcrypto.zip", "wrong", errWrongPassword},
+		{"zipcrypto_infozip.zip", "secret", nil},
+		{"zipcrypto_infozip.zip", "wrong", errWrongPassword},
+		{"aes128.zip", "secret", nil},
+		{"aes128.zip", "wrong", errWrongPassword},
+		{"aes256.zip", "secret", nil},
+		{"aes256.zip", "wrong", errWrongPassword},
+		{"aes256_badmac.zip", "secret", errChecksum},
+	}
+	for _, tt := range tests {
+		zr, e := zip.OpenReader(filepath.Join("testdata", tt.fixture))
+		if e != nil {
+			t.Fatal(e)
+		}
+		for _, f := range zr.File {
+			if !isZipEncrypted(f) {
+				t.Errorf("%s %s: not encrypted", tt.fixture, f.Name)
+			}
+			got, e := readEncrypted(f, tt.pw)
+			// zipcrypto has one check byte, a wrong password can get past it and fail on the crc instead
+			if tt.want == errWrongPassword && errors.Is(e, errChecksum) {
+				e = errWrongPassword
+			}
+			if !errors.Is(e, tt.want) {
+				t.Errorf("%s %s with %q: error %v, want %v", tt.fixture, f.Name, tt.pw, e, tt.want)
+				continue
+			}
+			want := fixtureFox
+			if f.Name == "hello.txt" {
+				want = fixtureHello
+			}
+			if e == nil && got != want {
+				t.Errorf("%s %s: content differs after decrypt", tt.fixture, f.Name)
+			}
+		}
+		zr.Close()
+	}
+}
+
+func readEncrypted(f *zip.File, pw string) (string, error) {
+	rc, e := openEncrypted(f, pw)
+	if e != nil {
+		return "", e
+	}
+	defer rc.Close()
+	b, e := io.ReadAll(rc)
+	return string(b), e
+}
+
+func TestAesExtra(t *testing.T) {
+	tests := []struct {
+		extra    []byte
+		strength int
+		method   uint16
+		vendor   uint16
+		ok       bool
+	}{
+		{[]byte{0x01, 0x99, 7, 0, 2, 0, 'A', 'E', 3, 8, 0}, 3, zip.Deflate, 2, true},
+		// a unix time field before the aes field
+		{[]byte{0x55, 0x54, 1, 0, 0, 0x01, 0x99, 7, 0, 1, 0, 'A', 'E', 1, 0, 0}, 1, zip.Store, 1, true},
+		{[]byte{0x55, 0x54, 1, 0, 0}, 0, 0, 0, false},
+		{[]byte{0x01, 0x99, 7, 0, 2, 0}, 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		strength, method, vendor, ok := aesExtra(tt.extra)
+		if strength != tt.strength || method != tt.method || vendor != tt.vendor || ok != tt.ok {
+			t.Errorf("aesExtra(% x) = %d, %d, %d, %v, want %d, %d, %d, %v", tt.extra, strength, method, vendor, ok,
+				tt.strength, tt.method, tt.vendor, tt.ok)
+		}
+	}
+}
+
+func TestZipTryPassword(t *testing.T) {
+	for _, fixture := range []string{"zipcrypto.zip", "zipcrypto_infozip.zip", "aes128.zip", "aes256.zip"} {
+		a := &zipArchive{volumes: []string{filepath.Join("testdata", fixture)}}
+		if !a.IsEncrypted() {
+			t.Errorf("%s: not encrypted", fixture)
+		}
+		if a.TryPassword("wrong") {
+			t.Errorf("%s: wrong password accepted", fixture)
+		}
+		if !a.TryPassword("secret") || a.password != "secret" {
+			t.Errorf("%s: password not accepted", fixture)
+		}
+	}
+	a := &zipArchive{volumes: []string{filepath.Join("testdata", "aes256_badmac.zip")}}
+	if a.TryPassword("secret") {
+		t.Error("aes256_badmac.zip: password accepted with a damaged auth code")
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+	split zip sets
+		volumes of a split set are read as one file. hjsplit style sets (name.001 ..) are a zip cut into pieces, so
+		reading the volumes end to end is enough. zip -s sets (name.z01 .. name.zip) store offsets relative to the
+		volume a header is on, so the central directory is rebuilt with offsets into the joined volumes and
+		appended after the last volume, where archive/zip finds it.
+*/
+
+const (
+	sigCentralDir = 0x02014b50
+	sigEnd        = 0x06054b50
+	sigEnd64      = 0x06064b50
+	sigLocator64  = 0x07064b50
+)
+
+// volumeReader reads a set of volumes as one file, followed by tail
+type volumeReader struct {
+	files  []*os.File
+	starts []int64 // offset of each volume in the joined file
+	size   int64   // size of the joined volumes without tail
+	tail   []byte
+}
+
+func openVolumes(paths []string) (*volumeReader, error) {
+	var vr volumeReader
+	for _, path := range paths {
+		f, e := os.Open(path)
+		if e != nil {
+			vr.Close()
+			return nil, e
+		}
+		st, e := f.Stat()
+		if e != nil {
+			f.Close()
+			vr.Close()
+			return nil, e
+		}
+		vr.files = append(vr.files, f)
+		vr.starts = append(vr.starts, vr.size)
+		vr.size += st.Size()
+	}
+	return &vr, nil
+}
+func (vr *volumeReader) Close() error {
+	for _, f := range vr.files {
+		f.Close()
+	}
+	return nil
+}
+func (vr *volumeReader) Size() int64 {
+	return vr.size + int64(len(vr.tail))
+}
+func (vr *volumeReader) ReadAt(b []byte, off int64) (int, error) {
+	n := 0
+	for n < len(b) {
+		pos := off + int64(n)
+		if pos >= vr.Size() {
+			return n, io.EOF
+		}
+		if pos >= vr.size {
+			n += copy(b[n:], vr.tail[pos-vr.size:])
+			continue
+		}
+		i := len(vr.starts) - 1
+		for i > 0 && vr.starts[i] > pos {
+			i--
+		}
+		end := vr.size
+		if i+1 < len(vr.starts) {
+			end = vr.starts[i+1]
+		}
+		want := b[n:]
+		if int64(len(want)) > end-pos {
+			want = want[:end-pos]
+		}
+		m, e := vr.files[i].ReadAt(want, pos-vr.starts[i])
+		n += m
+		if e != nil && !errors.Is(e, io.EOF) {
+			return n, e
+		}
+		if m < len(want) {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	return n, nil
+}
+
+// rebuildDirectory reads the central directory of a zip -s set, converts every per-volume offset into an offset in
+// the joined volumes and sets tail to the new central directory and zip64 end records
+func (vr *volumeReader) rebuildDirectory() error {
+	// end of central directory record is in the last 64k of the last volume
+	last := len(vr.files) - 1
+	lastSize := vr.size - vr.starts[last]
+	n := int64(65 * 1024)
+	if n > lastSize {
+		n = lastSize
+	}
+	buf := make([]byte, n)
+	_, e := vr.files[last].ReadAt(buf, lastSize-n)
+	if e != nil && !errors.Is(e, io.EOF) {
+		return e
+	}
+	pos := -1
+	for i := len(buf) - 22; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(buf[i:]) == sigEnd {
+			pos = i
+			break
+		}
+	}
+	if pos == -1 {
+		return errors.New("zip: end of central directory not found in last volume")
+	}
+	end := buf[pos:]
+	dirDisk := uint32(binary.LittleEndian.Uint16(end[6:]))
+	records := uint64(binary.LittleEndian.Uint16(end[10:]))
+	dirSize := uint64(binary.LittleEndian.Uint32(end[12:]))
+	dirOffset := uint64(binary.LittleEndian.Uint32(end[16:]))
+
+	if records == 0xffff || dirSize == 0xffffffff || dirOffset == 0xffffffff {
+		if pos < 20 || binary.LittleEndian.Uint32(buf[pos-20:]) != sigLocator64 {
+			return errors.New("zip: zip64 end of central directory locator not found")
+		}
+		loc := buf[pos-20:]
+		disk64 := binary.LittleEndian.Uint32(loc[4:])
+		off64 := binary.LittleEndian.Uint64(loc[8:])
+		if int(disk64) >= len(vr.files) {
+			return fmt.Errorf("zip: zip64 end record on missing volume %d", disk64+1)
+		}
+		rec := make([]byte, 56)
+		_, e = vr.ReadAt(rec, vr.starts[disk64]+int64(off64))
+		if e != nil {
+			return e
+		}
+		if binary.LittleEndian.Uint32(rec) != sigEnd64 {
+			return errors.New("zip: zip64 end of central directory not found")
+		}
+		dirDisk = binary.LittleEndian.Uint32(rec[20:])
+		records = binary.LittleEndian.Uint64(rec[32:])
+		dirSize = binary.LittleEndian.Uint64(rec[40:])
+		dirOffset = binary.LittleEndian.Uint64(rec[48:])
+	}
+	if int(dirDisk) >= len(vr.files) {
+		return fmt.Errorf("zip: central directory on missing volume %d", dirDisk+1)
+	}
+
+	dir := make([]byte, dirSize)
+	_, e = vr.ReadAt(dir, vr.starts[dirDisk]+int64(dirOffset))
+	if e != nil {
+		return e
+	}
+	var out bytes.Buffer
+	for i := uint64(0); i < records; i++ {
+		if len(dir) < 46 || binary.LittleEndian.Uint32(dir) != sigCentralDir {
+			return errors.New("zip: invalid central directory header")
+		}
+		nameLen := int(binary.LittleEndian.Uint16(dir[28:]))
+		extraLen := int(binary.LittleEndian.Uint16(dir[30:]))
+		commentLen := int(binary.LittleEndian.Uint16(dir[32:]))
+		total := 46 + nameLen + extraLen + commentLen
+		if len(dir) < total {
+			return errors.New("zip: central directory header truncated")
+		}
+		rec, e := vr.relocate(dir[:total])
+		if e != nil {
+			return e
+		}
+		out.Write(rec)
+		dir = dir[total:]
+	}
+
+	// zip64 end record, locator and end record for the new directory, all pointing into the joined file
+	newOffset := uint64(vr.size)
+	newSize := uint64(out.Len())
+	le := binary.LittleEndian
+	end64 := make([]byte, 56)
+	le.PutUint32(end64[0:], sigEnd64)
+	le.PutUint64(end64[4:], 44)
+	le.PutUint16(end64[12:], 45)
+	le.PutUint16(end64[14:], 45)
+	le.PutUint64(end64[24:], records)
+	le.PutUint64(end64[32:], records)
+	le.PutUint64(end64[40:], newSize)
+	le.PutUint64(end64[48:], newOffset)
+	loc := make([]byte, 20)
+	le.PutUint32(loc[0:], sigLocator64)
+	le.PutUint64(loc[8:], newOffset+newSize)
+	le.PutUint32(loc[16:], 1)
+	endRec := make([]byte, 22)
+	le.PutUint32(endRec[0:], sigEnd)
+	le.PutUint16(endRec[8:], 0xffff)
+	le.PutUint16(endRec[10:], 0xffff)
+	le.PutUint32(endRec[12:], 0xffffffff)
+	le.PutUint32(endRec[16:], 0xffffffff)
+	out.Write(end64)
+	out.Write(loc)
+	out.Write(endRec)
+	vr.tail = out.Bytes()
+	return nil
+}
+
+// relocate returns a central directory header with the local header offset moved into a zip64 extra field as an
+// offset into the joined volumes and the disk number set to 0
+func (vr *volumeReader) relocate(rec []byte) ([]byte, error) {
+	le := binary.LittleEndian
+	nameLen := int(le.Uint16(rec[28:]))
+	extraLen := int(le.Uint16(rec[30:]))
+	usize := uint64(le.Uint32(rec[24:]))
+	csize := uint64(le.Uint32(rec[20:]))
+	disk := uint64(le.Uint16(rec[34:]))
+	offset := uint64(le.Uint32(rec[42:]))
+	extra := rec[46+nameLen : 46+nameLen+extraLen]
+
+	// read the values that are in the zip64 extra field and keep all other extra fields
+	var kept []byte
+	for len(extra) >= 4 {
+		id := le.Uint16(extra)
+		size := int(le.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		data := extra[4 : 4+size]
+		if id == 0x0001 {
+			next := func() uint64 {
+				if len(data) < 8 {
+					return 0
+				}
+				v := le.Uint64(data)
+				data = data[8:]
+				return v
+			}
+			if usize == 0xffffffff {
+				usize = next()
+			}
+			if csize == 0xffffffff {
+				csize = next()
+			}
+			if offset == 0xffffffff {
+				offset = next()
+			}
+			if disk == 0xffff && len(data) >= 4 {
+				disk = uint64(le.Uint32(data))
+			}
+		} else {
+			kept = append(kept, extra[:4+size]...)
+		}
+		extra = extra[4+size:]
+	}
+	if int(disk) >= len(vr.files) {
+		return nil, fmt.Errorf("zip: file on missing volume %d", disk+1)
+	}
+	offset += uint64(vr.starts[disk])
+
+	// archive/zip reads zip64 values in this order, only for the fields set to 0xffffffff
+	var z64 []byte
+	put := func(v uint64) {
+		b := make([]byte, 8)
+		le.PutUint64(b, v)
+		z64 = append(z64, b...)
+	}
+	if le.Uint32(rec[24:]) == 0xffffffff {
+		put(usize)
+	}
+	if le.Uint32(rec[20:]) == 0xffffffff {
+		put(csize)
+	}
+	put(offset)
+	head := make([]byte, 4)
+	le.PutUint16(head, 0x0001)
+	le.PutUint16(head[2:], uint16(len(z64)))
+	newExtra := append(append(head, z64...), kept...)
+
+	out := make([]byte, 0, len(rec)+len(newExtra))
+	out = append(out, rec[:46+nameLen]...)
+	le.PutUint16(out[30:], uint16(len(newExtra)))
+	le.PutUint16(out[34:], 0)
+	le.PutUint32(out[42:], 0xffffffff)
+	out = append(out, newExtra...)
+	out = append(out, rec[46+nameLen+extraLen:]...)
+	return out, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSplitZip writes files as a zip -s set name.z01 .. name.zip in dir with volumes of volSize bytes and returns
+// the volume paths
+func writeSplitZip(t *testing.T, dir, name string, files map[string]string, volSize int) []string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for n, content := range files {
+		w, e := zw.CreateHeader(&zip.FileHeader{Name: n, Method: zip.Store})
+		if e != nil {
+			t.Fatal(e)
+		}
+		_, _ = w.Write([]byte(content))
+	}
+	if e := zw.Close(); e != nil {
+		t.Fatal(e)
+	}
+	raw := buf.Bytes()
+	le := binary.LittleEndian
+	end := raw[len(raw)-22:]
+	records := int(le.Uint16(end[10:]))
+	dirSize := int(le.Uint32(end[12:]))
+	dirOffset := int(le.Uint32(end[16:]))
+
+	// the set starts with the split signature, offsets are counted from there
+	data := append([]byte("PK\x07\x08"), raw[:dirOffset]...)
+	var vols [][]byte
+	for len(data) > volSize {
+		vols = append(vols, data[:volSize])
+		data = data[volSize:]
+	}
+	last := len(vols)
+	lastData := len(data)
+
+	// offsets in the central directory are relative to the volume each local header starts on
+	dir64 := append([]byte{}, raw[dirOffset:dirOffset+dirSize]...)
+	for i, rec := 0, dir64; i < records; i++ {
+		offset := int(le.Uint32(rec[42:])) + 4
+		le.PutUint16(rec[34:], uint16(offset/volSize))
+		le.PutUint32(rec[42:], uint32(offset%volSize))
+		total := 46 + int(le.Uint16(rec[28:])) + int(le.Uint16(rec[30:])) + int(le.Uint16(rec[32:]))
+		rec = rec[total:]
+	}
+	endRec := append([]byte{}, end...)
+	le.PutUint16(endRec[4:], uint16(last))
+	le.PutUint16(endRec[6:], uint16(last))
+	le.PutUint32(endRec[16:], uint32(lastData))
+	vols = append(vols, append(append(append([]byte{}, data...), dir64...), endRec...))
+
+	var paths []string
+	for i, v := range vols {
+		path := filepath.Join(dir, fmt.Sprintf("%s.z%02d", name, i+1))
+		if i == last {
+			path = filepath.Join(dir, name+".zip")
+		}
+		if e := os.WriteFile(path, v, 0644); e != nil {
+			t.Fatal(e)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestSplitZip(t *testing.T) {
+	files := map[string]string{
+		"movie/movie.mkv": strings.Repeat("video data ", 40),
+		"movie/movie.nfo": "nfo",
+		"movie/subs.srt":  strings.Repeat("1\n00:00:01,000 --> 00:00:02,000\nline\n\n", 8),
+	}
+	for _, volSize := range []int{64, 100, 333} {
+		t.Run(fmt.Sprint(volSize), func(t *testing.T) {
+			dir := t.TempDir()
+			paths := writeSplitZip(t, dir, "movie", files, volSize)
+			sets := archiveSets(paths)
+			if len(sets) != 1 {
+				t.Fatalf("got %d sets, want 1", len(sets))
+			}
+			a, ok := sets[0].(*zipArchive)
+			if !ok || !a.spanned {
+				t.Fatalf("got %T, want spanned zip", sets[0])
+			}
+			if filepath.Base(a.First()) != "movie.z01" {
+				t.Errorf("first volume %s, want movie.z01", a.First())
+			}
+			members, e := a.List()
+			if e != nil {
+				t.Fatal(e)
+			}
+			if len(members) != len(files) {
+				t.Errorf("listed %d members, want %d", len(members), len(files))
+			}
+			dst := filepath.Join(dir, "out")
+			if e = a.Extract(dst, nil); e != nil {
+				t.Fatal(e)
+			}
+			for n, content := range files {
+				b, e := os.ReadFile(filepath.Join(dst, n))
+				if e != nil {
+					t.Error(e)
+				} else if string(b) != content {
+					t.Errorf("%s: content differs after extract", n)
+				}
+			}
+		})
+	}
+}
+
+func TestRelocate(t *testing.T) {
+	vr := &volumeReader{files: make([]*os.File, 3), starts: []int64{0, 1000, 2000}}
+	le := binary.LittleEndian
+	rec := make([]byte, 46+len("a.txt"))
+	le.PutUint32(rec, sigCentralDir)
+	le.PutUint32(rec[20:], 10)
+	le.PutUint32(rec[24:], 10)
+	le.PutUint16(rec[28:], uint16(len("a.txt")))
+	le.PutUint16(rec[34:], 2)
+	le.PutUint32(rec[42:], 123)
+	copy(rec[46:], "a.txt")
+
+	out, e := vr.relocate(rec)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if disk := le.Uint16(out[34:]); disk != 0 {
+		t.Errorf("disk = %d, want 0", disk)
+	}
+	if off := le.Uint32(out[42:]); off != 0xffffffff {
+		t.Errorf("offset = %#x, want 0xffffffff", off)
+	}
+	extra := out[46+len("a.txt"):]
+	if le.Uint16(extra) != 0x0001 || le.Uint16(extra[2:]) != 8 {
+		t.Fatalf("zip64 extra field = % x", extra)
+	}
+	if off := le.Uint64(extra[4:]); off != 2123 {
+		t.Errorf("zip64 offset = %d, want 2123", off)
+	}
+
+	le.PutUint16(rec[34:], 3)
+	if _, e = vr.relocate(rec); e == nil {
+		t.Error("relocate to a missing volume did not fail")
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -35,6 +36,9 @@ var (
 	procFolder, preProcFolder, convertFolder string
 	recycleFolder, torFolder, probFolder     string
 	protectedFolders                         []string
+	autoSort                                 bool
+	sortLock                                 sync.Mutex
+	sortSeen                                 map[string]time.Time // mkvs left in procFolder by the last m -auto
 
 	torFileInterval      = 30 * time.Second
 	convertInterval      = 60 * time.Second
@@ -694,6 +698,9 @@ func parseConfig() {
 				p("problem_folder   -> %s", v)
 				probFolder = v
 				protectedFolders = append(protectedFolders, v)
+			case "auto_sort":
+				autoSort = reTrue.MatchString(v)
+				p("auto_sort        -> %t", autoSort)
 			case "default":
 				if reTrue.MatchString(v) {
 					defaultDeluge = deluge
@@ -1049,6 +1056,47 @@ func muxPreProc() {
 		chk(err)
 	}
 }
+
+// sortProc moves movies in the proc folder that m can name with confidence into the library, the rest are left
+// on m's review list
+func sortProc() {
+	if !autoSort {
+		return
+	}
+	// muxConvert and finishTorrents both sort, one m at a time
+	sortLock.Lock()
+	defer sortLock.Unlock()
+	// movies on the review list stay in procFolder, m only runs again for new or changed mkvs
+	found := false
+	for f, t := range procMkvs() {
+		if seen, ok := sortSeen[f]; !ok || !seen.Equal(t) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return
+	}
+	p("running m -auto in %s", procFolder)
+	err := run("m", "-auto", procFolder)
+	if err != nil {
+		p("m -auto failed, running it again when the mkvs in %s change: %s", procFolder, err)
+	}
+	// recorded after a failure too, or a failing m would run and log the same error every pass
+	sortSeen = procMkvs()
+}
+
+// procMkvs returns the mkvs in procFolder with their modified time
+func procMkvs() map[string]time.Time {
+	mkvs := make(map[string]time.Time)
+	_ = filepath.Walk(procFolder, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(strings.ToLower(path), ".mkv") {
+			mkvs[path] = info.ModTime()
+		}
+		return nil
+	})
+	return mkvs
+}
 func muxConvert() {
 	time.Sleep(convertStartDelay)
 	p("starting convert folder monitor")
@@ -1067,6 +1115,7 @@ func muxConvert() {
 			err := run(cmd...)
 			chk(err)
 			rmEmptyFolders(convertFolder)
+			sortProc()
 		}
 		time.Sleep(convertInterval)
 	}
@@ -1118,6 +1167,7 @@ func finishTorrents() {
 			extractPreProc()
 			muxPreProc()
 			mvTree(preProcFolder, procFolder, true)
+			sortProc()
 		}
 		time.Sleep(finishInterval)
 	}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	m -auto [folder]
+		sort without prompts. every name candidate of a video is searched (see providers.go) and each result is scored
+			title  similarity of the candidate title to the tmdb title or original title   60%
+			year   same year as the candidate, half for one year off                       30%
+			popularity  tmdb popularity, full at 100                                       10%
+		when the best result scores at least autoMinScore and no other result is within autoMargin of it, the video
+		is moved to the guessed folder with the tmdb name. everything else, and movies already in the library, is
+		added to the review list.
+	m -review
+		work through the review list interactively. entries that were moved or renamed are removed from the list.
+*/
+
+var (
+	autoMinScore = 0.85
+	autoMargin   = 0.1
+	reviewFile   string // proc_folder/m_review.txt unless review_file is set in m.conf
+	reNotAlnum   = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+)
+
+type match struct {
+	tmdb  TmdbResult
+	score float64
+}
+
+func sortAuto(mkv string) {
+	fmt.Printf("video :\n| %s\n", mkv)
+	matches := findMatches(mkv)
+	if len(matches) == 0 {
+		addReview(mkv, "no match")
+		return
+	}
+	best := matches[0]
+	name := tmdbFileName(&best.tmdb)
+	fmt.Printf("| best match: %s, score %.2f\n", name, best.score)
+	if best.score < autoMinScore {
+		addReview(mkv, fmt.Sprintf("best match %s scored %.2f, below %.2f", name, best.score, autoMinScore))
+		return
+	}
+	if len(matches) > 1 && best.score-matches[1].score < autoMargin {
+		addReview(mkv, fmt.Sprintf("%s and %s scored within %.2f", name, tmdbFileName(&matches[1].tmdb),
+			autoMargin))
+		return
+	}
+	guess, rule := guessFolder(mkv, mkv, best.tmdb.ReleaseDate.year(), &best.tmdb)
+	if guess == "" {
+		addReview(mkv, "no folder rule matched "+name)
+		return
+	}
+	fmt.Printf("| folder: %s [%s]\n", guess, rule)
+	dst := path.Join(sortedFolder, guess, name)
+	if fileExists(dst) {
+		addReview(mkv, dst+" already exists")
+		return
+	}
+	if dupes := findDuplicates(name, &best.tmdb); len(dupes) > 0 {
+		addReview(mkv, "already in library: "+strings.Join(dupes, ", "))
+		return
+	}
+	fmt.Printf("| Moving -> %s\n", dst)
+	e := move(mkv, dst)
+	if e != nil {
+		chk(e)
+		addReview(mkv, "move failed: "+e.Error())
+		return
+	}
+	addToLibrary(dst, &best.tmdb)
+	writeExtras(dst, &best.tmdb)
+}
+
+// findMatches searches the providers for every name candidate of a video and returns each movie found once with its best
+// score, highest first
+func findMatches(mkv string) []match {
+	byKey := make(map[string]match)
+	searched := make(map[string]bool)
+	for _, name := range nameCandidates(mkv) {
+		title, year := getNameYear(path.Base(name))
+		if searched[title+"|"+year] {
+			continue
+		}
+		searched[title+"|"+year] = true
+		for _, t := range searchResults(title, year) {
+			s := scoreMatch(title, year, &t)
+			if m, ok := byKey[t.key()]; !ok || s > m.score {
+				byKey[t.key()] = match{tmdb: t, score: s}
+			}
+		}
+	}
+	var matches []match
+	for _, m := range byKey {
+		matches = append(matches, m)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+	return matches
+}
+
+func scoreMatch(title, year string, t *TmdbResult) float64 {
+	sim := math.Max(similarity(title, t.Title), similarity(title, t.OriginalTitle))
+	yearScore := 0.0
+	if y, e := strconv.Atoi(year); e == nil && !t.ReleaseDate.IsZero() {
+		switch diff := y - t.ReleaseDate.Year(); {
+		case diff == 0:
+			yearScore = 1
+		case diff == 1 || diff == -1:
+			yearScore = 0.5
+		}
+	}
+	pop := math.Min(1, math.Log10(1+t.Popularity)/2)
+	return 0.6*sim + 0.3*yearScore + 0.1*pop
+}
+
+// similarity is 1 for titles that are the same ignoring case, punctuation and a leading "the", down to 0
+func similarity(a, b string) float64 {
+	ra, rb := []rune(normTitle(a)), []rune(normTitle(b))
+	longest := math.Max(float64(len(ra)), float64(len(rb)))
+	if longest == 0 {
+		return 0
+	}
+	return 1 - float64(levenshtein(ra, rb))/longest
+}
+func normTitle(s string) string {
+	s = strings.ToLower(strings.ReplaceAll(s, "&", " and "))
+	s = strings.TrimSpace(reNotAlnum.ReplaceAllString(s, " "))
+	return strings.TrimPrefix(s, "the ")
+}
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// review list, one "path<tab>reason<tab>time" line per video
+
+func addReview(mkv, reason string) {
+	fmt.Printf("| added to review list: %s\n", reason)
+	lines := reviewLines()
+	var keep []string
+	for _, l := range lines {
+		if strings.SplitN(l, "\t", 2)[0] != mkv {
+			keep = append(keep, l)
+		}
+	}
+	keep = append(keep, strings.Join([]string{mkv, reason, time.Now().Format(time.RFC3339)}, "\t"))
+	writeReview(keep)
+}
+
+// readReview returns the videos on the review list that are still there
+func readReview() []string {
+	var mkvs []string
+	for _, l := range reviewLines() {
+		mkv := strings.SplitN(l, "\t", 2)[0]
+		if fileExists(mkv) {
+			mkvs = append(mkvs, mkv)
+		}
+	}
+	return mkvs
+}
+
+// pruneReview removes videos that were moved or renamed from the review list
+func pruneReview() {
+	var keep []string
+	for _, l := range reviewLines() {
+		if fileExists(strings.SplitN(l, "\t", 2)[0]) {
+			keep = append(keep, l)
+		}
+	}
+	writeReview(keep)
+}
+func reviewLines() []string {
+	b, e := os.ReadFile(reviewFile)
+	if e != nil {
+		return nil
+	}
+	var lines []string
+	for _, l := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(l) != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+func writeReview(lines []string) {
+	if len(lines) == 0 {
+		e := os.Remove(reviewFile)
+		if !os.IsNotExist(e) {
+			chk(e)
+		}
+		return
+	}
+	e := os.WriteFile(reviewFile, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	chk(e)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+	response cache
+		every tmdb and omdb response is kept in cacheFolder (cache_folder in m.conf, default the user cache
+		folder/m), named after the endpoint and the query, so searches are cached by title and year and details by
+		tmdb id:
+			search_movie/query=Heat&year=1995.json
+			movie_949/append_to_response=credits.json
+		entries older than cache_days (default 30) are fetched again. cache_days = 0 turns the cache off, and -refresh
+		fetches everything again and updates the cache.
+		artwork downloaded for nfo files is kept in cacheFolder/images.
+*/
+
+var (
+	cacheFolder string
+	cacheDays   = 30
+	refresh     bool
+)
+
+// cachePath returns the cache file for a request, "" with the cache off
+func cachePath(endpoint string, q url.Values) string {
+	if cacheDays <= 0 {
+		return ""
+	}
+	return responsePath(cacheFolder, endpoint, q)
+}
+
+// responsePath returns where a response is kept in the cache or fixtures folder, "" without a folder
+func responsePath(folder, endpoint string, q url.Values) string {
+	if folder == "" {
+		return ""
+	}
+	name := q.Encode()
+	if name == "" {
+		name = "_"
+	}
+	// Encode escapes / so the query is safe as a file name
+	if len(name) > 200 {
+		name = fmt.Sprintf("%x", sha1.Sum([]byte(name)))
+	}
+	return filepath.Join(folder, strings.ReplaceAll(endpoint, "/", "_"), name+".json")
+}
+
+// readCache returns a cached response that isn't too old
+func readCache(path string) ([]byte, bool) {
+	if path == "" || refresh {
+		return nil, false
+	}
+	st, e := os.Stat(path)
+	if e != nil || time.Since(st.ModTime()) > time.Duration(cacheDays)*24*time.Hour {
+		return nil, false
+	}
+	b, e := os.ReadFile(path)
+	return b, e == nil
+}
+func writeCache(path string, b []byte) {
+	if path == "" {
+		return
+	}
+	e := os.MkdirAll(filepath.Dir(path), 0755)
+	if e == nil {
+		e = os.WriteFile(path, b, 0644)
+	}
+	chk(e)
+}
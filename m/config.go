@@ -0,0 +1,169 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+	m.conf
+		optional config file, loaded from the path given with -conf, the M_CONF environment variable, or /etc/m.conf.
+		format is one "key = value" per line, lines starting with # are ignored. see m.conf.example.
+		the first folders, bad or rule line replaces the defaults for that key, later lines add to it.
+*/
+
+var (
+	possibleConfs = []string{
+		"/etc/m.conf",
+	}
+	confFile string
+)
+
+func loadConfig() {
+	if confFile == "" {
+		confFile = os.Getenv("M_CONF")
+	}
+	var conf string
+	if confFile != "" {
+		b, e := os.ReadFile(confFile)
+		if e != nil {
+			p("could not read conf file %s: %s", confFile, e)
+			os.Exit(1)
+		}
+		conf = string(b)
+	} else {
+		for _, c := range possibleConfs {
+			b, e := os.ReadFile(c)
+			if e == nil {
+				confFile = c
+				conf = string(b)
+				break
+			}
+		}
+	}
+	ruleLines := defaultRules
+	defer func() {
+		setRules(ruleLines)
+		if reviewFile == "" {
+			reviewFile = path.Join(procFolder, "m_review.txt")
+		}
+		if trashFolder == "" {
+			trashFolder = path.Join(procFolder, ".m_trash")
+		}
+		if journalFile == "" {
+			if d, e := os.UserConfigDir(); e == nil {
+				journalFile = filepath.Join(d, "m", "journal.jsonl")
+			}
+		}
+		if cacheFolder == "" {
+			if d, e := os.UserCacheDir(); e == nil {
+				cacheFolder = filepath.Join(d, "m")
+			}
+		}
+	}()
+	if conf == "" {
+		return
+	}
+	p("loading config from %s", confFile)
+
+	replaced := make(map[string]bool)
+	// the first line of a list key replaces the defaults
+	replace := func(k string) bool {
+		if replaced[k] {
+			return false
+		}
+		replaced[k] = true
+		return true
+	}
+	reEq := regexp.MustCompile(`\s*=\s*`)
+	for _, line := range strings.Split(conf, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") || !strings.Contains(line, "=") {
+			continue
+		}
+		kv := reEq.Split(line, 2)
+		k, v := strings.ToLower(kv[0]), kv[1]
+		switch k {
+		case "proc_folder":
+			procFolder = v
+		case "sorted_folder":
+			sortedFolder = v
+		case "tv_folder":
+			tvFolder = v
+		case "review_file":
+			reviewFile = v
+		case "journal_file":
+			journalFile = v
+		case "trash_folder":
+			trashFolder = v
+		case "ffprobe":
+			ffprobe = v
+		case "cache_folder":
+			cacheFolder = v
+		case "cache_days":
+			i, e := strconv.Atoi(v)
+			if e != nil {
+				p("cache_days in %s must be a number", confFile)
+				os.Exit(1)
+			}
+			cacheDays = i
+		case "providers":
+			providerOrder = nil
+			for _, pr := range strings.Fields(strings.ToLower(v)) {
+				if _, ok := providers[pr]; !ok {
+					p("unknown provider in %s: %s", confFile, pr)
+					os.Exit(1)
+				}
+				providerOrder = append(providerOrder, pr)
+			}
+		case "fixtures":
+			if fixtureFolder == "" {
+				fixtureFolder = v
+			}
+		case "nfo":
+			writeNfo = isTrue(v)
+		case "artwork":
+			writeArt = isTrue(v)
+		case "folders":
+			if replace(k) {
+				sortedFolders = nil
+			}
+			sortedFolders = append(sortedFolders, strings.Fields(v)...)
+		case "bad":
+			if replace(k) {
+				bad = nil
+			}
+			bad = append(bad, strings.Fields(strings.ToLower(v))...)
+		case "rule":
+			if replace(k) {
+				ruleLines = nil
+			}
+			ruleLines = append(ruleLines, v)
+		default:
+			p("unknown key in %s: %s", confFile, k)
+		}
+	}
+}
+
+func isTrue(v string) bool {
+	return regexp.MustCompile(`(?i)^(true|t|yes|y|1)$`).MatchString(v)
+}
+
+func setRules(lines []string) {
+	rules = nil
+	for _, l := range lines {
+		r, e := parseRule(l)
+		if e != nil {
+			p("invalid rule in %s: %s", confFile, e)
+			os.Exit(1)
+		}
+		if !isAny(r.folder, sortedFolders...) {
+			p("rule folder %s is not in folders", r.folder)
+		}
+		rules = append(rules, r)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+	duplicates
+		before a movie is moved into sorted_folder, the library is checked for the same movie. the library is indexed
+		once per run by title and year from the file names, and by tmdb id from nfo files next to the videos. a
+		movie.nfo is only used for a folder that holds a single video.
+		without -auto, both files are shown with resolution, codec and size from ffprobe, and the menu offers
+			r  replace: each library file is confirmed on its own, the confirmed ones go to the trash folder (see
+			   journal.go) and the new one is moved in
+			k  keep both: the new one is moved in, with " - 2" added to its name if the name is taken
+			s  skip: the new file is left in place (default)
+		with -auto, duplicates go on the review list.
+*/
+
+var (
+	library   map[string][]string // videos in sorted_folder by title and year
+	libraryId map[int][]string    // videos in sorted_folder by tmdb id
+	reNfoId   = regexp.MustCompile(`<uniqueid type="tmdb"[^>]*>(\d+)</uniqueid>`)
+)
+
+func libraryKey(title, year string) string {
+	return normTitle(title) + "|" + year
+}
+
+// indexLibrary reads the videos in sorted_folder and the tmdb ids in the nfo files next to them
+func indexLibrary() {
+	library = make(map[string][]string)
+	libraryId = make(map[int][]string)
+	ids := make(map[string]int) // nfo path without extension, or folder for movie.nfo, to tmdb id
+	var videos []string
+	_ = filepath.Walk(sortedFolder, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if isAny(ext, videoExts...) {
+			videos = append(videos, path)
+		} else if ext == ".nfo" {
+			if id := nfoTmdbId(path); id != 0 {
+				if filepath.Base(path) == "movie.nfo" {
+					ids[filepath.Dir(path)] = id
+				} else {
+					ids[strings.TrimSuffix(path, filepath.Ext(path))] = id
+				}
+			}
+		}
+		return nil
+	})
+	perDir := make(map[string]int)
+	for _, v := range videos {
+		perDir[filepath.Dir(v)]++
+	}
+	for _, v := range videos {
+		title, year := getNameYear(filepath.Base(v))
+		key := libraryKey(title, year)
+		library[key] = append(library[key], v)
+		id, ok := ids[strings.TrimSuffix(v, filepath.Ext(v))]
+		if !ok && perDir[filepath.Dir(v)] == 1 {
+			id = ids[filepath.Dir(v)]
+		}
+		if id != 0 {
+			libraryId[id] = append(libraryId[id], v)
+		}
+	}
+}
+
+func nfoTmdbId(path string) int {
+	b, e := os.ReadFile(path)
+	if e != nil {
+		return 0
+	}
+	m := reNfoId.FindSubmatch(b)
+	if m == nil {
+		return 0
+	}
+	id, _ := strconv.Atoi(string(m[1]))
+	return id
+}
+
+// findDuplicates returns the videos in the library that are the same movie as fName or the tmdb match
+func findDuplicates(fName string, tmdb *TmdbResult) []string {
+	if library == nil {
+		indexLibrary()
+	}
+	var dupes []string
+	title, year := getNameYear(fName)
+	add(&dupes, library[libraryKey(title, year)]...)
+	if tmdb != nil {
+		// without a release date the titles alone would match every video of that name
+		if y := tmdb.ReleaseDate.year(); y != "" {
+			add(&dupes, library[libraryKey(tmdb.OriginalTitle, y)]...)
+			add(&dupes, library[libraryKey(tmdb.Title, y)]...)
+		}
+		if tmdb.Id != 0 {
+			add(&dupes, libraryId[tmdb.Id]...)
+		}
+	}
+	return dupes
+}
+
+// addToLibrary adds a video that was moved into the library to the index
+func addToLibrary(video string, tmdb *TmdbResult) {
+	if library == nil {
+		return
+	}
+	title, year := getNameYear(filepath.Base(video))
+	key := libraryKey(title, year)
+	library[key] = append(library[key], video)
+	if tmdb != nil && tmdb.Id != 0 {
+		libraryId[tmdb.Id] = append(libraryId[tmdb.Id], video)
+	}
+}
+
+// describe returns resolution, codec and size of a video for the duplicate menu
+func describe(video string) string {
+	size := "size unknown"
+	if st, e := os.Stat(video); e == nil {
+		size = fmt.Sprintf("%.2f GB", float64(st.Size())/1e9)
+	}
+	vi, e := probeVideo(video)
+	if e != nil {
+		return size + ", ffprobe failed"
+	}
+	return fmt.Sprintf("%dx%d %s, %s", vi.width, vi.height, vi.codec, size)
+}
+
+// resolveDuplicates asks what to do when a movie is already in the library and returns where to move it, "" to
+// leave it in place
+func resolveDuplicates(video, dst string, dupes []string) string {
+	fmt.Println("already in library :")
+	fmt.Printf("| new: %s\n|      %s\n", video, describe(video))
+	for _, d := range dupes {
+		fmt.Printf("| old: %s\n|      %s\n", d, describe(d))
+	}
+	switch getChoice("[r]eplace old, [k]eep both, [s]kip or Enter to skip ", "r", "k", "s") {
+	case "r":
+		for _, d := range dupes {
+			if getChoice(fmt.Sprintf("| trash %s? [y]es, [n]o or Enter for no ", d), "y", "n") != "y" {
+				continue
+			}
+			fmt.Printf("| moving %s to trash %s\n", d, trashFolder)
+			e := trash(d)
+			if e != nil {
+				chk(e)
+				return ""
+			}
+		}
+		// an old file that was kept can still hold the name
+		return keepBothName(dst)
+	case "k":
+		return keepBothName(dst)
+	}
+	return ""
+}
+
+// keepBothName returns dst, or "name - 2.ext", "name - 3.ext" .. if dst is taken
+func keepBothName(dst string) string {
+	ext := filepath.Ext(dst)
+	stem := strings.TrimSuffix(dst, ext)
+	for i := 2; fileExists(dst); i++ {
+		dst = fmt.Sprintf("%s - %d%s", stem, i, ext)
+	}
+	return dst
+}
+
+// getChoice returns one of the choices typed at the prompt, "" for Enter
+func getChoice(prompt string, choices ...string) string {
+	r := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Print(prompt)
+		line, _ := r.ReadString('\n')
+		c := strings.ToLower(strings.TrimSpace(line))
+		if c == "" || isAny(c, choices...) {
+			return c
+		}
+		fmt.Printf("  choose one of %s\n", strings.Join(choices, ", "))
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+/*
+	journal and undo
+		every rename, move, folder delete and nfo or artwork file m makes is appended to journalFile (journal_file in
+		m.conf, default the user config folder/m/journal.jsonl), one json object per line with the time it happened.
+		folders and replaced movies are never deleted, they are moved to trashFolder (trash_folder in m.conf, default
+		proc_folder/.m_trash, which is skipped when looking for videos) so they can be put back.
+	m -undo [n]
+		reverses the last n operations that weren't undone yet, newest first, default 1. a rename, move and delete
+		are moved back, a created file is removed. undo stops at the first operation that can't be undone, older
+		operations can depend on it. each undo is appended to the journal too, so the journal only ever grows and
+		shows everything that happened.
+*/
+
+var (
+	journalFile string
+	trashFolder string
+)
+
+type Op struct {
+	Id   int64     `json:"id"`
+	Time time.Time `json:"time"`
+	Op   string    `json:"op"` // rename, move, delete, create or undo
+	Src  string    `json:"src,omitempty"`
+	Dst  string    `json:"dst,omitempty"`
+	Ref  int64     `json:"ref,omitempty"` // id of the operation an undo reversed
+}
+
+func journal(op, src, dst string, ref int64) {
+	if journalFile == "" {
+		return
+	}
+	now := time.Now()
+	b, e := json.Marshal(Op{Id: now.UnixNano(), Time: now, Op: op, Src: src, Dst: dst, Ref: ref})
+	if e != nil {
+		chk(e)
+		return
+	}
+	e = os.MkdirAll(filepath.Dir(journalFile), 0755)
+	if e != nil {
+		chk(e)
+		return
+	}
+	f, e := os.OpenFile(journalFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if e != nil {
+		chk(e)
+		return
+	}
+	defer f.Close()
+	_, e = f.Write(append(b, '\n'))
+	chk(e)
+}
+
+// rename renames a file in place and journals it
+func rename(src, dst string) error {
+	e := os.Rename(src, dst)
+	if e == nil {
+		journal("rename", src, dst, 0)
+	}
+	return e
+}
+
+// move moves a file to another folder and journals it
+func move(src, dst string) error {
+	e := mvFile(src, dst)
+	if e == nil {
+		journal("move", src, dst, 0)
+	}
+	return e
+}
+
+// created journals a file m wrote, so undo can remove it
+func created(path string) {
+	journal("create", "", path, 0)
+}
+
+// trash moves a file or folder to the trash folder instead of deleting it and journals it
+func trash(dir string) error {
+	dst := getAltPath(filepath.Join(trashFolder, time.Now().Format("20060102_150405")+"_"+filepath.Base(dir)))
+	e := moveFolder(dir, dst)
+	if e == nil {
+		journal("delete", dir, dst, 0)
+	}
+	return e
+}
+
+func moveFolder(src, dst string) error {
+	e := os.MkdirAll(filepath.Dir(dst), 0755)
+	if e != nil {
+		return e
+	}
+	e = os.Rename(src, dst)
+	if e != nil {
+		// other filesystem
+		if st, e := os.Stat(src); e == nil && !st.IsDir() {
+			return mvFile(src, dst)
+		}
+		mvTree(src, dst, true)
+		e = os.RemoveAll(src)
+	}
+	return e
+}
+
+func readJournal() ([]Op, error) {
+	f, e := os.Open(journalFile)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	var ops []Op
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var op Op
+		if json.Unmarshal(sc.Bytes(), &op) == nil {
+			ops = append(ops, op)
+		}
+	}
+	return ops, sc.Err()
+}
+
+// undo reverses the last n operations in the journal that weren't undone yet
+func undo(n int) {
+	ops, e := readJournal()
+	if e != nil {
+		fmt.Printf("could not read journal %s: %s\n", journalFile, e)
+		os.Exit(1)
+	}
+	undone := make(map[int64]bool)
+	for _, op := range ops {
+		if op.Op == "undo" {
+			undone[op.Ref] = true
+		}
+	}
+	done := 0
+	for i := len(ops) - 1; i >= 0 && done < n; i-- {
+		op := ops[i]
+		if op.Op == "undo" || undone[op.Id] {
+			continue
+		}
+		fmt.Printf("undo %s %s : %s -> %s\n", op.Time.Format("2006-01-02 15:04:05"), op.Op, op.Src, op.Dst)
+		var e error
+		switch op.Op {
+		case "create":
+			e = os.Remove(op.Dst)
+		case "delete":
+			if fileExists(op.Src) {
+				e = fmt.Errorf("%s exists", op.Src)
+			} else {
+				e = moveFolder(op.Dst, op.Src)
+			}
+		default:
+			if fileExists(op.Src) {
+				e = fmt.Errorf("%s exists", op.Src)
+			} else {
+				e = mvFile(op.Dst, op.Src)
+			}
+		}
+		// older operations can depend on this one, so undo stops here
+		if e != nil {
+			fmt.Printf("| could not undo: %s\n", e)
+			fmt.Printf("undid %d of %d operations, stopped at the one that could not be undone\n", done, n)
+			return
+		}
+		journal("undo", op.Dst, op.Src, op.Id)
+		done++
+	}
+	if done == 0 {
+		fmt.Println("nothing left to undo")
+	} else if done < n {
+		fmt.Printf("undid %d of %d operations, nothing older left to undo\n", done, n)
+	}
+}
+
+// undoCount returns the n given after -undo at os.Args[i], 1 if there is none
+func undoCount(i int) (int, bool) {
+	if i+1 < len(os.Args) {
+		if n, e := strconv.Atoi(os.Args[i+1]); e == nil && n > 0 {
+			return n, true
+		}
+	}
+	return 1, false
+}
@@ -2,11 +2,8 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
 	"fmt"
 	"github.com/jerblack/server_tools/base"
-	"io"
-	"net/http"
 	"os"
 	"path"
 	"path/filepath"
@@ -17,8 +14,13 @@ import (
 )
 
 /*
-	m
-	automatically parse and rename movie files
+	m [-auto][-review][-refresh][-undo [n]][-conf path][-fixtures folder [-record]][folder]
+	m -guess name ..
+	automatically parse and rename movie files, and tv episodes (see tv.go)
+	folders and the rules that guess them are set in m.conf (see config.go and rules.go)
+	movies are looked up on tmdb or omdb (see providers.go)
+	responses are cached (see cache.go), and moved movies can get an nfo and artwork (see nfo.go)
+	renames, moves and deletes are journaled and can be undone with -undo (see journal.go)
 	if no file specified, look in current folder
 		recursively gather all mkv files
 	for each video
@@ -52,12 +54,6 @@ var (
 		10751: "Family", 14: "Fantasy", 36: "History", 27: "Horror", 10402: "Music", 9648: "Mystery", 10749: "Romance",
 		878: "Science Fiction", 10770: "TV Movie", 53: "Thriller", 10752: "War", 37: "Western",
 	}
-	recommends = map[int]string{
-		28: "action_adventure_sci-fi", 12: "action_adventure_sci-fi", 16: "animated", 35: "comedy", 80: "drama",
-		99: "docs", 18: "drama", 10751: "hallmark_family", 14: "action_adventure_sci-fi", 36: "drama", 27: "horror",
-		10402: "hallmark_family", 9648: "drama", 10749: "drama", 878: "action_adventure_sci-fi", 10770: "drama",
-		53: "horror", 10752: "drama", 37: "drama",
-	}
 )
 
 type TmdbDate struct {
@@ -74,6 +70,14 @@ func (td *TmdbDate) UnmarshalJSON(b []byte) (e error) {
 	return
 }
 
+// year returns the year as text, "" if there is no release date
+func (td TmdbDate) year() string {
+	if td.IsZero() {
+		return ""
+	}
+	return strconv.Itoa(td.Year())
+}
+
 type TmdbResults struct {
 	Results []TmdbResult `json:"results"`
 }
@@ -84,10 +88,21 @@ type TmdbResult struct {
 	Id               int      `json:"id"`
 	OriginalLanguage string   `json:"original_language"`
 	OriginalTitle    string   `json:"original_title"`
+	Title            string   `json:"title"`
 	Overview         string   `json:"overview"`
 	Popularity       float64  `json:"popularity"`
 	PosterPath       string   `json:"poster_path"`
 	ReleaseDate      TmdbDate `json:"release_date"`
+	ImdbId           string   `json:"imdb_id,omitempty"` // only from omdb
+	Source           string   `json:"-"`                 // provider that found it
+}
+
+// key tells movies apart, by tmdb id or imdb id for movies from omdb
+func (t *TmdbResult) key() string {
+	if t.Id == 0 {
+		return t.ImdbId
+	}
+	return strconv.Itoa(t.Id)
 }
 
 func (t *TmdbResult) genres() []string {
@@ -99,42 +114,13 @@ func (t *TmdbResult) genres() []string {
 }
 
 func tmdbSearch(title, year string) (t *TmdbResult) {
-	uri := `https://api.themoviedb.org/3/search/movie`
-	req, e := http.NewRequest("GET", uri, nil)
-	if e != nil {
-		fmt.Println(e)
-		return
-	}
-	q := req.URL.Query()
-	q.Add("api_key", apiKey)
-	q.Add("query", title)
-	if year != "" {
-		q.Add("year", year)
-	}
-	req.URL.RawQuery = q.Encode()
-	var client http.Client
-	rsp, e := client.Do(req)
-	if e != nil {
-		fmt.Println(e)
-		return
-	}
-	defer rsp.Body.Close()
-	body, e := io.ReadAll(rsp.Body)
-	if e != nil {
-		fmt.Println(e)
-		return
-	}
-	var trs TmdbResults
-	e = json.Unmarshal(body, &trs)
-	if e != nil {
-		fmt.Println(e)
-		return
-	}
-	if len(trs.Results) > 0 {
-		t = &trs.Results[0]
+	results := searchResults(title, year)
+	if len(results) > 0 {
+		t = &results[0]
 	}
 	return
 }
+
 func getNameYear(fName string) (title, year string) {
 	reTitleYear := regexp.MustCompile(`(.+) \((\d{4})\)`)
 	if reTitleYear.MatchString(fName) {
@@ -157,7 +143,8 @@ func trimToYear(name string) string {
 		yr := strconv.Itoa(y)
 		i := strings.LastIndex(name, yr)
 		if i != -1 {
-			return fmt.Sprintf("%s(%s)", name[:i], yr)
+			// a year already in brackets keeps one bracket
+			return fmt.Sprintf("%s(%s)", strings.TrimRight(name[:i], "(["), yr)
 		}
 	}
 	return name
@@ -307,6 +294,10 @@ func getMkvs(workDir string) []string {
 		if err != nil {
 			return err
 		}
+		// trashed videos aren't new work
+		if info.IsDir() && trashFolder != "" && path.Clean(p) == path.Clean(trashFolder) {
+			return filepath.SkipDir
+		}
 		if !info.IsDir() && isMkv(p) {
 			mkvs = append(mkvs, p)
 		}
@@ -351,22 +342,90 @@ func main() {
 			text: ## files remaining in folder, fname1 fname2 ...
 			text: delete source folder [Yn]
 				if yes, change cwd to .. and delete source folder
+
+		-auto sorts without prompts and -review works through what -auto left, see auto.go
 	*/
 
 	apiKey = os.Getenv("TMDB_KEY")
-	if apiKey == "" {
-		fmt.Println("no api key found in TMDB_KEY env var")
-	}
-	args := os.Args[1:]
+	omdbKey = os.Getenv("OMDB_KEY")
+	auto, review, guess := false, false, false
+	undoN := 0
 	workDir := ""
-	if len(args) > 0 {
-		workDir = args[0]
-	} else {
+	var names []string
+	for i := 1; i < len(os.Args); i++ {
+		arg := os.Args[i]
+		switch strings.ToLower(arg) {
+		case "-auto":
+			auto = true
+		case "-guess":
+			guess = true
+		case "-record":
+			record = true
+		case "-fixtures":
+			if i+1 >= len(os.Args) {
+				fmt.Println("must specify folder with -fixtures.")
+				os.Exit(1)
+			}
+			fixtureFolder = os.Args[i+1]
+			i++
+		case "-review":
+			review = true
+		case "-refresh":
+			refresh = true
+		case "-undo":
+			var skip bool
+			undoN, skip = undoCount(i)
+			if skip {
+				i++
+			}
+		case "-conf":
+			if i+1 >= len(os.Args) {
+				fmt.Println("must specify path with -conf.")
+				os.Exit(1)
+			}
+			confFile = os.Args[i+1]
+			i++
+		default:
+			workDir = arg
+			names = append(names, arg)
+		}
+	}
+	loadConfig()
+	if record && fixtureFolder == "" {
+		fmt.Println("-record needs -fixtures or fixtures in m.conf")
+		os.Exit(1)
+	}
+	if len(readyProviders()) == 0 {
+		fmt.Println("no metadata provider, set TMDB_KEY or OMDB_KEY")
+	}
+	if tv := os.Getenv("TV_ROOT"); tv != "" {
+		tvFolder = tv
+	}
+	if undoN > 0 {
+		undo(undoN)
+		return
+	}
+	if guess {
+		printGuesses(names)
+		return
+	}
+	if workDir == "" {
 		workDir, _ = os.Getwd()
 	}
 	workDir, _ = filepath.Abs(workDir)
-	fmt.Printf("path : %s\n", workDir)
-	mkvs := getMkvs(workDir)
+	if auto && len(readyProviders()) == 0 {
+		fmt.Println("-auto needs a metadata provider")
+		os.Exit(1)
+	}
+
+	var mkvs []string
+	if review {
+		mkvs = readReview()
+		fmt.Printf("review list : %s\n", reviewFile)
+	} else {
+		fmt.Printf("path : %s\n", workDir)
+		mkvs = getMkvs(workDir)
+	}
 	if len(mkvs) == 0 {
 		fmt.Printf("| no videos found in folder\n")
 		return
@@ -374,130 +433,136 @@ func main() {
 		fmt.Printf("| found %d mkvs in folder\n", len(mkvs))
 	}
 	for _, mkv := range mkvs {
-		searchName := mkv
-		fmt.Printf("video :\n| %s\n", mkv)
-		fmt.Println("name options :")
-		file := cleanFileName(mkv)
-		folder := cleanFolderName(mkv)
-		var names []string
-		add(&names, getNameOptions(mkv, file)...)
-		add(&names, getNameOptions(mkv, folder)...)
-		for i, name := range names {
-			fmt.Printf("  %d) %s\n", i, name)
+		ep, isEpisode := parseEpisode(mkv)
+		switch {
+		case isEpisode && auto:
+			sortEpisodeAuto(mkv, ep)
+		case isEpisode:
+			sortEpisode(mkv, ep, workDir)
+		case auto:
+			sortAuto(mkv)
+		default:
+			sortInteractive(mkv, workDir)
 		}
-		nameIndex := getInt("select name [# or Enter to skip] ", len(names))
-		if nameIndex >= 0 && nameIndex < len(names)+1 {
-			selected := names[nameIndex]
-			if nameIndex > 0 {
-				fmt.Printf("| renamed: %s -> %s\n", mkv, selected)
-				err := os.Rename(mkv, selected)
-				chkFatal(err)
-				searchName = selected
-			} else {
-				fmt.Println("| original name kept")
-				if len(names) > 0 {
-					searchName = names[0]
-				}
-			}
+	}
+	if review {
+		pruneReview()
+	}
+}
 
+func sortInteractive(mkv, workDir string) {
+	searchName := mkv
+	fmt.Printf("video :\n| %s\n", mkv)
+	fmt.Println("name options :")
+	names := nameCandidates(mkv)
+	for i, name := range names {
+		fmt.Printf("  %d) %s\n", i, name)
+	}
+	nameIndex := getInt("select name [# or Enter to skip] ", len(names))
+	if nameIndex >= 0 && nameIndex < len(names)+1 {
+		selected := names[nameIndex]
+		if nameIndex > 0 {
+			fmt.Printf("| renamed: %s -> %s\n", mkv, selected)
+			err := rename(mkv, selected)
+			chkFatal(err)
+			searchName = selected
 		} else {
-			fmt.Println("| file name unchanged.")
+			fmt.Println("| original name kept")
+			if len(names) > 0 {
+				searchName = names[0]
+			}
 		}
 
-		fName := filepath.Base(searchName)
-		title, year := getNameYear(fName)
-		tmdb := tmdbSearch(title, year)
-		guess := ""
-		if tmdb != nil {
-			fmt.Printf("tmdb info :\n")
-			fmt.Printf("| title: %s (%d)\n", tmdb.OriginalTitle, tmdb.ReleaseDate.Year())
-			fmt.Printf("| genres: %s\n", strings.Join(tmdb.genres(), ", "))
-			fmt.Printf("| overview: %s\n", tmdb.Overview)
-			if len(tmdb.GenreIds) > 0 {
-				guess = recommends[tmdb.GenreIds[0]]
-			}
-			if tmdb.ReleaseDate.Year() < 1980 {
-				guess = "before_1980"
-			} else if tmdb.ReleaseDate.Year() < 2000 {
-				guess = "before_2000"
-			}
+	} else {
+		fmt.Println("| file name unchanged.")
+	}
 
-			if title != tmdb.OriginalTitle {
-				fmt.Printf("tmdb title different from current title :\n")
-				tmdbFname := fmt.Sprintf("%s (%d).mkv", tmdb.OriginalTitle, tmdb.ReleaseDate.Year())
-				tmdbFname = getLegalFilename(tmdbFname)
-				prompt := fmt.Sprintf("| rename %s -> %s ? [1,0,y,N or Enter to skip] ", fName, tmdbFname)
-				if getYesNo(prompt) {
-					newPath := filepath.Join(filepath.Dir(searchName), tmdbFname)
-					e := os.Rename(searchName, newPath)
-					chkFatal(e)
-					searchName = newPath
-					fName = tmdbFname
-					fmt.Printf("| renamed to %s\n", searchName)
-				} else {
-					fmt.Println("| file name unchanged.")
-				}
-			}
-		}
-		if guess == "" && year != "" {
-			yearInt, e := strconv.Atoi(year)
-			if e == nil {
-				if yearInt < 1980 {
-					guess = "before_1980"
-				} else if yearInt < 2000 {
-					guess = "before_2000"
-				}
-			}
-		}
-		if strings.Contains(mkv, "2160") || strings.Contains(strings.ToLower(mkv), "4k") {
-			if tmdb != nil && isAny("Documentary", tmdb.genres()...) {
-				guess = "4K_docs"
+	fName := filepath.Base(searchName)
+	title, year := getNameYear(fName)
+	tmdb := tmdbSearch(title, year)
+	if tmdb != nil {
+		fmt.Printf("%s info :\n", tmdb.Source)
+		fmt.Printf("| title: %s (%d)\n", tmdb.OriginalTitle, tmdb.ReleaseDate.Year())
+		fmt.Printf("| genres: %s\n", strings.Join(tmdb.genres(), ", "))
+		fmt.Printf("| overview: %s\n", tmdb.Overview)
+
+		if title != tmdb.OriginalTitle {
+			fmt.Printf("tmdb title different from current title :\n")
+			tmdbFname := tmdbFileName(tmdb)
+			prompt := fmt.Sprintf("| rename %s -> %s ? [1,0,y,N or Enter to skip] ", fName, tmdbFname)
+			if getYesNo(prompt) {
+				newPath := filepath.Join(filepath.Dir(searchName), tmdbFname)
+				e := rename(searchName, newPath)
+				chkFatal(e)
+				searchName = newPath
+				fName = tmdbFname
+				fmt.Printf("| renamed to %s\n", searchName)
 			} else {
-				guess = "4K"
+				fmt.Println("| file name unchanged.")
 			}
 		}
+	}
+	guess, rule := guessFolder(searchName, mkv, year, tmdb)
 
-		fmt.Println("folder options :")
-		if guess != "" {
-			fmt.Printf("  00) %s [guessed]\n", guess)
-		}
-		printSortedFolders()
-
-		prompt := fmt.Sprintf("Move %s to /z/~movies/ subfolder? [# or Enter to skip] ", fName)
-		moveTo := getInt(prompt, len(sortedFolders))
-		var dst string
-		if moveTo == 0 && guess != "" {
-			dst = path.Join(sortedFolder, guess, fName)
-		} else if moveTo > 0 && moveTo < len(sortedFolders) {
-			dst = path.Join(sortedFolder, sortedFolders[moveTo-1], fName)
+	fmt.Println("folder options :")
+	if guess != "" {
+		fmt.Printf("  00) %s [guessed: %s]\n", guess, rule)
+	}
+	printSortedFolders()
+
+	prompt := fmt.Sprintf("Move %s to %s/ subfolder? [# or Enter to skip] ", fName, sortedFolder)
+	moveTo := getInt(prompt, len(sortedFolders))
+	var dst string
+	if moveTo == 0 && guess != "" {
+		dst = path.Join(sortedFolder, guess, fName)
+	} else if moveTo > 0 && moveTo < len(sortedFolders) {
+		dst = path.Join(sortedFolder, sortedFolders[moveTo-1], fName)
+	}
+	if dst != "" {
+		if dupes := findDuplicates(fName, tmdb); len(dupes) > 0 {
+			dst = resolveDuplicates(searchName, dst, dupes)
 		}
-		if dst != "" {
-			fmt.Printf("| Moving -> %s\n", dst)
-			e := mvFile(searchName, dst)
-			chkFatal(e)
-			mkvDir := filepath.Dir(mkv)
-			if mkvDir != procFolder && mkvDir != workDir {
-				files := getFiles(mkvDir)
-				if len(files) > 0 {
-					fmt.Printf("| %d files remaining in movie folder %s\n", len(files), mkvDir)
-					for _, f := range files {
-						fmt.Printf("| > %s\n", f)
-					}
-				}
-				if getYesNo(fmt.Sprintf("delete folder %s ? [1,0,y,N or Enter to skip] ", mkvDir)) {
-					fmt.Println("| deleting folder")
-					e := os.RemoveAll(mkvDir)
-					chkFatal(e)
-				} else {
-					fmt.Println("| leaving folder in place")
+	}
+	if dst != "" {
+		fmt.Printf("| Moving -> %s\n", dst)
+		e := move(searchName, dst)
+		chkFatal(e)
+		addToLibrary(dst, tmdb)
+		writeExtras(dst, tmdb)
+		mkvDir := filepath.Dir(mkv)
+		if mkvDir != procFolder && mkvDir != workDir {
+			files := getFiles(mkvDir)
+			if len(files) > 0 {
+				fmt.Printf("| %d files remaining in movie folder %s\n", len(files), mkvDir)
+				for _, f := range files {
+					fmt.Printf("| > %s\n", f)
 				}
 			}
-		} else {
-			fmt.Println("| leaving file in place")
+			if getYesNo(fmt.Sprintf("delete folder %s ? [1,0,y,N or Enter to skip] ", mkvDir)) {
+				fmt.Printf("| moving folder to trash %s\n", trashFolder)
+				e := trash(mkvDir)
+				chkFatal(e)
+			} else {
+				fmt.Println("| leaving folder in place")
+			}
 		}
+	} else {
+		fmt.Println("| leaving file in place")
 	}
 }
 
+// nameCandidates returns the current name of a video followed by the names guessed from the file and folder
+func nameCandidates(mkv string) []string {
+	var names []string
+	add(&names, getNameOptions(mkv, cleanFileName(mkv))...)
+	add(&names, getNameOptions(mkv, cleanFolderName(mkv))...)
+	return names
+}
+
+func tmdbFileName(tmdb *TmdbResult) string {
+	return getLegalFilename(fmt.Sprintf("%s (%d).mkv", tmdb.OriginalTitle, tmdb.ReleaseDate.Year()))
+}
+
 func add(arr *[]string, items ...string) {
 	for _, item := range items {
 		if !isAny(item, *arr...) {
@@ -515,6 +580,8 @@ var (
 	rmEmptyFolders   = base.RmEmptyFolders
 	printCmd         = base.PrintCmd
 	mvFile           = base.MvFile
+	mvTree           = base.MvTree
+	getAltPath       = base.GetAltPath
 	fileExists       = base.FileExists
 	isAny            = base.IsAny
 	getLegalFilename = base.GetLegalFilename
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTrimToYear(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"Heat.1995.1080p.BluRay.x264", "Heat.(1995)"},
+		{"Heat (1995) Remastered", "Heat (1995)"},
+		{"Heat [1995] 1080p", "Heat (1995)"},
+		{"Dune.2021.2160p.WEB-DL", "Dune.(2021)"},
+		{"No Year Here", "No Year Here"},
+	}
+	for _, tt := range tests {
+		if got := trimToYear(tt.name); got != tt.want {
+			t.Errorf("trimToYear(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTrimNoise(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"Heat 1080p BluRay x264", "Heat "},
+		{"Movie.WEB-DL.DDP5.1.H.264", "Movie."},
+		{"Some Show AMZN 720p", "Some Show "},
+		{"Clean Title", "Clean Title"},
+	}
+	for _, tt := range tests {
+		if got := trimNoise(tt.name); got != tt.want {
+			t.Errorf("trimNoise(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTitleCase(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"the lord of the rings", "The Lord of the Rings"},
+		{"ROCKY iv", "Rocky IV"},
+		{"alien vs predator", "Alien vs Predator"},
+		{"a man and a woman", "A Man and a Woman"},
+		{"heat (1995)", "Heat (1995)"},
+	}
+	for _, tt := range tests {
+		if got := titleCase(tt.name); got != tt.want {
+			t.Errorf("titleCase(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCleanFileName(t *testing.T) {
+	tests := []struct{ path, file, folder string }{
+		{"/x/_proc/Heat.1995.1080p.BluRay.x264-GRP/Heat.1995.1080p.BluRay.x264-GRP.mkv", "Heat (1995)", "Heat (1995)"},
+		{"/x/_proc/The_Lord_of_the_Rings_2001_720p/the.lord.of.the.rings.2001.720p.mkv",
+			"The Lord of the Rings (2001)", "The Lord of the Rings (2001)"},
+		{"/x/_proc/Heat (1995) Remastered/Heat (1995) Remastered.mkv", "Heat (1995)", "Heat (1995)"},
+	}
+	for _, tt := range tests {
+		if got := cleanFileName(tt.path); got != tt.file {
+			t.Errorf("cleanFileName(%q) = %q, want %q", tt.path, got, tt.file)
+		}
+		if got := cleanFolderName(tt.path); got != tt.folder {
+			t.Errorf("cleanFolderName(%q) = %q, want %q", tt.path, got, tt.folder)
+		}
+	}
+}
+
+func TestGetNameOptions(t *testing.T) {
+	procFolder = "/x/_proc"
+	tests := []struct {
+		path, clean string
+		want        []string
+	}{
+		{"/x/_proc/Heat.1995.1080p/heat.mkv", "Heat (1995)", []string{
+			"/x/_proc/Heat.1995.1080p/heat.mkv",
+			"/x/_proc/Heat.1995.1080p/Heat (1995).mkv",
+			"/x/_proc/Heat.1995.1080p/Heat.1995.1080p.mkv",
+			"/x/_proc/Heat (1995).mkv",
+			"/x/_proc/Heat.1995.1080p.mkv",
+		}},
+		{"/x/_proc/Heat.1995.1080p.mkv", "Heat (1995)", []string{
+			"/x/_proc/Heat.1995.1080p.mkv",
+			"/x/_proc/Heat (1995).mkv",
+		}},
+	}
+	for _, tt := range tests {
+		if got := getNameOptions(tt.path, tt.clean); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("getNameOptions(%q, %q) = %q, want %q", tt.path, tt.clean, got, tt.want)
+		}
+	}
+}
+
+func TestTmdbDateYear(t *testing.T) {
+	var td TmdbDate
+	for _, tt := range []struct{ json, want string }{{`"1995-12-15"`, "1995"}, {`null`, ""}, {`""`, ""}} {
+		_ = td.UnmarshalJSON([]byte(tt.json))
+		if got := td.year(); got != tt.want {
+			t.Errorf("year of %s = %q, want %q", tt.json, got, tt.want)
+		}
+	}
+}
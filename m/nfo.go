@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+	nfo and artwork
+		with nfo = true in m.conf, a kodi/jellyfin nfo with the tmdb details is written next to a movie when it is
+		moved. with artwork = true, the tmdb poster and fanart are saved next to it too.
+		movies share a folder per genre, so the files are named after the movie: name.nfo, name-poster.jpg,
+		name-fanart.jpg. movie.nfo, poster.jpg and fanart.jpg would apply to every movie in the folder.
+*/
+
+var (
+	writeNfo   bool
+	writeArt   bool
+	imageUri   = "https://image.tmdb.org/t/p/original"
+	videoExts  = []string{".mkv", ".mp4", ".avi", ".m4v", ".ts"}
+	maxActors  = 20
+	writerJobs = []string{"Screenplay", "Writer", "Story", "Novel"}
+)
+
+type TmdbMovie struct {
+	Id            int      `json:"id"`
+	ImdbId        string   `json:"imdb_id"`
+	Title         string   `json:"title"`
+	OriginalTitle string   `json:"original_title"`
+	Overview      string   `json:"overview"`
+	Tagline       string   `json:"tagline"`
+	Runtime       int      `json:"runtime"`
+	ReleaseDate   TmdbDate `json:"release_date"`
+	VoteAverage   float64  `json:"vote_average"`
+	VoteCount     int      `json:"vote_count"`
+	PosterPath    string   `json:"poster_path"`
+	BackdropPath  string   `json:"backdrop_path"`
+	Genres        []struct {
+		Name string `json:"name"`
+	} `json:"genres"`
+	ProductionCompanies []struct {
+		Name string `json:"name"`
+	} `json:"production_companies"`
+	Credits struct {
+		Cast []struct {
+			Name        string `json:"name"`
+			Character   string `json:"character"`
+			Order       int    `json:"order"`
+			ProfilePath string `json:"profile_path"`
+		} `json:"cast"`
+		Crew []struct {
+			Name string `json:"name"`
+			Job  string `json:"job"`
+		} `json:"crew"`
+	} `json:"credits"`
+}
+
+type nfoMovie struct {
+	XMLName       xml.Name    `xml:"movie"`
+	Title         string      `xml:"title"`
+	OriginalTitle string      `xml:"originaltitle"`
+	Year          int         `xml:"year,omitempty"`
+	Premiered     string      `xml:"premiered,omitempty"`
+	Plot          string      `xml:"plot,omitempty"`
+	Tagline       string      `xml:"tagline,omitempty"`
+	Runtime       int         `xml:"runtime,omitempty"`
+	Ratings       []nfoRating `xml:"ratings>rating"`
+	UniqueIds     []nfoId     `xml:"uniqueid"`
+	Genres        []string    `xml:"genre"`
+	Studios       []string    `xml:"studio"`
+	Directors     []string    `xml:"director"`
+	Writers       []string    `xml:"credits"`
+	Actors        []nfoActor  `xml:"actor"`
+}
+type nfoRating struct {
+	Name    string  `xml:"name,attr"`
+	Max     int     `xml:"max,attr"`
+	Default bool    `xml:"default,attr"`
+	Value   float64 `xml:"value"`
+	Votes   int     `xml:"votes"`
+}
+type nfoId struct {
+	Type    string `xml:"type,attr"`
+	Default bool   `xml:"default,attr,omitempty"`
+	Id      string `xml:",chardata"`
+}
+type nfoActor struct {
+	Name  string `xml:"name"`
+	Role  string `xml:"role,omitempty"`
+	Order int    `xml:"order"`
+	Thumb string `xml:"thumb,omitempty"`
+}
+
+func tmdbMovie(id int) (*TmdbMovie, error) {
+	var m TmdbMovie
+	q := url.Values{}
+	q.Add("append_to_response", "credits")
+	e := tmdbGet(fmt.Sprintf("movie/%d", id), q, &m)
+	if e != nil {
+		return nil, e
+	}
+	return &m, nil
+}
+
+// writeExtras writes the nfo and artwork for a movie that was moved to video, as set in m.conf
+func writeExtras(video string, t *TmdbResult) {
+	if t == nil || t.Id == 0 || (!writeNfo && !writeArt) {
+		return
+	}
+	m, e := tmdbMovie(t.Id)
+	if e != nil {
+		fmt.Printf("| could not get tmdb details for nfo: %s\n", e)
+		return
+	}
+	nfo, poster, fanart := extrasPaths(video)
+	if writeNfo {
+		fmt.Printf("| writing %s\n", nfo)
+		existed := fileExists(nfo)
+		e := os.WriteFile(nfo, movieNfo(m), 0644)
+		chk(e)
+		if e == nil && !existed {
+			created(nfo)
+		}
+	}
+	if writeArt {
+		for _, img := range []struct{ tmdbPath, dst string }{{m.PosterPath, poster}, {m.BackdropPath, fanart}} {
+			if img.tmdbPath == "" {
+				continue
+			}
+			fmt.Printf("| writing %s\n", img.dst)
+			existed := fileExists(img.dst)
+			e := fetchImage(img.tmdbPath, img.dst)
+			chk(e)
+			if e == nil && !existed {
+				created(img.dst)
+			}
+		}
+	}
+}
+
+// extrasPaths returns where the nfo, poster and fanart of a movie go
+func extrasPaths(video string) (nfo, poster, fanart string) {
+	stem := strings.TrimSuffix(video, filepath.Ext(video))
+	return stem + ".nfo", stem + "-poster.jpg", stem + "-fanart.jpg"
+}
+
+func movieNfo(m *TmdbMovie) []byte {
+	n := nfoMovie{
+		Title:         m.Title,
+		OriginalTitle: m.OriginalTitle,
+		Plot:          m.Overview,
+		Tagline:       m.Tagline,
+		Runtime:       m.Runtime,
+		UniqueIds:     []nfoId{{Type: "tmdb", Default: true, Id: strconv.Itoa(m.Id)}},
+	}
+	if !m.ReleaseDate.IsZero() {
+		n.Year = m.ReleaseDate.Year()
+		n.Premiered = m.ReleaseDate.Format("2006-01-02")
+	}
+	if m.ImdbId != "" {
+		n.UniqueIds = append(n.UniqueIds, nfoId{Type: "imdb", Id: m.ImdbId})
+	}
+	if m.VoteCount > 0 {
+		n.Ratings = []nfoRating{{Name: "themoviedb", Max: 10, Default: true, Value: m.VoteAverage, Votes: m.VoteCount}}
+	}
+	for _, g := range m.Genres {
+		n.Genres = append(n.Genres, g.Name)
+	}
+	for _, c := range m.ProductionCompanies {
+		n.Studios = append(n.Studios, c.Name)
+	}
+	for _, c := range m.Credits.Crew {
+		if c.Job == "Director" {
+			n.Directors = append(n.Directors, c.Name)
+		} else if isAny(c.Job, writerJobs...) && !isAny(c.Name, n.Writers...) {
+			n.Writers = append(n.Writers, c.Name)
+		}
+	}
+	for i, c := range m.Credits.Cast {
+		if i == maxActors {
+			break
+		}
+		a := nfoActor{Name: c.Name, Role: c.Character, Order: c.Order}
+		if c.ProfilePath != "" {
+			a.Thumb = imageUri + c.ProfilePath
+		}
+		n.Actors = append(n.Actors, a)
+	}
+	b, e := xml.MarshalIndent(n, "", "  ")
+	chk(e)
+	return append([]byte(xml.Header), append(b, '\n')...)
+}
+
+// fetchImage saves a tmdb image to dst, from the cache when it was downloaded before
+func fetchImage(tmdbPath, dst string) error {
+	var cached string
+	if cacheFolder != "" && cacheDays > 0 {
+		cached = filepath.Join(cacheFolder, "images", filepath.Base(tmdbPath))
+		if b, e := os.ReadFile(cached); e == nil && !refresh {
+			return os.WriteFile(dst, b, 0644)
+		}
+	}
+	rsp, e := http.Get(imageUri + tmdbPath)
+	if e != nil {
+		return e
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("tmdb image %s: %s", tmdbPath, rsp.Status)
+	}
+	b, e := io.ReadAll(rsp.Body)
+	if e != nil {
+		return e
+	}
+	if cached != "" {
+		writeCache(cached, b)
+	}
+	return os.WriteFile(dst, b, 0644)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	metadata providers
+		movie searches go to the providers in order (providers in m.conf, default "tmdb omdb") and the first one that
+		finds something answers. a provider without its key is skipped.
+			tmdb  api.themoviedb.org, key in the TMDB_KEY environment variable
+			omdb  www.omdbapi.com, key in the OMDB_KEY environment variable. omdb has no tmdb ids, so movies found
+			      there get no nfo, artwork or keyword rules and are checked against the library by title and year
+			      only. omdb genres and languages are mapped to the tmdb ones for the folder rules.
+		tv episodes, nfo details and keywords always come from tmdb.
+	fixtures
+		with -fixtures folder, or fixtures in m.conf, every response is read from folder instead of the network and a
+		missing one is an error, so runs repeat exactly and work offline. the folder is laid out like the cache (see
+		cache.go), with omdb responses under omdb/. with -record, responses are fetched as usual and saved to the
+		fixtures folder. the tests read their responses from testdata the same way.
+	m -guess name ..
+		prints the name cleanup, the search results and the guessed folder for each name and moves nothing. names
+		can be paths to videos or just file names. with -fixtures this runs offline.
+*/
+
+var (
+	providerOrder = []string{"tmdb", "omdb"}
+	providers     = map[string]Provider{"tmdb": tmdbProvider{}, "omdb": omdbProvider{}}
+	omdbKey       string
+	fixtureFolder string
+	record        bool
+	omdbDetails   = 5 // omdb results looked up for genres and release date
+	omdbGenres    = map[string]string{"Sci-Fi": "Science Fiction"}
+	omdbLanguages = map[string]string{
+		"English": "en", "French": "fr", "German": "de", "Spanish": "es", "Italian": "it", "Japanese": "ja",
+		"Korean": "ko", "Mandarin": "zh", "Cantonese": "cn", "Hindi": "hi", "Russian": "ru", "Swedish": "sv",
+		"Danish": "da", "Norwegian": "no", "Finnish": "fi", "Dutch": "nl", "Portuguese": "pt", "Polish": "pl",
+		"Turkish": "tr", "Thai": "th", "Indonesian": "id",
+	}
+)
+
+type Provider interface {
+	Ready() bool
+	Search(title, year string) ([]TmdbResult, error)
+}
+
+// searchResults returns the matches for a title from the first provider that has any, best first
+func searchResults(title, year string) []TmdbResult {
+	for _, name := range providerOrder {
+		pr := providers[name]
+		if !pr.Ready() && fixtureFolder == "" {
+			continue
+		}
+		results, e := pr.Search(title, year)
+		if e != nil {
+			fmt.Println(e)
+			continue
+		}
+		if len(results) > 0 {
+			for i := range results {
+				results[i].Source = name
+			}
+			return results
+		}
+	}
+	return nil
+}
+
+// readyProviders returns the providers that can be searched
+func readyProviders() []string {
+	var ready []string
+	for _, name := range providerOrder {
+		if providers[name].Ready() || fixtureFolder != "" {
+			ready = append(ready, name)
+		}
+	}
+	return ready
+}
+
+type tmdbProvider struct{}
+
+func (tmdbProvider) Ready() bool {
+	return apiKey != ""
+}
+func (tmdbProvider) Search(title, year string) ([]TmdbResult, error) {
+	q := url.Values{}
+	q.Add("query", title)
+	if year != "" {
+		q.Add("year", year)
+	}
+	var trs TmdbResults
+	e := tmdbGet("search/movie", q, &trs)
+	return trs.Results, e
+}
+
+type omdbProvider struct{}
+
+type omdbSearch struct {
+	Search []struct {
+		Title  string `json:"Title"`
+		Year   string `json:"Year"`
+		ImdbId string `json:"imdbID"`
+	} `json:"Search"`
+	Response string `json:"Response"`
+	Error    string `json:"Error"`
+}
+type omdbMovie struct {
+	Title     string `json:"Title"`
+	Year      string `json:"Year"`
+	Released  string `json:"Released"`
+	Genre     string `json:"Genre"`
+	Language  string `json:"Language"`
+	Plot      string `json:"Plot"`
+	ImdbId    string `json:"imdbID"`
+	ImdbVotes string `json:"imdbVotes"`
+	Response  string `json:"Response"`
+	Error     string `json:"Error"`
+}
+
+func (omdbProvider) Ready() bool {
+	return omdbKey != ""
+}
+func (omdbProvider) Search(title, year string) ([]TmdbResult, error) {
+	q := url.Values{}
+	q.Add("s", title)
+	q.Add("type", "movie")
+	if year != "" {
+		q.Add("y", year)
+	}
+	var s omdbSearch
+	e := omdbGet(q, &s)
+	if e != nil {
+		return nil, e
+	}
+	if s.Response != "True" {
+		if s.Error == "Movie not found!" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("omdb search %s: %s", title, s.Error)
+	}
+	var results []TmdbResult
+	for i, r := range s.Search {
+		t := TmdbResult{Title: r.Title, OriginalTitle: r.Title, ImdbId: r.ImdbId}
+		if y, e := strconv.Atoi(r.Year); e == nil {
+			t.ReleaseDate.Time = time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC)
+		}
+		if i < omdbDetails {
+			omdbDetail(&t)
+		}
+		results = append(results, t)
+	}
+	return results, nil
+}
+
+// omdbDetail fills in genres, language, release date, plot and popularity from the omdb details of a movie
+func omdbDetail(t *TmdbResult) {
+	q := url.Values{}
+	q.Add("i", t.ImdbId)
+	var m omdbMovie
+	e := omdbGet(q, &m)
+	if e != nil || m.Response != "True" {
+		return
+	}
+	if d, e := time.Parse("02 Jan 2006", m.Released); e == nil {
+		t.ReleaseDate.Time = d
+	}
+	for _, g := range strings.Split(m.Genre, ", ") {
+		if tg, ok := omdbGenres[g]; ok {
+			g = tg
+		}
+		for id, name := range genres {
+			if name == g {
+				t.GenreIds = append(t.GenreIds, id)
+			}
+		}
+	}
+	lang, _, _ := strings.Cut(m.Language, ", ")
+	t.OriginalLanguage = omdbLanguages[lang]
+	t.Overview = m.Plot
+	// imdb votes stand in for tmdb popularity, 100 at 500,000 votes
+	votes, _ := strconv.Atoi(strings.ReplaceAll(m.ImdbVotes, ",", ""))
+	t.Popularity = float64(votes) / 5000
+}
+
+// tmdbGet calls a tmdb api endpoint and decodes the json into v
+func tmdbGet(endpoint string, q url.Values, v interface{}) error {
+	return fetch("tmdb", endpoint, `https://api.themoviedb.org/3/`+endpoint, q, "api_key", apiKey, v)
+}
+
+// omdbGet calls the omdb api and decodes the json into v
+func omdbGet(q url.Values, v interface{}) error {
+	return fetch("omdb", "omdb", `https://www.omdbapi.com/`, q, "apikey", omdbKey, v)
+}
+
+// fetch gets uri with query q from the fixtures, the cache or the network and decodes the json into v. endpoint
+// names the response in the cache and fixtures folders.
+func fetch(provider, endpoint, uri string, q url.Values, keyName, key string, v interface{}) error {
+	fixture := responsePath(fixtureFolder, endpoint, q)
+	if fixtureFolder != "" && !record {
+		body, e := os.ReadFile(fixture)
+		if e != nil {
+			return fmt.Errorf("no %s fixture %s", provider, fixture)
+		}
+		return json.Unmarshal(body, v)
+	}
+	cache := cachePath(endpoint, q)
+	if body, ok := readCache(cache); ok && !record {
+		return json.Unmarshal(body, v)
+	}
+	req, e := http.NewRequest("GET", uri, nil)
+	if e != nil {
+		return e
+	}
+	// the key isn't part of the cache or fixture name
+	q.Set(keyName, key)
+	req.URL.RawQuery = q.Encode()
+	q.Del(keyName)
+	var client http.Client
+	rsp, e := client.Do(req)
+	if e != nil {
+		return e
+	}
+	defer rsp.Body.Close()
+	body, e := io.ReadAll(rsp.Body)
+	if e != nil {
+		return e
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", provider, endpoint, rsp.Status)
+	}
+	e = json.Unmarshal(body, v)
+	if e == nil {
+		writeCache(cache, body)
+		if record {
+			writeCache(fixture, body)
+		}
+	}
+	return e
+}
+
+// printGuesses prints what m would make of a name without touching anything
+func printGuesses(names []string) {
+	for _, n := range names {
+		fmt.Printf("name :\n| %s\n", n)
+		fmt.Println("name options :")
+		cands := nameCandidates(n)
+		for i, c := range cands {
+			fmt.Printf("  %d) %s\n", i, c)
+		}
+		var best *match
+		for _, m := range findMatches(n) {
+			m := m
+			if best == nil {
+				best = &m
+			}
+			fmt.Printf("| %s: %s score %.2f\n", m.tmdb.Source, tmdbFileName(&m.tmdb), m.score)
+		}
+		if best == nil {
+			fmt.Println("| no match")
+			continue
+		}
+		folder, rule := guessFolder(n, n, best.tmdb.ReleaseDate.year(), &best.tmdb)
+		if folder == "" {
+			fmt.Println("| no folder rule matched")
+			continue
+		}
+		fmt.Printf("| folder: %s [%s]\n", folder, rule)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import "testing"
+
+// useFixtures answers every search from testdata and makes ffprobe fail so resolution comes from the name
+func useFixtures(t *testing.T, order ...string) {
+	t.Helper()
+	oldFolder, oldOrder, oldProbe, oldRules := fixtureFolder, providerOrder, ffprobe, rules
+	t.Cleanup(func() {
+		fixtureFolder, providerOrder, ffprobe, rules = oldFolder, oldOrder, oldProbe, oldRules
+	})
+	fixtureFolder = "testdata"
+	providerOrder = order
+	ffprobe = "/nonexistent/ffprobe"
+	setRules(defaultRules)
+}
+
+func TestSearchFixtures(t *testing.T) {
+	useFixtures(t, "tmdb", "omdb")
+	tests := []struct {
+		title, year string
+		source      string
+		id          int
+		imdbId      string
+	}{
+		{"Heat", "1995", "tmdb", 949, ""},
+		{"Aeon Flux", "2005", "omdb", 0, "tt0402022"},
+		{"Nothing Here", "1999", "", 0, ""},
+	}
+	for _, tt := range tests {
+		if tt.source == "omdb" {
+			providerOrder = []string{"omdb"}
+		} else {
+			providerOrder = []string{"tmdb", "omdb"}
+		}
+		results := searchResults(tt.title, tt.year)
+		if tt.source == "" {
+			if len(results) != 0 {
+				t.Errorf("%s: got %d results, want none", tt.title, len(results))
+			}
+			continue
+		}
+		if len(results) == 0 {
+			t.Fatalf("%s: no results", tt.title)
+		}
+		r := results[0]
+		if r.Source != tt.source || r.Id != tt.id || r.ImdbId != tt.imdbId {
+			t.Errorf("%s: got %s %d %s, want %s %d %s", tt.title, r.Source, r.Id, r.ImdbId, tt.source, tt.id,
+				tt.imdbId)
+		}
+		if y := r.ReleaseDate.Format("2006"); y != tt.year {
+			t.Errorf("%s: release year %s, want %s", tt.title, y, tt.year)
+		}
+	}
+}
+
+func TestOmdbDetail(t *testing.T) {
+	useFixtures(t, "omdb")
+	results := searchResults("Aeon Flux", "2005")
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	r := results[0]
+	if got := r.ReleaseDate.Format("2006-01-02"); got != "2005-12-02" {
+		t.Errorf("release date %s, want 2005-12-02", got)
+	}
+	if got := r.genres(); len(got) != 2 || got[0] != "Action" || got[1] != "Science Fiction" {
+		t.Errorf("genres %v, want [Action Science Fiction]", got)
+	}
+	if r.OriginalLanguage != "en" {
+		t.Errorf("language %q, want en", r.OriginalLanguage)
+	}
+}
+
+func TestGuessFolder(t *testing.T) {
+	tests := []struct {
+		name, title, year string
+		order             []string
+		rules             []string
+		want              string
+	}{
+		{"Heat.1995.1080p.BluRay.x264.mkv", "Heat", "1995", []string{"tmdb"}, nil, "before_2000"},
+		{"Dune.2021.2160p.WEB-DL.mkv", "Dune", "2021", []string{"tmdb"}, nil, "4K"},
+		{"Dune.2021.1080p.WEB-DL.mkv", "Dune", "2021", []string{"tmdb"}, nil, "action_adventure_sci-fi"},
+		{"Amelie.2001.1080p.mkv", "Amelie", "2001", []string{"tmdb"}, nil, "comedy"},
+		{"Amelie.2001.1080p.mkv", "Amelie", "2001", []string{"tmdb"},
+			[]string{"foreign: language != en", "comedy: main_genre = Comedy"}, "foreign"},
+		{"Logan.2017.1080p.mkv", "Logan", "2017", []string{"tmdb"},
+			[]string{"comic_book: keyword = superhero", "drama: main_genre = Drama"}, "comic_book"},
+		{"Heat.1995.1080p.mkv", "Heat", "1995", []string{"tmdb"},
+			[]string{"comic_book: keyword = superhero", "drama: genre = Drama"}, "drama"},
+		{"Aeon.Flux.2005.1080p.mkv", "Aeon Flux", "2005", []string{"omdb"}, nil, "action_adventure_sci-fi"},
+		{"Aeon.Flux.2005.1080p.mkv", "Aeon Flux", "2005", []string{"omdb"},
+			[]string{"comic_book: keyword = superhero"}, ""},
+	}
+	for _, tt := range tests {
+		useFixtures(t, tt.order...)
+		if tt.rules != nil {
+			setRules(tt.rules)
+		}
+		results := searchResults(tt.title, tt.year)
+		if len(results) == 0 {
+			t.Fatalf("%s: no results", tt.name)
+		}
+		video := "/x/_proc/" + tt.name
+		if got, _ := guessFolder(video, tt.name, tt.year, &results[0]); got != tt.want {
+			t.Errorf("guessFolder(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
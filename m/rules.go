@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+	folder rules
+		the guessed folder comes from the first rule whose conditions all match, rules are checked in order.
+			rule = <folder>: <condition>, <condition> ..
+		conditions are <key> <op> <value>, ops are = != < <= > >=. = and != take a list of values separated by |
+			genre       any tmdb genre of the movie
+			main_genre  the first tmdb genre
+			year        release year from tmdb, or the year in the name
+			resolution  2160, 1080, 720 or the height of the video, from ffprobe. the width decides for wide
+			            movies, so a 3840x1600 video is 2160. without ffprobe, 2160 when the name has 2160 or 4k
+			language    original language on tmdb, as iso 639-1 (en, fr, ja ..)
+			keyword     any tmdb keyword of the movie
+		a condition on something that isn't known, like genre for a movie not found on tmdb, doesn't match.
+*/
+
+var (
+	ffprobe      = "ffprobe"
+	rules        []Rule
+	defaultRules = []string{
+		"4K_docs: resolution >= 2160, genre = Documentary",
+		"4K: resolution >= 2160",
+		"before_1980: year < 1980",
+		"before_2000: year < 2000",
+		"action_adventure_sci-fi: main_genre = Action|Adventure|Fantasy|Science Fiction",
+		"animated: main_genre = Animation",
+		"comedy: main_genre = Comedy",
+		"docs: main_genre = Documentary",
+		"hallmark_family: main_genre = Family|Music",
+		"horror: main_genre = Horror|Thriller",
+		"drama: main_genre = Crime|Drama|History|Mystery|Romance|TV Movie|War|Western",
+	}
+	reCond = regexp.MustCompile(`^\s*(\w+)\s*(>=|<=|!=|=|<|>)\s*(.+?)\s*$`)
+)
+
+type Rule struct {
+	folder string
+	conds  []Cond
+	text   string // as written, shown in the folder menu
+}
+type Cond struct {
+	key    string
+	op     string
+	values []string
+}
+
+// facts are what the rules look at, found once per video. keywords are only fetched when a rule needs them.
+type facts struct {
+	genres     []string
+	year       int
+	resolution int
+	language   string
+	tmdbId     int
+	keywords   []string
+	gotKw      bool
+}
+
+func parseRule(s string) (Rule, error) {
+	folder, conds, ok := strings.Cut(s, ":")
+	r := Rule{folder: strings.TrimSpace(folder), text: strings.TrimSpace(conds)}
+	if !ok || r.folder == "" || r.text == "" {
+		return r, fmt.Errorf("rule must be <folder>: <conditions>: %s", s)
+	}
+	for _, c := range strings.Split(conds, ",") {
+		m := reCond.FindStringSubmatch(c)
+		if m == nil {
+			return r, fmt.Errorf("condition must be <key> <op> <value>: %s", c)
+		}
+		cond := Cond{key: strings.ToLower(m[1]), op: m[2]}
+		if !isAny(cond.key, "genre", "main_genre", "year", "resolution", "language", "keyword") {
+			return r, fmt.Errorf("unknown rule key %s", cond.key)
+		}
+		for _, v := range strings.Split(m[3], "|") {
+			cond.values = append(cond.values, strings.TrimSpace(v))
+		}
+		numeric := isAny(cond.key, "year", "resolution")
+		if !numeric && !isAny(cond.op, "=", "!=") {
+			return r, fmt.Errorf("%s only takes = or !=", cond.key)
+		}
+		if numeric {
+			for _, v := range cond.values {
+				if _, e := strconv.Atoi(v); e != nil {
+					return r, fmt.Errorf("%s must be a number: %s", cond.key, v)
+				}
+			}
+		}
+		r.conds = append(r.conds, cond)
+	}
+	return r, nil
+}
+
+// match reports whether every condition of the rule matches
+func (r *Rule) match(f *facts) bool {
+	for _, c := range r.conds {
+		if !c.match(f) {
+			return false
+		}
+	}
+	return true
+}
+func (c *Cond) match(f *facts) bool {
+	switch c.key {
+	case "year", "resolution":
+		n := f.year
+		if c.key == "resolution" {
+			n = f.resolution
+		}
+		if n == 0 {
+			return false
+		}
+		for _, v := range c.values {
+			if compare(n, c.op, v) {
+				return true
+			}
+		}
+		return false
+	}
+	var have []string
+	switch c.key {
+	case "genre":
+		have = f.genres
+	case "main_genre":
+		if len(f.genres) > 0 {
+			have = f.genres[:1]
+		}
+	case "language":
+		if f.language != "" {
+			have = []string{f.language}
+		}
+	case "keyword":
+		have = f.getKeywords()
+	}
+	if len(have) == 0 {
+		return false
+	}
+	found := false
+	for _, h := range have {
+		for _, v := range c.values {
+			if strings.EqualFold(h, v) {
+				found = true
+			}
+		}
+	}
+	return found == (c.op == "=")
+}
+func compare(n int, op, v string) bool {
+	w, _ := strconv.Atoi(v)
+	switch op {
+	case "<":
+		return n < w
+	case "<=":
+		return n <= w
+	case ">":
+		return n > w
+	case ">=":
+		return n >= w
+	case "!=":
+		return n != w
+	}
+	return n == w
+}
+
+func (f *facts) getKeywords() []string {
+	if f.gotKw || f.tmdbId == 0 {
+		return f.keywords
+	}
+	f.gotKw = true
+	var kws struct {
+		Keywords []struct {
+			Name string `json:"name"`
+		} `json:"keywords"`
+	}
+	e := tmdbGet(fmt.Sprintf("movie/%d/keywords", f.tmdbId), url.Values{}, &kws)
+	if e != nil {
+		fmt.Println(e)
+		return nil
+	}
+	for _, k := range kws.Keywords {
+		f.keywords = append(f.keywords, k.Name)
+	}
+	return f.keywords
+}
+
+// videoFacts gathers the facts for a video. name is the file name it came in with, for the resolution fallback.
+func videoFacts(video, name, year string, tmdb *TmdbResult) *facts {
+	f := &facts{resolution: resolution(video, name)}
+	f.year, _ = strconv.Atoi(year)
+	if tmdb != nil {
+		f.genres = tmdb.genres()
+		f.language = tmdb.OriginalLanguage
+		f.tmdbId = tmdb.Id
+		if !tmdb.ReleaseDate.IsZero() {
+			f.year = tmdb.ReleaseDate.Year()
+		}
+	}
+	return f
+}
+
+// resolution returns 2160, 1080 or 720 for videos of those sizes, the height for smaller ones, 0 if unknown
+func resolution(video, name string) int {
+	vi, e := probeVideo(video)
+	if e != nil {
+		if strings.Contains(name, "2160") || strings.Contains(strings.ToLower(name), "4k") {
+			return 2160
+		}
+		return 0
+	}
+	w, h := vi.width, vi.height
+	switch {
+	case w >= 3200 || h >= 1800:
+		return 2160
+	case w >= 1700 || h >= 1000:
+		return 1080
+	case w >= 1200 || h >= 700:
+		return 720
+	}
+	return h
+}
+
+type videoInfo struct {
+	codec  string
+	width  int
+	height int
+}
+
+// probeVideo returns the codec and size of the first video stream
+func probeVideo(video string) (videoInfo, error) {
+	var vi videoInfo
+	out, e := exec.Command(ffprobe, "-v", "error", "-select_streams", "v:0", "-show_entries",
+		"stream=codec_name,width,height", "-of", "csv=p=0", video).Output()
+	if e != nil {
+		return vi, e
+	}
+	parts := strings.Split(strings.TrimSpace(string(out)), ",")
+	if len(parts) < 3 {
+		return vi, fmt.Errorf("unexpected ffprobe output for %s: %s", video, out)
+	}
+	vi.codec = parts[0]
+	vi.width, _ = strconv.Atoi(parts[1])
+	vi.height, _ = strconv.Atoi(parts[2])
+	return vi, nil
+}
+
+// guessFolder returns the folder of the first rule that matches a video and the rule, "" if none match
+func guessFolder(video, name, year string, tmdb *TmdbResult) (string, string) {
+	f := videoFacts(video, name, year, tmdb)
+	for _, r := range rules {
+		if r.match(f) {
+			return r.folder, r.text
+		}
+	}
+	return "", ""
+}
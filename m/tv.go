@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	tv episodes
+		videos named with SxxEyy, SxxEyy-Ezz, NxYY or an air date (2021.05.14) are episodes. the show name comes from
+		the text before the episode marker, or from the folder when the file name starts with the marker. a year after
+		the show name picks between shows with the same name.
+		the show is searched on tmdb and the episode title comes from the season listing, by number or by air date.
+		episodes are renamed to "Show (Year) - S01E02 - Title.mkv" and moved to tvFolder/Show (Year)/Season 01.
+		tvFolder is /z/~tv unless tv_folder is set in m.conf or the TV_ROOT env var is set.
+		-auto moves an episode when the show is a confident match (see auto.go) and tmdb has the episode, everything
+		else goes on the review list. without -auto the move is confirmed at a prompt, and videos with no show found
+		on tmdb go through the movie menus.
+*/
+
+var (
+	tvFolder    = "/z/~tv"
+	reSxxEyy    = regexp.MustCompile(`(?i)^(.*?)[ ._-]*\bs(\d{1,2})[ ._-]?e(\d{1,3})(?:(?:[ ._-]?e|-)(\d{1,3}))?\b`)
+	reNxYY      = regexp.MustCompile(`(?i)^(.*?)[ ._-]*\b(\d{1,2})x(\d{2,3})\b`)
+	reAirDate   = regexp.MustCompile(`^(.*?)[ ._-]*\b((?:19|20)\d{2})[ ._-](\d{2})[ ._-](\d{2})\b`)
+	reShowYear  = regexp.MustCompile(`^(.+?)[ ._(]+((?:19|20)\d{2})\)?$`)
+	reSeasonDir = regexp.MustCompile(`(?i)[ ._-]*\b(season[ ._-]?\d+|s\d{1,2})\b.*$`)
+)
+
+// Episode is what the name of a video says about the episode in it
+type Episode struct {
+	Show     string
+	Year     string
+	Season   int
+	Episodes []int     // one, or the first and last of a multi-episode file
+	AirDate  time.Time // daily shows, instead of Season and Episodes
+}
+
+func (ep Episode) String() string {
+	if !ep.AirDate.IsZero() {
+		return fmt.Sprintf("%s %s", ep.Show, ep.AirDate.Format("2006-01-02"))
+	}
+	return fmt.Sprintf("%s %s", ep.Show, episodeTag(ep.Season, ep.Episodes))
+}
+
+type TmdbTvResults struct {
+	Results []TmdbTvResult `json:"results"`
+}
+type TmdbTvResult struct {
+	Id           int      `json:"id"`
+	Name         string   `json:"name"`
+	OriginalName string   `json:"original_name"`
+	FirstAirDate TmdbDate `json:"first_air_date"`
+	GenreIds     []int    `json:"genre_ids"`
+	Overview     string   `json:"overview"`
+	Popularity   float64  `json:"popularity"`
+}
+type TmdbTvDetails struct {
+	Seasons []struct {
+		SeasonNumber int      `json:"season_number"`
+		AirDate      TmdbDate `json:"air_date"`
+	} `json:"seasons"`
+}
+type TmdbSeason struct {
+	Episodes []TmdbEpisode `json:"episodes"`
+}
+type TmdbEpisode struct {
+	Name          string   `json:"name"`
+	SeasonNumber  int      `json:"season_number"`
+	EpisodeNumber int      `json:"episode_number"`
+	AirDate       TmdbDate `json:"air_date"`
+}
+
+// parseEpisode returns the episode a video is named as, false if it isn't named like an episode
+func parseEpisode(mkv string) (ep Episode, ok bool) {
+	name := strings.TrimSuffix(filepath.Base(mkv), filepath.Ext(mkv))
+	var show string
+	if m := reSxxEyy.FindStringSubmatch(name); m != nil {
+		show = m[1]
+		ep.Season, _ = strconv.Atoi(m[2])
+		first, _ := strconv.Atoi(m[3])
+		ep.Episodes = []int{first}
+		if last, e := strconv.Atoi(m[4]); e == nil && last > first {
+			ep.Episodes = append(ep.Episodes, last)
+		}
+	} else if m := reNxYY.FindStringSubmatch(name); m != nil {
+		show = m[1]
+		ep.Season, _ = strconv.Atoi(m[2])
+		n, _ := strconv.Atoi(m[3])
+		ep.Episodes = []int{n}
+	} else if m := reAirDate.FindStringSubmatch(name); m != nil {
+		d, e := time.Parse("2006-01-02", strings.Join(m[2:5], "-"))
+		if e != nil {
+			return ep, false
+		}
+		show = m[1]
+		ep.AirDate = d
+	} else {
+		return ep, false
+	}
+	if strings.TrimSpace(show) == "" {
+		// Show.Name/Season 1/S01E02.mkv
+		dir := filepath.Dir(mkv)
+		show = reSeasonDir.ReplaceAllString(filepath.Base(dir), "")
+		if show == "" {
+			show = reSeasonDir.ReplaceAllString(filepath.Base(filepath.Dir(dir)), "")
+		}
+	}
+	show = strings.TrimSpace(regexp.MustCompile(`[_.]+`).ReplaceAllString(show, " "))
+	if m := reShowYear.FindStringSubmatch(show); m != nil {
+		show, ep.Year = m[1], m[2]
+	}
+	ep.Show = titleCase(strings.TrimSpace(trimNoise(show)))
+	return ep, ep.Show != ""
+}
+
+func episodeTag(season int, episodes []int) string {
+	tag := fmt.Sprintf("S%02dE%02d", season, episodes[0])
+	if len(episodes) > 1 {
+		tag += fmt.Sprintf("-E%02d", episodes[len(episodes)-1])
+	}
+	return tag
+}
+
+func tmdbTvResults(show, year string) []TmdbTvResult {
+	q := url.Values{}
+	q.Add("query", show)
+	if year != "" {
+		q.Add("first_air_date_year", year)
+	}
+	var trs TmdbTvResults
+	e := tmdbGet("search/tv", q, &trs)
+	if e != nil {
+		fmt.Println(e)
+		return nil
+	}
+	return trs.Results
+}
+
+func tmdbSeason(showId, season int) ([]TmdbEpisode, error) {
+	var s TmdbSeason
+	e := tmdbGet(fmt.Sprintf("tv/%d/season/%d", showId, season), url.Values{}, &s)
+	return s.Episodes, e
+}
+
+// tmdbEpisodes returns the tmdb episodes a video holds, by number or by air date
+func tmdbEpisodes(showId int, ep Episode) ([]TmdbEpisode, error) {
+	if ep.AirDate.IsZero() {
+		list, e := tmdbSeason(showId, ep.Season)
+		if e != nil {
+			return nil, e
+		}
+		var found []TmdbEpisode
+		for _, te := range list {
+			if te.EpisodeNumber >= ep.Episodes[0] && te.EpisodeNumber <= ep.Episodes[len(ep.Episodes)-1] {
+				found = append(found, te)
+			}
+		}
+		if len(found) != ep.Episodes[len(ep.Episodes)-1]-ep.Episodes[0]+1 {
+			return nil, fmt.Errorf("%s not found on tmdb", episodeTag(ep.Season, ep.Episodes))
+		}
+		return found, nil
+	}
+	var details TmdbTvDetails
+	e := tmdbGet(fmt.Sprintf("tv/%d", showId), url.Values{}, &details)
+	if e != nil {
+		return nil, e
+	}
+	// latest season that started on or before the air date first
+	sort.Slice(details.Seasons, func(i, j int) bool {
+		return details.Seasons[i].SeasonNumber > details.Seasons[j].SeasonNumber
+	})
+	for _, s := range details.Seasons {
+		if s.SeasonNumber == 0 || s.AirDate.After(ep.AirDate) {
+			continue
+		}
+		list, e := tmdbSeason(showId, s.SeasonNumber)
+		if e != nil {
+			return nil, e
+		}
+		for _, te := range list {
+			if te.AirDate.Equal(ep.AirDate) {
+				return []TmdbEpisode{te}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no episode aired %s on tmdb", ep.AirDate.Format("2006-01-02"))
+}
+
+// showMatches searches tmdb for the show of an episode and returns the results scored, highest first
+func showMatches(ep Episode) []tvMatch {
+	var matches []tvMatch
+	for _, t := range tmdbTvResults(ep.Show, ep.Year) {
+		sim := math.Max(similarity(ep.Show, t.Name), similarity(ep.Show, t.OriginalName))
+		pop := math.Min(1, math.Log10(1+t.Popularity)/2)
+		var score float64
+		if ep.Year != "" {
+			yearScore := 0.0
+			if strconv.Itoa(t.FirstAirDate.Year()) == ep.Year {
+				yearScore = 1
+			}
+			score = 0.6*sim + 0.3*yearScore + 0.1*pop
+		} else {
+			// most episode names have no year, the title has to carry the match
+			score = 0.9*sim + 0.1*pop
+		}
+		matches = append(matches, tvMatch{show: t, score: score})
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+	return matches
+}
+
+type tvMatch struct {
+	show  TmdbTvResult
+	score float64
+}
+
+// showFolder is "Show (Year)", the folder under tvFolder and the start of episode names
+func showFolder(show TmdbTvResult) string {
+	if show.FirstAirDate.IsZero() {
+		return getLegalFilename(show.Name)
+	}
+	return getLegalFilename(fmt.Sprintf("%s (%d)", show.Name, show.FirstAirDate.Year()))
+}
+
+// episodeDst returns where an episode goes: tvFolder/Show (Year)/Season 01/Show (Year) - S01E02 - Title.mkv
+func episodeDst(show TmdbTvResult, eps []TmdbEpisode, ext string) string {
+	var numbers []int
+	var titles []string
+	for _, te := range eps {
+		numbers = append(numbers, te.EpisodeNumber)
+		titles = append(titles, te.Name)
+	}
+	season := eps[0].SeasonNumber
+	name := fmt.Sprintf("%s - %s", showFolder(show), episodeTag(season, numbers))
+	if title := strings.Join(titles, " + "); title != "" {
+		name += " - " + title
+	}
+	return path.Join(tvFolder, showFolder(show), fmt.Sprintf("Season %02d", season), getLegalFilename(name+ext))
+}
+
+// lookupEpisode finds the show and episode on tmdb and returns where the video goes. confident is false when the
+// show match isn't clear enough for -auto.
+func lookupEpisode(mkv string, ep Episode) (dst string, confident bool, e error) {
+	matches := showMatches(ep)
+	if len(matches) == 0 {
+		return "", false, errors.New("no tmdb show match for " + ep.Show)
+	}
+	best := matches[0]
+	fmt.Printf("| best show match: %s, score %.2f\n", showFolder(best.show), best.score)
+	confident = best.score >= autoMinScore && (len(matches) == 1 || best.score-matches[1].score >= autoMargin)
+	eps, e := tmdbEpisodes(best.show.Id, ep)
+	if e != nil {
+		return "", false, e
+	}
+	return episodeDst(best.show, eps, strings.ToLower(filepath.Ext(mkv))), confident, nil
+}
+
+func sortEpisodeAuto(mkv string, ep Episode) {
+	fmt.Printf("video :\n| %s\nepisode :\n| %s\n", mkv, ep)
+	dst, confident, e := lookupEpisode(mkv, ep)
+	if e != nil {
+		addReview(mkv, e.Error())
+		return
+	}
+	if !confident {
+		addReview(mkv, "show match for "+ep.Show+" not clear")
+		return
+	}
+	if fileExists(dst) {
+		addReview(mkv, dst+" already exists")
+		return
+	}
+	fmt.Printf("| Moving -> %s\n", dst)
+	e = move(mkv, dst)
+	if e != nil {
+		chk(e)
+		addReview(mkv, "move failed: "+e.Error())
+	}
+}
+
+// sortEpisode confirms the move of an episode at a prompt. videos with no show on tmdb go through the movie menus.
+func sortEpisode(mkv string, ep Episode, workDir string) {
+	fmt.Printf("video :\n| %s\nepisode :\n| %s\n", mkv, ep)
+	dst, _, e := lookupEpisode(mkv, ep)
+	if e != nil {
+		fmt.Printf("| %s, using movie options\n", e)
+		sortInteractive(mkv, workDir)
+		return
+	}
+	if fileExists(dst) {
+		fmt.Printf("| %s already exists, leaving file in place\n", dst)
+		return
+	}
+	if getYesNo(fmt.Sprintf("move to %s ? [1,0,y,N or Enter to skip] ", dst)) {
+		fmt.Printf("| Moving -> %s\n", dst)
+		e := move(mkv, dst)
+		chkFatal(e)
+	} else {
+		fmt.Println("| leaving file in place")
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseEpisode(t *testing.T) {
+	tests := []struct {
+		mkv      string
+		show     string
+		season   int
+		episodes []int
+	}{
+		{"/x/_proc/Show.Name.S01E02.1080p.WEB.mkv", "Show Name", 1, []int{2}},
+		{"/x/_proc/Show.Name.S01E01E02.1080p.mkv", "Show Name", 1, []int{1, 2}},
+		{"/x/_proc/Show.Name.S01E01-E03.mkv", "Show Name", 1, []int{1, 3}},
+		{"/x/_proc/Show.Name.S01E01-02.mkv", "Show Name", 1, []int{1, 2}},
+		{"/x/_proc/Show.Name.S01E01.E02.mkv", "Show Name", 1, []int{1, 2}},
+		// audio channels after the episode aren't a second episode
+		{"/x/_proc/Show.S01E01.5.1.AAC.mkv", "Show", 1, []int{1}},
+		{"/x/_proc/Show.S01E01.1080p.mkv", "Show", 1, []int{1}},
+		{"/x/_proc/Show.Name.2x05.mkv", "Show Name", 2, []int{5}},
+		{"/x/_proc/Show Name/Season 1/S01E02.mkv", "Show Name", 1, []int{2}},
+	}
+	for _, tt := range tests {
+		ep, ok := parseEpisode(tt.mkv)
+		if !ok || ep.Show != tt.show || ep.Season != tt.season || !reflect.DeepEqual(ep.Episodes, tt.episodes) {
+			t.Errorf("parseEpisode(%q) = %q S%d %v %v, want %q S%d %v", tt.mkv, ep.Show, ep.Season, ep.Episodes, ok,
+				tt.show, tt.season, tt.episodes)
+		}
+	}
+}
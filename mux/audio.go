@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+	audio compatibility tracks
+		clients that can't play lossless audio (truehd, dts-hd) get an extra lossy track encoded from the lossless one.
+		the original track is left untouched and stays the default track. settings come from mux.conf
+			compat_audio            formats to add, any of aac_stereo aac_51 ac3_stereo ac3_51 eac3_51
+			compat_sources          codecs or codec profiles that get compatibility tracks [default truehd dts-hd]
+			compat_loudnorm         apply EBU R128 loudness normalization to the added track
+			compat_loudnorm_target  integrated loudness target in LUFS [default -23]
+			compat_order            after_source: added track follows the track it was made from [default]
+			                        after_all: added tracks follow all original audio tracks
+		no track is added when a track in the same language already uses the compatibility codec, so remuxed files
+		don't get a second copy.
+*/
+
+type CompatFormat struct {
+	name     string
+	codec    string
+	ext      string
+	channels int
+	bitrate  string
+}
+
+var (
+	compatFormats = map[string]CompatFormat{
+		"aac_stereo": {name: "AAC", codec: "aac", ext: "aac", channels: 2, bitrate: "256k"},
+		"aac_51":     {name: "AAC", codec: "aac", ext: "aac", channels: 6, bitrate: "512k"},
+		"ac3_stereo": {name: "AC3", codec: "ac3", ext: "ac3", channels: 2, bitrate: "224k"},
+		"ac3_51":     {name: "AC3", codec: "ac3", ext: "ac3", channels: 6, bitrate: "640k"},
+		"eac3_51":    {name: "E-AC3", codec: "eac3", ext: "eac3", channels: 6, bitrate: "768k"},
+	}
+	compatAudio          []string
+	compatSources        = []string{"truehd", "dts-hd"}
+	compatLoudnorm       bool
+	compatLoudnormTarget = "-23"
+	compatOrder          = "after_source"
+)
+
+// needsCompat reports whether the stream matches one of compat_sources by codec name or profile
+func needsCompat(s *Stream) bool {
+	codec := strings.ToLower(s.CodecName)
+	profile := strings.ToLower(s.Profile)
+	for _, src := range compatSources {
+		src = strings.ToLower(src)
+		if codec == src || (profile != "" && strings.HasPrefix(profile, src)) {
+			return true
+		}
+	}
+	return false
+}
+
+// addCompatAudio adds compatibility tracks for lossless audio streams and orders them according to compat_order.
+// compat streams already created for this job are reused so restarted jobs don't add them twice.
+func (j *Job) addCompatAudio() {
+	if len(compatAudio) == 0 {
+		return
+	}
+	var ordered, added []*Stream
+	for _, s := range j.audioStream {
+		ordered = append(ordered, s)
+		if !needsCompat(s) {
+			continue
+		}
+		for _, name := range compatAudio {
+			cf, ok := compatFormats[name]
+			if !ok {
+				continue
+			}
+			c := j.compatStream(s, name, cf)
+			if c == nil {
+				continue
+			}
+			if compatOrder == "after_all" {
+				added = append(added, c)
+			} else {
+				ordered = append(ordered, c)
+			}
+		}
+	}
+	j.audioStream = append(ordered, added...)
+}
+func (j *Job) compatStream(src *Stream, name string, cf CompatFormat) *Stream {
+	for _, s := range j.streams {
+		if s.compatSource == src && s.compatFormat == name {
+			return s
+		}
+	}
+	for _, s := range j.streams {
+		if s.CodecType == "audio" && !s.compat && s.CodecName == cf.codec && s.Tags.Language == src.Tags.Language {
+			return nil
+		}
+	}
+
+	channels := cf.channels
+	if src.Channels > 0 && src.Channels < channels {
+		channels = src.Channels
+	}
+	c := &Stream{
+		Index:         src.Index,
+		CodecType:     "audio",
+		CodecName:     cf.codec,
+		SampleRate:    src.SampleRate,
+		Channels:      channels,
+		ChannelLayout: src.ChannelLayout,
+		convert:       true,
+		compat:        true,
+		compatFormat:  name,
+		compatSource:  src,
+	}
+	c.Tags.Language = src.Tags.Language
+	c.Tags.Title = cf.title(channels)
+	c.elementaryStream = fmt.Sprintf("%s.%d.%s.%s", j.baseWithPath, src.Index, name, cf.ext)
+	j.streams = append(j.streams, c)
+	j.record("adding %s compatibility track for %s audio stream %d", c.Tags.Title, src.CodecName, src.Index)
+	j.convert = true
+	j.mux = true
+	return c
+}
+
+// title names a compatibility track after its format and channel count, never after the source track
+func (cf CompatFormat) title(channels int) string {
+	t := fmt.Sprintf("%s %s", cf.name, channelName(channels))
+	if compatLoudnorm {
+		t += " Normalized"
+	}
+	return t
+}
+
+// compatArgs returns the ffmpeg audio arguments used to encode a compatibility track
+func (s *Stream) compatArgs() []string {
+	cf := compatFormats[s.compatFormat]
+	var filters []string
+	if pan := downmixFilter(s.compatSource, s.Channels); pan != "" {
+		filters = append(filters, pan)
+	}
+	if compatLoudnorm {
+		filters = append(filters, fmt.Sprintf("loudnorm=I=%s:TP=-1:LRA=11", compatLoudnormTarget))
+	}
+	// the source title and tags stay with the source track
+	args := []string{"-map_metadata", "-1", "-c:a", cf.codec, "-b:a", cf.bitrate, "-ac", fmt.Sprintf("%d", s.Channels)}
+	if len(filters) > 0 {
+		// loudnorm resamples to 192k internally
+		args = append(args, "-af", strings.Join(filters, ","), "-ar", "48000")
+	}
+	return args
+}
+
+// downmixFilter returns a pan filter that folds the surround channels of the source layout into the target channel
+// count. surround channels are folded in at -3dB and the center at -3dB, with '<' so pan renormalizes the gains and
+// the mix can't clip. returns "" when ffmpeg's default -ac mixing is fine.
+func downmixFilter(src *Stream, channels int) string {
+	layout := strings.ToLower(src.ChannelLayout)
+	hasSide := strings.Contains(layout, "side") || strings.HasPrefix(layout, "6.1") || strings.HasPrefix(layout, "7.1")
+	hasBack := strings.HasPrefix(layout, "7.1") || isAny(layout, "5.1", "5.0")
+
+	if src.Channels <= channels {
+		return ""
+	}
+	switch channels {
+	case 2:
+		if !hasSide && !hasBack {
+			return ""
+		}
+		var l, r []string
+		l = append(l, "FL", "0.707*FC")
+		r = append(r, "FR", "0.707*FC")
+		if hasSide && hasBack {
+			l = append(l, "0.5*SL", "0.5*BL")
+			r = append(r, "0.5*SR", "0.5*BR")
+		} else if hasSide {
+			l = append(l, "0.707*SL")
+			r = append(r, "0.707*SR")
+		} else {
+			l = append(l, "0.707*BL")
+			r = append(r, "0.707*BR")
+		}
+		return fmt.Sprintf("pan=stereo|FL<%s|FR<%s", strings.Join(l, "+"), strings.Join(r, "+"))
+	case 6:
+		if hasSide && hasBack {
+			return "pan=5.1(side)|FL=FL|FR=FR|FC=FC|LFE=LFE|SL<SL+BL|SR<SR+BR"
+		}
+	}
+	return ""
+}
+
+func channelName(channels int) string {
+	switch channels {
+	case 1:
+		return "1.0"
+	case 2:
+		return "2.0"
+	case 6:
+		return "5.1"
+	case 8:
+		return "7.1"
+	}
+	return fmt.Sprintf("%dch", channels)
+}
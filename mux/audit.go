@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+	mux audit <library path>
+		probes every video under the library path with getStreams and reports
+			codec distribution for video, audio and subtitle streams
+			files with no english audio, files with no subtitles, files whose tracks are not in the order mux
+			writes them (video, audio, forced subtitles, subtitles), interlaced video and odd dimensions
+			file count and total size for each codec and category
+		probe results are cached by path, size and modified time so later audits only probe new or changed files.
+		the summary is printed as a table and the full report, including the files in each category, is written
+		as json.
+*/
+
+const (
+	catNoEnglishAudio = "no english audio"
+	catNoSubtitles    = "missing subtitles"
+	catTrackOrder     = "non-standard track order"
+	catInterlaced     = "interlaced video"
+	catOddDimensions  = "odd dimensions"
+	catProbeFailed    = "probe failed"
+)
+
+type AuditCount struct {
+	Files int      `json:"files"`
+	Size  int64    `json:"size"`
+	Paths []string `json:"paths,omitempty"`
+}
+
+func (ac *AuditCount) add(path string, size int64, keepPath bool) {
+	ac.Files++
+	ac.Size += size
+	if keepPath {
+		ac.Paths = append(ac.Paths, path)
+	}
+}
+
+type AuditReport struct {
+	Path           string                 `json:"path"`
+	Date           time.Time              `json:"date"`
+	Files          int                    `json:"files"`
+	Size           int64                  `json:"size"`
+	VideoCodecs    map[string]*AuditCount `json:"video_codecs"`
+	AudioCodecs    map[string]*AuditCount `json:"audio_codecs"`
+	SubtitleCodecs map[string]*AuditCount `json:"subtitle_codecs"`
+	Categories     map[string]*AuditCount `json:"categories"`
+}
+
+type AuditCacheEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Streams []*Stream `json:"streams"`
+}
+type AuditCache struct {
+	file    string
+	mu      sync.Mutex
+	Entries map[string]*AuditCacheEntry `json:"entries"`
+}
+
+func NewAuditCache(file string) *AuditCache {
+	if file == "" {
+		dir, e := os.UserCacheDir()
+		chkFatal(e)
+		file = filepath.Join(dir, "mux", "audit.json")
+	}
+	ac := AuditCache{file: file, Entries: make(map[string]*AuditCacheEntry)}
+	b, e := os.ReadFile(file)
+	if e == nil {
+		e = json.Unmarshal(b, &ac)
+		if e != nil {
+			p("audit cache %s is not valid, starting with empty cache: %s", file, e)
+		}
+		if ac.Entries == nil {
+			ac.Entries = make(map[string]*AuditCacheEntry)
+		}
+	} else if !errors.Is(e, os.ErrNotExist) {
+		chk(e)
+	}
+	return &ac
+}
+
+// get returns cached streams for path if the size and modified time still match
+func (ac *AuditCache) get(path string, st os.FileInfo) ([]*Stream, bool) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ce, ok := ac.Entries[path]
+	if !ok || ce.Size != st.Size() || !ce.ModTime.Equal(st.ModTime()) {
+		return nil, false
+	}
+	return ce.Streams, true
+}
+func (ac *AuditCache) set(path string, st os.FileInfo, streams []*Stream) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.Entries[path] = &AuditCacheEntry{Size: st.Size(), ModTime: st.ModTime(), Streams: streams}
+}
+
+// save writes the cache, dropping entries for files that weren't part of this audit and no longer exist
+func (ac *AuditCache) save() {
+	for path := range ac.Entries {
+		if !fileExists(path) {
+			delete(ac.Entries, path)
+		}
+	}
+	e := os.MkdirAll(filepath.Dir(ac.file), 0755)
+	chkFatal(e)
+	b, e := json.Marshal(ac)
+	chkFatal(e)
+	e = os.WriteFile(ac.file, b, 0644)
+	chkFatal(e)
+}
+
+type auditResult struct {
+	path    string
+	size    int64
+	streams []*Stream
+	e       error
+}
+
+func auditCmd(args []string) {
+	usage := func() {
+		fmt.Println("mux audit [-json <path>] [-cache <path>] [-t <threads>] <library path>")
+		os.Exit(1)
+	}
+	jsonFile := "mux_audit.json"
+	var cacheFile string
+	threads := runtime.NumCPU()
+	var libPath string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-json", "-cache", "-t":
+			if i+1 >= len(args) {
+				usage()
+			}
+			v := args[i+1]
+			switch args[i] {
+			case "-json":
+				jsonFile = v
+			case "-cache":
+				cacheFile = v
+			case "-t":
+				n, e := strconv.Atoi(v)
+				if e != nil || n < 1 {
+					usage()
+				}
+				threads = n
+			}
+			i++
+		default:
+			libPath = args[i]
+		}
+	}
+	if libPath == "" {
+		usage()
+	}
+	libPath, e := filepath.Abs(libPath)
+	chkFatal(e)
+	st, e := os.Stat(libPath)
+	if e != nil || !st.IsDir() {
+		p("library path %s is not a folder", libPath)
+		os.Exit(1)
+	}
+
+	var videos []string
+	e = filepath.Walk(libPath, func(path string, info os.FileInfo, err error) error {
+		// one unreadable folder or file doesn't stop the audit of the rest of the library
+		if err != nil {
+			p("skipping %s: %s", path, err)
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && isVideo(path) {
+			videos = append(videos, path)
+		}
+		return nil
+	})
+	chkFatal(e)
+	p("auditing %d videos in %s with %d threads", len(videos), libPath, threads)
+
+	cache := NewAuditCache(cacheFile)
+	results := probeLibrary(videos, cache, threads)
+	cache.save()
+
+	report := buildAuditReport(libPath, results)
+	report.print()
+	b, e := json.MarshalIndent(report, "", "  ")
+	chkFatal(e)
+	e = os.WriteFile(jsonFile, b, 0644)
+	chkFatal(e)
+	p("full report written to %s", jsonFile)
+}
+
+// probeLibrary gets streams for all videos in parallel, using cached results for files that haven't changed
+func probeLibrary(videos []string, cache *AuditCache, threads int) []*auditResult {
+	results := make([]*auditResult, len(videos))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	var probed, cached int
+	var mu sync.Mutex
+
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				r := auditResult{path: videos[i]}
+				results[i] = &r
+				st, e := os.Stat(r.path)
+				if e != nil {
+					r.e = e
+					continue
+				}
+				r.size = st.Size()
+				if streams, ok := cache.get(r.path, st); ok {
+					r.streams = streams
+					mu.Lock()
+					cached++
+					mu.Unlock()
+					continue
+				}
+				r.e, r.streams = getStreams(r.path)
+				if r.e == nil {
+					cache.set(r.path, st, r.streams)
+				}
+				mu.Lock()
+				probed++
+				if probed%100 == 0 {
+					p("probed %d files", probed)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range videos {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	p("probed %d files, %d unchanged files from cache", probed, cached)
+	return results
+}
+
+func buildAuditReport(libPath string, results []*auditResult) *AuditReport {
+	r := AuditReport{
+		Path:           libPath,
+		Date:           time.Now(),
+		VideoCodecs:    make(map[string]*AuditCount),
+		AudioCodecs:    make(map[string]*AuditCount),
+		SubtitleCodecs: make(map[string]*AuditCount),
+		Categories:     make(map[string]*AuditCount),
+	}
+	for _, c := range []string{catNoEnglishAudio, catNoSubtitles, catTrackOrder, catInterlaced, catOddDimensions,
+		catProbeFailed} {
+		r.Categories[c] = &AuditCount{}
+	}
+	count := func(m map[string]*AuditCount, key, path string, size int64) {
+		if _, ok := m[key]; !ok {
+			m[key] = &AuditCount{}
+		}
+		m[key].add(path, size, false)
+	}
+
+	for _, res := range results {
+		r.Files++
+		r.Size += res.size
+		if res.e != nil {
+			r.Categories[catProbeFailed].add(res.path, res.size, true)
+			continue
+		}
+		// count each codec once per file so sizes add up to the size of files using it
+		seen := map[string]bool{}
+		var english, subs, interlaced, odd bool
+		for _, s := range res.streams {
+			key := s.CodecType + "/" + s.CodecName
+			switch s.CodecType {
+			case "video":
+				if isAny(s.CodecName, "mjpeg", "bmp", "png") {
+					continue
+				}
+				if !seen[key] {
+					count(r.VideoCodecs, s.CodecName, res.path, res.size)
+				}
+				if !isAny(s.FieldOrder, "progressive", "unknown", "") {
+					interlaced = true
+				}
+				if s.Width%2 != 0 || s.Height%2 != 0 {
+					odd = true
+				}
+			case "audio":
+				if !seen[key] {
+					count(r.AudioCodecs, s.CodecName, res.path, res.size)
+				}
+				if isAny(s.Tags.Language, engLangs...) {
+					english = true
+				}
+			case "subtitle":
+				if !seen[key] {
+					count(r.SubtitleCodecs, s.CodecName, res.path, res.size)
+				}
+				subs = true
+			}
+			seen[key] = true
+		}
+		if !english {
+			r.Categories[catNoEnglishAudio].add(res.path, res.size, true)
+		}
+		if !subs {
+			r.Categories[catNoSubtitles].add(res.path, res.size, true)
+		}
+		if !standardTrackOrder(res.streams) {
+			r.Categories[catTrackOrder].add(res.path, res.size, true)
+		}
+		if interlaced {
+			r.Categories[catInterlaced].add(res.path, res.size, true)
+		}
+		if odd {
+			r.Categories[catOddDimensions].add(res.path, res.size, true)
+		}
+	}
+	for _, c := range r.Categories {
+		sort.Strings(c.Paths)
+	}
+	return &r
+}
+
+// standardTrackOrder reports whether streams are already in the order parseStreams would write them
+func standardTrackOrder(streams []*Stream) bool {
+	var vid, audio, forced, subs []*Stream
+	for _, s := range streams {
+		switch s.CodecType {
+		case "video":
+			if !isAny(s.CodecName, "mjpeg", "bmp", "png") {
+				vid = append(vid, s)
+			}
+		case "audio":
+			audio = append(audio, s)
+		case "subtitle":
+			if s.Disposition.Forced == 1 {
+				forced = append(forced, s)
+			} else {
+				subs = append(subs, s)
+			}
+		}
+	}
+	n := 0
+	for _, group := range [][]*Stream{vid, audio, forced, subs} {
+		for _, s := range group {
+			if s.Index != n {
+				return false
+			}
+			n++
+		}
+	}
+	return true
+}
+
+func (r *AuditReport) print() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	section := func(title string, m map[string]*AuditCount) {
+		_, _ = fmt.Fprintf(w, "%s\tFILES\tSIZE\t\n", title)
+		var keys []string
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(a, b int) bool {
+			if m[keys[a]].Files != m[keys[b]].Files {
+				return m[keys[a]].Files > m[keys[b]].Files
+			}
+			return keys[a] < keys[b]
+		})
+		for _, k := range keys {
+			_, _ = fmt.Fprintf(w, "%s\t%d\t%s\t\n", k, m[k].Files, humanSize(m[k].Size))
+		}
+		_, _ = fmt.Fprintln(w, "\t\t\t")
+	}
+	fmt.Printf("\naudit of %s\n%d files, %s\n\n", r.Path, r.Files, humanSize(r.Size))
+	section("VIDEO CODEC", r.VideoCodecs)
+	section("AUDIO CODEC", r.AudioCodecs)
+	section("SUBTITLE CODEC", r.SubtitleCodecs)
+	section("CATEGORY", r.Categories)
+	_ = w.Flush()
+}
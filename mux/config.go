@@ -0,0 +1,199 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+	mux.conf
+		optional config file for settings that don't fit on the command line.
+		loaded from the path given with -conf, the MUX_CONF environment variable, or /etc/mux.conf.
+		format is one "key = value" per line, lines starting with # are ignored.
+		keys that accept a list can be repeated.
+*/
+
+var (
+	possibleConfs = []string{
+		"/etc/mux.conf",
+	}
+	confFile string
+
+	subAssToSrt     bool
+	subStripStyling bool
+	subFixTiming    bool
+	subDetectLang   bool
+	subOcrCmd       []string
+)
+
+func loadConfig() {
+	if confFile == "" {
+		confFile = os.Getenv("MUX_CONF")
+	}
+	var conf string
+	if confFile != "" {
+		b, e := os.ReadFile(confFile)
+		if e != nil {
+			p("could not read conf file %s: %s", confFile, e)
+			os.Exit(1)
+		}
+		conf = string(b)
+	} else {
+		for _, c := range possibleConfs {
+			b, e := os.ReadFile(c)
+			if e == nil {
+				confFile = c
+				conf = string(b)
+				break
+			}
+		}
+	}
+	if conf == "" {
+		return
+	}
+	p("loading config from %s", confFile)
+
+	reEq := regexp.MustCompile(`\s*=\s*`)
+	for _, line := range strings.Split(conf, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") || !strings.Contains(line, "=") {
+			continue
+		}
+		kv := reEq.Split(line, 2)
+		k, v := strings.ToLower(kv[0]), kv[1]
+		switch k {
+		case "sub_ass_to_srt":
+			subAssToSrt = isTrue(v)
+		case "sub_strip_styling":
+			subStripStyling = isTrue(v)
+		case "sub_fix_timing":
+			subFixTiming = isTrue(v)
+		case "sub_detect_language":
+			subDetectLang = isTrue(v)
+		case "sub_ocr_cmd":
+			subOcrCmd = strings.Fields(v)
+		case "compat_audio":
+			for _, c := range strings.Fields(v) {
+				if _, ok := compatFormats[c]; !ok {
+					p("unknown compat_audio format in %s: %s", confFile, c)
+					os.Exit(1)
+				}
+				compatAudio = append(compatAudio, c)
+			}
+		case "compat_sources":
+			compatSources = strings.Fields(strings.ToLower(v))
+		case "compat_loudnorm":
+			compatLoudnorm = isTrue(v)
+		case "compat_loudnorm_target":
+			compatLoudnormTarget = v
+		case "compat_order":
+			if !isAny(v, "after_source", "after_all") {
+				p("compat_order in %s must be after_source or after_all", confFile)
+				os.Exit(1)
+			}
+			compatOrder = v
+		case "chapter_interval":
+			chapterInterval = atoiConf(k, v)
+		case "title_source":
+			if !isAny(v, "filename", "tmdb", "none") {
+				p("title_source in %s must be filename, tmdb or none", confFile)
+				os.Exit(1)
+			}
+			titleSource = v
+		case "tmdb_key":
+			tmdbKey = v
+		case "junk_title":
+			re, e := regexp.Compile(v)
+			if e != nil {
+				p("invalid junk_title regex in %s: %s", confFile, e)
+				os.Exit(1)
+			}
+			junkTitles = append(junkTitles, re)
+		case "junk_tag":
+			junkTags = append(junkTags, strings.Fields(strings.ToUpper(v))...)
+		case "field_analysis":
+			fieldAnalysis = isTrue(v)
+		case "field_samples":
+			fieldSamples = atoiConf(k, v)
+		case "field_sample_frames":
+			fieldSampleFrames = atoiConf(k, v)
+		case "deinterlacer":
+			if !isAny(v, "yadif", "bwdif") {
+				p("deinterlacer in %s must be yadif or bwdif", confFile)
+				os.Exit(1)
+			}
+			deinterlacer = v
+		case "field_override":
+			kv := strings.SplitN(v, " ", 2)
+			if len(kv) != 2 || !isAny(kv[0], fieldModes...) {
+				p("field_override in %s must be '<progressive|interlaced|telecined> <path or file name>'", confFile)
+				os.Exit(1)
+			}
+			fieldOverrides[strings.TrimSpace(kv[1])] = kv[0]
+		case "remedy":
+			r, e := parseRemedy(v)
+			if e != nil {
+				p("invalid remedy in %s: %s", confFile, e)
+				os.Exit(1)
+			}
+			confRemedies = append(confRemedies, r)
+		case "remedy_max_restarts":
+			remedyMaxRestarts = atoiConf(k, v)
+		case "quality_check":
+			qualityCheck = isTrue(v)
+		case "quality_metric":
+			if !isAny(v, qualityMetrics...) {
+				p("quality_metric in %s must be vmaf, ssim or psnr", confFile)
+				os.Exit(1)
+			}
+			qualityMetric = v
+		case "quality_target":
+			f, e := strconv.ParseFloat(v, 64)
+			if e != nil {
+				p("quality_target in %s must be a number", confFile)
+				os.Exit(1)
+			}
+			qualityTarget = f
+		case "quality_samples":
+			qualitySamples = atoiConf(k, v)
+		case "quality_sample_seconds":
+			qualitySampleSeconds = atoiConf(k, v)
+		case "quality_crf_min":
+			qualityCrfMin = atoiConf(k, v)
+		case "quality_crf_max":
+			qualityCrfMax = atoiConf(k, v)
+		case "quality_max_tries":
+			qualityMaxTries = atoiConf(k, v)
+		case "queue_file":
+			if queueFile == "" {
+				queueFile = v
+			}
+		case "queue_max_attempts":
+			queueMaxAttempts = atoiConf(k, v)
+		case "queue_retry_minutes":
+			queueRetryMinutes = atoiConf(k, v)
+		case "queue_settle_seconds":
+			queueSettleSeconds = atoiConf(k, v)
+		default:
+			p("unknown key in %s: %s", confFile, k)
+		}
+	}
+	if len(subOcrCmd) > 0 && !ocrAvailable() {
+		p("sub_ocr_cmd is set but '%s' was not found, image subtitles will not be converted", subOcrCmd[0])
+		subOcrCmd = nil
+	}
+}
+
+func atoiConf(k, v string) int {
+	i, e := strconv.Atoi(v)
+	if e != nil {
+		p("%s in %s must be a number", k, confFile)
+		os.Exit(1)
+	}
+	return i
+}
+func isTrue(v string) bool {
+	return regexp.MustCompile(`(?i)^(true|t|yes|y|1)$`).MatchString(v)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+/*
+	hdr handling
+		ffprobe reports color metadata on the stream and HDR side data on either the stream (mkv, dolby vision
+		configuration record) or the frames (mp4/ts mastering display and HDR10+ SEI). getStreams reads the stream
+		fields and probes the first frame of any HDR video stream so both sources end up in Stream.SideDataList.
+
+		HDR video is never converted to 8-bit SDR unless -sdr is set. when conversion is required, HDR video is
+		encoded to 10-bit HEVC with the mastering display and content light level metadata passed through to x265
+		and to mkvmerge. dolby vision RPU and HDR10+ dynamic metadata can't be carried through an encode, so only the
+		static HDR10 metadata survives conversion.
+*/
+
+const (
+	sideDataDovi        = "DOVI configuration record"
+	sideDataHdr10Plus   = "HDR Dynamic Metadata SMPTE2094-40 (HDR10+)"
+	sideDataMastering   = "Mastering display metadata"
+	sideDataLightLevel  = "Content light level metadata"
+	transferPQ          = "smpte2084"
+	transferHLG         = "arib-std-b67"
+	tonemapFilter       = "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=hable:desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p"
+	hdrChromaMultiplier = 50000
+	hdrLumaMultiplier   = 10000
+)
+
+type SideData struct {
+	SideDataType string `json:"side_data_type"`
+
+	// dolby vision configuration record
+	DvProfile                 int `json:"dv_profile"`
+	DvLevel                   int `json:"dv_level"`
+	RpuPresentFlag            int `json:"rpu_present_flag"`
+	ElPresentFlag             int `json:"el_present_flag"`
+	BlPresentFlag             int `json:"bl_present_flag"`
+	DvBlSignalCompatibilityId int `json:"dv_bl_signal_compatibility_id"`
+
+	// mastering display metadata, values are rationals like "34000/50000"
+	RedX         string `json:"red_x"`
+	RedY         string `json:"red_y"`
+	GreenX       string `json:"green_x"`
+	GreenY       string `json:"green_y"`
+	BlueX        string `json:"blue_x"`
+	BlueY        string `json:"blue_y"`
+	WhitePointX  string `json:"white_point_x"`
+	WhitePointY  string `json:"white_point_y"`
+	MinLuminance string `json:"min_luminance"`
+	MaxLuminance string `json:"max_luminance"`
+
+	// content light level metadata
+	MaxContent int `json:"max_content"`
+	MaxAverage int `json:"max_average"`
+}
+
+func (s *Stream) sideData(sideDataType string) *SideData {
+	for n := range s.SideDataList {
+		if s.SideDataList[n].SideDataType == sideDataType {
+			return &s.SideDataList[n]
+		}
+	}
+	return nil
+}
+func (s *Stream) isDolbyVision() bool {
+	return s.sideData(sideDataDovi) != nil
+}
+func (s *Stream) isHdr10Plus() bool {
+	return s.sideData(sideDataHdr10Plus) != nil
+}
+func (s *Stream) isHdr() bool {
+	if s.CodecType != "video" {
+		return false
+	}
+	return isAny(s.ColorTransfer, transferPQ, transferHLG) || s.isDolbyVision() || s.isHdr10Plus()
+}
+
+// hdrFormat returns a short description of the HDR flavor of the stream for logging
+func (s *Stream) hdrFormat() string {
+	var formats []string
+	if dv := s.sideData(sideDataDovi); dv != nil {
+		formats = append(formats, fmt.Sprintf("Dolby Vision profile %d", dv.DvProfile))
+	}
+	if s.isHdr10Plus() {
+		formats = append(formats, "HDR10+")
+	}
+	if s.ColorTransfer == transferPQ {
+		formats = append(formats, "HDR10")
+	}
+	if s.ColorTransfer == transferHLG {
+		formats = append(formats, "HLG")
+	}
+	return strings.Join(formats, ", ")
+}
+
+// keepHdr reports whether the stream should go through the 10-bit HEVC path when converted
+func (s *Stream) keepHdr() bool {
+	return s.isHdr() && !tonemapHdr
+}
+
+// masterDisplay formats mastering display metadata in the form x265 expects
+// G(x,y)B(x,y)R(x,y)WP(x,y)L(max,min)
+func (s *Stream) masterDisplay() string {
+	md := s.sideData(sideDataMastering)
+	if md == nil || md.RedX == "" || md.MaxLuminance == "" {
+		return ""
+	}
+	c := func(r string) int {
+		return int(math.Round(parseRational(r) * hdrChromaMultiplier))
+	}
+	l := func(r string) int {
+		return int(math.Round(parseRational(r) * hdrLumaMultiplier))
+	}
+	return fmt.Sprintf("G(%d,%d)B(%d,%d)R(%d,%d)WP(%d,%d)L(%d,%d)",
+		c(md.GreenX), c(md.GreenY), c(md.BlueX), c(md.BlueY), c(md.RedX), c(md.RedY),
+		c(md.WhitePointX), c(md.WhitePointY), l(md.MaxLuminance), l(md.MinLuminance))
+}
+func (s *Stream) maxCll() string {
+	cll := s.sideData(sideDataLightLevel)
+	if cll == nil || (cll.MaxContent == 0 && cll.MaxAverage == 0) {
+		return ""
+	}
+	return fmt.Sprintf("%d,%d", cll.MaxContent, cll.MaxAverage)
+}
+
+// hdrEncodeArgs returns the ffmpeg encoder arguments for the 10-bit HEVC path
+func (s *Stream) hdrEncodeArgs(crf int) []string {
+	primaries := s.ColorPrimaries
+	if primaries == "" {
+		primaries = "bt2020"
+	}
+	transfer := s.ColorTransfer
+	if !isAny(transfer, transferPQ, transferHLG) {
+		// dolby vision profile 5 and friends report no transfer, base layer is PQ
+		transfer = transferPQ
+	}
+	matrix := s.ColorSpace
+	if matrix == "" {
+		matrix = "bt2020nc"
+	}
+	params := []string{
+		"repeat-headers=1",
+		"colorprim=" + primaries,
+		"transfer=" + transfer,
+		"colormatrix=" + matrix,
+	}
+	if transfer == transferPQ {
+		params = append(params, "hdr10=1", "hdr10-opt=1")
+	}
+	if md := s.masterDisplay(); md != "" {
+		params = append(params, "master-display="+md)
+	}
+	if cll := s.maxCll(); cll != "" {
+		params = append(params, "max-cll="+cll)
+	}
+	return []string{"-c:v", "libx265", "-preset", "slow", "-crf", strconv.Itoa(crf), "-pix_fmt", "yuv420p10le",
+		"-color_primaries", primaries, "-color_trc", transfer, "-colorspace", matrix,
+		"-x265-params", strings.Join(params, ":")}
+}
+
+// hdrMkvmergeArgs returns the mkvmerge track options that carry HDR color metadata for an elementary stream
+func (s *Stream) hdrMkvmergeArgs() []string {
+	var args []string
+	add := func(opt, val string) {
+		args = append(args, opt, "0:"+val)
+	}
+	// matroska uses the ISO/IEC 23091-4 code points
+	primaries := map[string]string{"bt709": "1", "bt2020": "9"}
+	transfers := map[string]string{"bt709": "1", transferPQ: "16", transferHLG: "18"}
+	matrices := map[string]string{"bt709": "1", "bt2020nc": "9", "bt2020c": "10"}
+	if v, ok := primaries[s.ColorPrimaries]; ok {
+		add("--colour-primaries", v)
+	}
+	if v, ok := transfers[s.ColorTransfer]; ok {
+		add("--colour-transfer-characteristics", v)
+	}
+	if v, ok := matrices[s.ColorSpace]; ok {
+		add("--colour-matrix-coefficients", v)
+	}
+	if s.ColorRange == "tv" {
+		add("--colour-range", "1")
+	} else if s.ColorRange == "pc" {
+		add("--colour-range", "2")
+	}
+	if md := s.sideData(sideDataMastering); md != nil && md.RedX != "" {
+		f := func(r string) string {
+			return strconv.FormatFloat(parseRational(r), 'f', -1, 64)
+		}
+		add("--chromaticity-coordinates", strings.Join([]string{f(md.RedX), f(md.RedY), f(md.GreenX),
+			f(md.GreenY), f(md.BlueX), f(md.BlueY)}, ","))
+		add("--white-colour-coordinates", f(md.WhitePointX)+","+f(md.WhitePointY))
+		add("--max-luminance", f(md.MaxLuminance))
+		add("--min-luminance", f(md.MinLuminance))
+	}
+	if cll := s.sideData(sideDataLightLevel); cll != nil && (cll.MaxContent != 0 || cll.MaxAverage != 0) {
+		add("--max-content-light", strconv.Itoa(cll.MaxContent))
+		add("--max-frame-light", strconv.Itoa(cll.MaxAverage))
+	}
+	return args
+}
+
+// probeFrameSideData reads the side data attached to the first frame of the stream and adds any types not
+// already found on the stream. mastering display and HDR10+ metadata are frequently only present per frame.
+func probeFrameSideData(path string, s *Stream) {
+	var ff struct {
+		Frames []struct {
+			SideDataList []SideData `json:"side_data_list"`
+		} `json:"frames"`
+	}
+	cmd := exec.Command("ffprobe", "-v", "quiet", "-print_format", "json", "-select_streams",
+		strconv.Itoa(s.Index), "-read_intervals", "%+#1", "-show_frames", "-show_entries",
+		"frame=side_data_list", path)
+	output, e := cmd.Output()
+	if e != nil {
+		return
+	}
+	if json.Unmarshal(output, &ff) != nil {
+		return
+	}
+	for _, frame := range ff.Frames {
+		for _, sd := range frame.SideDataList {
+			if s.sideData(sd.SideDataType) == nil {
+				s.SideDataList = append(s.SideDataList, sd)
+			}
+		}
+	}
+}
+
+func parseRational(r string) float64 {
+	parts := strings.Split(r, "/")
+	n, e := strconv.ParseFloat(parts[0], 64)
+	if e != nil {
+		return 0
+	}
+	if len(parts) == 2 {
+		d, e := strconv.ParseFloat(parts[1], 64)
+		if e != nil || d == 0 {
+			return 0
+		}
+		return n / d
+	}
+	return n
+}
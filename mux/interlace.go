@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+/*
+	field order analysis
+		the field_order tag is often wrong (progressive content tagged tt, soft telecined dvd rips tagged progressive),
+		so video that is being converted is analysed with the ffmpeg idet filter over field_samples segments of
+		field_sample_frames frames spread through the file and classified as
+			progressive  no filter
+			interlaced   deinterlaced with yadif or bwdif (deinterlacer in mux.conf)
+			telecined    hard telecine, 2 combed frames in every 5 (3:2 pulldown) and no repeated fields. inverse
+			             telecine with fieldmatch and decimate back to the original frame rate
+		soft telecine, where the stream holds the original frames with flags to repeat fields, decodes to the
+		original frames already and is handled as progressive, so no frames are dropped.
+		if analysis is off or finds nothing, the field_order tag is used like before.
+		the mode can be forced for a file with field_override in mux.conf or for all files in a run with -field.
+*/
+
+const (
+	fieldProgressive = "progressive"
+	fieldInterlaced  = "interlaced"
+	fieldTelecined   = "telecined"
+)
+
+var (
+	fieldAnalysis     = true
+	fieldSamples      = 4
+	fieldSampleFrames = 500
+	deinterlacer      = "yadif"
+	fieldMode         string                // -field, applies to every file in the run
+	fieldOverrides    = map[string]string{} // field_override, by full path or file name
+	fieldModes        = []string{fieldProgressive, fieldInterlaced, fieldTelecined}
+)
+
+type IdetCount struct {
+	tff, bff, progressive, undetermined int
+	neither, top, bottom                int
+}
+
+func (ic *IdetCount) frames() int {
+	return ic.tff + ic.bff + ic.progressive
+}
+func (ic *IdetCount) interlacedRatio() float64 {
+	if ic.frames() == 0 {
+		return 0
+	}
+	return float64(ic.tff+ic.bff) / float64(ic.frames())
+}
+func (ic *IdetCount) repeatedRatio() float64 {
+	total := ic.neither + ic.top + ic.bottom
+	if total == 0 {
+		return 0
+	}
+	return float64(ic.top+ic.bottom) / float64(total)
+}
+
+// threeTwo reports whether the interlaced frames follow the 3:2 pattern of hard telecine, 2 interlaced frames in
+// every 5 with next to no repeated fields
+func (ic *IdetCount) threeTwo() bool {
+	il := ic.interlacedRatio()
+	return il > 0.25 && il <= 0.6 && ic.repeatedRatio() < 0.05
+}
+
+// classify decides the field mode from the idet counts. hard telecine shows as 2 interlaced frames in every 5,
+// soft telecine as repeated fields on 2 frames in every 5.
+func (ic *IdetCount) classify() string {
+	il, rep := ic.interlacedRatio(), ic.repeatedRatio()
+	switch {
+	case rep > 0.2:
+		// soft telecine, the decoder already returns the original frames
+		return fieldProgressive
+	case il > 0.6:
+		return fieldInterlaced
+	case ic.threeTwo():
+		return fieldTelecined
+	case il > 0.1:
+		// mostly progressive with interlaced sections
+		return fieldInterlaced
+	}
+	return fieldProgressive
+}
+
+// fieldOverride returns the mode forced for the job with -field or field_override, or ""
+func (j *Job) fieldOverride() string {
+	if m, ok := fieldOverrides[j.video]; ok {
+		return m
+	}
+	if m, ok := fieldOverrides[filepath.Base(j.video)]; ok {
+		return m
+	}
+	return fieldMode
+}
+
+// analyzeFields sets the field mode of a video stream that is about to be converted
+func (j *Job) analyzeFields(s *Stream) {
+	if s.fieldMode != "" {
+		return
+	}
+	if m := j.fieldOverride(); m != "" {
+		s.fieldMode = m
+		j.record("video stream %d field mode set to %s by override", s.Index, m)
+		return
+	}
+	tagged := fieldProgressive
+	if !isAny(s.FieldOrder, "progressive", "unknown", "") {
+		tagged = fieldInterlaced
+	}
+	if !fieldAnalysis {
+		s.fieldMode = tagged
+		return
+	}
+
+	p("analysing field order of video stream %d", s.Index)
+	ic, e := idet(j.video, s.Index, j.duration())
+	if e == nil && ic.frames() == 0 {
+		e = errors.New("no frames analysed")
+	}
+	if e != nil {
+		p("field analysis failed, using field_order tag '%s': %s", s.FieldOrder, e)
+		s.fieldMode = tagged
+		return
+	}
+	s.fieldMode = ic.classify()
+	j.record("video stream %d analysed as %s (tff %d, bff %d, progressive %d, repeated fields %d of %d frames), "+
+		"field_order tag '%s'", s.Index, s.fieldMode, ic.tff, ic.bff, ic.progressive, ic.top+ic.bottom,
+		ic.neither+ic.top+ic.bottom, s.FieldOrder)
+}
+
+// idet runs the idet filter over samples spread through the file and adds up the counts
+func idet(path string, index int, d time.Duration) (*IdetCount, error) {
+	var ic IdetCount
+	reMulti := regexp.MustCompile(`Multi frame detection: TFF:\s*(\d+)\s+BFF:\s*(\d+)\s+Progressive:\s*(\d+)\s+Undetermined:\s*(\d+)`)
+	reRepeated := regexp.MustCompile(`Repeated Fields: Neither:\s*(\d+)\s+Top:\s*(\d+)\s+Bottom:\s*(\d+)`)
+	atoi := func(s string) int {
+		i, _ := strconv.Atoi(s)
+		return i
+	}
+
+	samples := fieldSamples
+	if d <= 0 || samples < 1 {
+		// unknown duration, analyse from the start
+		samples = 1
+	}
+	for n := 1; n <= samples; n++ {
+		var start time.Duration
+		if d > 0 {
+			start = d * time.Duration(n) / time.Duration(samples+1)
+		}
+		out, e := exec.Command("ffmpeg", "-hide_banner", "-nostats", "-ss", fmt.Sprintf("%.3f", start.Seconds()),
+			"-i", path, "-map", fmt.Sprintf("0:%d", index), "-frames:v", strconv.Itoa(fieldSampleFrames),
+			"-vf", "idet", "-an", "-sn", "-f", "null", "-").CombinedOutput()
+		if e != nil {
+			return &ic, e
+		}
+		if m := reMulti.FindStringSubmatch(string(out)); m != nil {
+			ic.tff += atoi(m[1])
+			ic.bff += atoi(m[2])
+			ic.progressive += atoi(m[3])
+			ic.undetermined += atoi(m[4])
+		}
+		if m := reRepeated.FindStringSubmatch(string(out)); m != nil {
+			ic.neither += atoi(m[1])
+			ic.top += atoi(m[2])
+			ic.bottom += atoi(m[3])
+		}
+	}
+	return &ic, nil
+}
+
+// fieldFilter returns the ffmpeg video filter for the stream's field mode, or ""
+func (s *Stream) fieldFilter() string {
+	switch s.fieldMode {
+	case fieldInterlaced:
+		return deinterlacer
+	case fieldTelecined:
+		// hard telecine only, from analysis or an override. fieldmatch rebuilds the progressive frames, frames it
+		// can't match are deinterlaced and decimate drops the duplicate frame in every 5
+		return fmt.Sprintf("fieldmatch,%s=deint=interlaced,decimate", deinterlacer)
+	}
+	return ""
+}
@@ -35,7 +35,10 @@ import (
             video not in one of the following formats
 				"h264", "hevc", "mpeg4"
 			subtitle in mov_text format
-		automatic problem handlers
+		subtitle normalization (see subtitles.go, configured in mux.conf)
+			ass/ssa converted to srt, html/ass styling removed, overlapping and negative timestamps fixed,
+			language detected from text when missing, image subtitles converted to srt with external ocr tool
+		automatic problem handlers (see remedy.go, more can be added in mux.conf)
 			all text subtitles converted to UTF-8 text encoding.
 			idx/sub subtitle
 				Warning: Unknown header [subtitle unusable, idx/sub moved to recycle]
@@ -47,8 +50,20 @@ import (
 				track contains X bytes of invalid data
 				No AC-3 header found in first frame
 					[All audio tracks demuxed from video stream and rewritten with corrupted portions of audio removed]
-			interlaced video
-				video deinterlaced during conversion with yadif video filter
+			interlaced and telecined video (see interlace.go, configured in mux.conf)
+				field order of converted video found with idet analysis, deinterlaced with yadif or bwdif or
+				hard telecine inverse telecined with fieldmatch and decimate
+			audio compatibility tracks (see audio.go, configured in mux.conf)
+				lossy stereo or 5.1 track added alongside truehd and dts-hd tracks, optionally loudness normalized
+			chapters, attachments and title (see metadata.go, configured in mux.conf)
+				chapters, fonts and cover art kept, other attachments, junk titles, track names and release group
+				tags dropped, chapters optionally generated, container title set from file name or TMDB
+			hdr video
+				HDR10, HLG and dolby vision video converted to 10-bit HEVC with mastering display metadata kept
+				only tone mapped to 8-bit SDR h264 if -sdr is specified
+
+		quality check (see quality.go, configured in mux.conf)
+			crf for converted video chosen by scoring sample encodes with vmaf, ssim or psnr against the source
 
 		optional external convert path
 			in scenarios where long conversion process would block other processing, an option is provided to move files
@@ -82,8 +97,16 @@ import (
 						mux -r -mc ~/_convert -rel /a/b/c/
 			-w	watch start path for new files. stay running and remux and convert files as they appear.
 				recommend using with -mf
+				files are tracked in a persistent queue (see queue.go), listed and edited with mux queue
+		audit
+			mux audit <library path> summarizes streams of every video in the library (see audit.go)
          -prob  -prob <path>
 				move files to this folder if they fail during remux or convert
+			-sdr	tone map HDR video to SDR when it needs conversion instead of converting to 10-bit HEVC
+			-field	-field <progressive|interlaced|telecined>
+				skip field analysis and treat all converted video as this. meant for use with -f
+			-conf	-conf <path to mux.conf>
+				load settings from this file instead of MUX_CONF or /etc/mux.conf
 */
 
 var (
@@ -101,6 +124,7 @@ var (
 	moveProb     bool
 	useRecycle   bool
 	force        bool
+	tonemapHdr   bool
 
 	exitOnError bool
 
@@ -140,9 +164,40 @@ var help = ` mux options:
             mux -r -mc ~/_convert -rel /a/b/c/
   -w	watch start path for new files. stay running and remux and convert files as they appear.
         recommend using with -mf
+        files are tracked in a persistent queue. a file is queued once its size and modified time stop changing,
+        finished files are skipped until they change, and failed files are retried with backoff until they are
+        parked after queue_max_attempts failures.
+  -queue -queue <path to queue file>
+        queue file used with -w. if not specified, queue_file from mux.conf or ~/.config/mux/queue.json is used
+
+ mux queue list [state]
+        list entries in the watch queue, optionally only those in state pending, queued, done, failed or parked
+ mux queue retry <path|all>
+        queue failed or parked files again with their attempt count reset
+ mux queue park <path>
+        stop watch mode from processing a file
+ mux queue remove <path>
+        forget a file. it is treated as a new file on the next scan
+ mux queue clear <state|all>
+        forget all entries in a state, or all entries
+
+ mux audit [-json <path>] [-cache <path>] [-t <threads>] <library path>
+        probe every video under library path and summarize codecs, missing english audio, missing subtitles,
+        non-standard track order, interlaced video and odd dimensions.
+        -json   write full report including file lists to this file. default mux_audit.json in current folder
+        -cache  probe cache keyed by path, size and modified time. default ~/.cache/mux/audit.json
+        -t      number of files to probe at once. default number of cpus
   -xe   exit on error. if unable to complete job, exit instead of proceeding with queue processing
   -prob -prob <path>
         move all files in job to this folder if there is a failure during remux or convert
+  -sdr  tone map HDR video to 8-bit SDR h264 when it needs conversion.
+        by default HDR video that needs conversion is converted to 10-bit HEVC with HDR metadata preserved
+  -field -field <progressive|interlaced|telecined>
+        skip field order analysis and treat video that needs conversion as progressive, interlaced or telecined.
+        telecined means hard telecine and drops 1 frame in every 5. meant for use with -f. use field_override in
+        mux.conf to set this for single files permanently
+  -conf -conf <path to mux.conf>
+        load settings from this file. if not specified, MUX_CONF environment variable or /etc/mux.conf is used
   -recycle
         -recycle <path to move files instead of deleting them>
         If specified, files will be moved to this folder instead of being deleted`
@@ -266,6 +321,35 @@ func getArgs() {
 	if isAny("-xe", args...) {
 		exitOnError = true
 	}
+	if isAny("-sdr", args...) {
+		tonemapHdr = true
+	}
+	if specifyField := arrayIdx(args, "-field"); specifyField != -1 {
+		if len(args) >= specifyField+2 && isAny(args[specifyField+1], fieldModes...) {
+			fieldMode = args[specifyField+1]
+		} else {
+			fmt.Println("must specify progressive, interlaced or telecined with -field.")
+			os.Exit(1)
+		}
+	}
+	if specifyQueue := arrayIdx(args, "-queue"); specifyQueue != -1 {
+		if len(args) >= specifyQueue+2 {
+			queueFile, e = filepath.Abs(args[specifyQueue+1])
+			chkFatal(e)
+		} else {
+			fmt.Println("must specify path with -queue.")
+			os.Exit(1)
+		}
+	}
+	if specifyConf := arrayIdx(args, "-conf"); specifyConf != -1 {
+		if len(args) >= specifyConf+2 {
+			confFile, e = filepath.Abs(args[specifyConf+1])
+			chkFatal(e)
+		} else {
+			fmt.Println("must specify path with -conf.")
+			os.Exit(1)
+		}
+	}
 	if isAny("-r", args...) {
 		argR = true
 	}
@@ -382,23 +466,16 @@ func (m *Muxer) start() {
 	m.doJobs()
 }
 func (m *Muxer) getJobs() {
-	makeJob := func(vid string) {
-		j := Job{
-			video: vid,
-		}
-		j.filename = filepath.Base(j.video)
-		j.basename = strings.TrimSuffix(j.filename, filepath.Ext(j.filename))
-		j.ext = strings.ToLower(filepath.Ext(j.filename))
-		if j.ext != ".mkv" {
-			j.mux = true
-		}
-		j.baseWithPath = strings.TrimSuffix(vid, filepath.Ext(j.filename))
-		j.tmpVideo = j.baseWithPath + ".tmp.mkv"
-		j.finalVideo = j.baseWithPath + ".mkv"
-		m.jobs = append(m.jobs, &j)
+	for _, vid := range findVideos() {
+		m.jobs = append(m.jobs, newJob(vid))
 	}
+}
+
+// findVideos returns the file specified with -f, or all videos in start path, recursively if -r is set
+func findVideos() []string {
+	var videos []string
 	if argF {
-		makeJob(singleFile)
+		videos = append(videos, singleFile)
 	} else {
 		if !argR {
 			sp, e := os.Open(startPath)
@@ -409,7 +486,7 @@ func (m *Muxer) getJobs() {
 			chkFatal(e)
 			for _, f := range files {
 				if !f.IsDir() && isVideo(f.Name()) {
-					makeJob(filepath.Join(startPath, f.Name()))
+					videos = append(videos, filepath.Join(startPath, f.Name()))
 				}
 			}
 		} else {
@@ -418,7 +495,7 @@ func (m *Muxer) getJobs() {
 					return err
 				}
 				if !info.IsDir() && isVideo(p) {
-					makeJob(p)
+					videos = append(videos, p)
 				}
 				return nil
 			}
@@ -426,7 +503,22 @@ func (m *Muxer) getJobs() {
 			chkFatal(err)
 		}
 	}
-
+	return videos
+}
+func newJob(vid string) *Job {
+	j := Job{
+		video: vid,
+	}
+	j.filename = filepath.Base(j.video)
+	j.basename = strings.TrimSuffix(j.filename, filepath.Ext(j.filename))
+	j.ext = strings.ToLower(filepath.Ext(j.filename))
+	if j.ext != ".mkv" {
+		j.mux = true
+	}
+	j.baseWithPath = strings.TrimSuffix(vid, filepath.Ext(j.filename))
+	j.tmpVideo = j.baseWithPath + ".tmp.mkv"
+	j.finalVideo = j.baseWithPath + ".mkv"
+	return &j
 }
 func (m *Muxer) doJobs() {
 	for n, job := range m.jobs {
@@ -435,22 +527,30 @@ func (m *Muxer) doJobs() {
 		}
 		p("checking remux candidate: %s", job.video)
 		job.start()
+		job.printResult()
 	}
 }
 
 type Job struct {
-	video        string //   /x/a/b/c/file.ext
-	filename     string //   /x/a/b/c/file.ext -> file.ext
-	basename     string //   /x/a/b/c/file.ext -> file
-	ext          string //   /x/a/b/c/file.ext -> .ext
-	baseWithPath string //   /x/a/b/c/file.ext -> /x/a/b/c/file
-	tmpVideo     string //   /x/a/b/c/file.ext -> /x/a/b/c/file.tmp.mkv
-	finalVideo   string //   /x/a/b/c/file.ext -> /x/a/b/c/file.mkv
-	mux          bool   //	remux required for job
-	convert      bool   //	convert required for job
-	restarted    bool   //   job has been restarted
-	reStream     bool   //   job is restarted and needs streams refreshed
-	failed       bool   //  mark job failed for -xe exit on error
+	video        string   //   /x/a/b/c/file.ext
+	filename     string   //   /x/a/b/c/file.ext -> file.ext
+	basename     string   //   /x/a/b/c/file.ext -> file
+	ext          string   //   /x/a/b/c/file.ext -> .ext
+	baseWithPath string   //   /x/a/b/c/file.ext -> /x/a/b/c/file
+	tmpVideo     string   //   /x/a/b/c/file.ext -> /x/a/b/c/file.tmp.mkv
+	finalVideo   string   //   /x/a/b/c/file.ext -> /x/a/b/c/file.mkv
+	mux          bool     //	remux required for job
+	convert      bool     //	convert required for job
+	restarted    bool     //   job has been restarted
+	reStream     bool     //   job is restarted and needs streams refreshed
+	failed       bool     //  mark job failed for -xe exit on error
+	result       []string // fixes and decisions made during the job
+	tmpFiles     []string // files created or replaced during the job, removed when the job finishes
+	meta         Metadata // chapters, attachments, tags and title taken from the source
+
+	tags           map[string]string // global tags added by mux
+	remedyAttempts map[string]int    // times each remedy has been applied
+	restarts       int               // times the job has been restarted by a remedy
 
 	streams         []*Stream //	 all streams found for job, internal and external
 	vidStream       []*Stream //  video stream in primary main file
@@ -469,6 +569,7 @@ func (j *Job) start() {
 			p("failed to get streams for file: %s", j.video)
 
 			p("got error: %s", e)
+			j.failed = true
 			//if !j.reStream && strings.HasSuffix(strings.ToLower(j.video), ".mkv") {
 			//	p("fix needed: remux with ffmpeg")
 			//	e = j.remuxWithFfmpeg()
@@ -495,9 +596,11 @@ func (j *Job) start() {
 			return
 		}
 		j.streams = append(j.streams, j.findExternalSubs()...)
+		j.readMeta()
 	}
 
 	j.parseStreams()
+	j.checkMeta()
 	//j.printStreams()
 
 	if j.convert && moveConvert {
@@ -505,6 +608,8 @@ func (j *Job) start() {
 		j.move(moveConvertPath)
 	} else if j.mux || force {
 		j.convertStreams()
+		j.normalizeSubs()
+		j.prepareMeta()
 		j.buildCmdLine()
 		j.runJob()
 	} else if moveFinished {
@@ -517,6 +622,22 @@ func (j *Job) start() {
 	}
 }
 
+// record prints a fix or decision made for the job and keeps it for the job result
+func (j *Job) record(s string, i ...interface{}) {
+	msg := fmt.Sprintf(s, i...)
+	p(msg)
+	j.result = append(j.result, msg)
+}
+func (j *Job) printResult() {
+	if len(j.result) == 0 {
+		return
+	}
+	p("job result: %s", j.video)
+	for _, r := range j.result {
+		p("| %s", r)
+	}
+}
+
 func (j *Job) findExternalSubs() []*Stream {
 	src := strings.ToLower(j.basename)
 	var subStreams []*Stream
@@ -552,6 +673,7 @@ func (j *Job) findExternalSubs() []*Stream {
 				for _, stream := range streams {
 					stream.elementaryStream = path
 					stream.subFile = subFile
+					stream.external = true
 					subStreams = append(subStreams, stream)
 				}
 
@@ -606,6 +728,9 @@ func (j *Job) validateSub(path string) (error, string) {
 	return nil, subFile
 }
 func (j *Job) getStreams(path string) (error, []*Stream) {
+	return getStreams(path)
+}
+func getStreams(path string) (error, []*Stream) {
 	var ffStreams FfprobeStreams
 	cmd := exec.Command("ffprobe", "-v", "quiet", "-print_format", "json", "-show_streams", path)
 	output, e := cmd.Output()
@@ -620,6 +745,9 @@ func (j *Job) getStreams(path string) (error, []*Stream) {
 		if isAny(ffStreams.Streams[n].Tags.Language, "cmn", "yue") {
 			ffStreams.Streams[n].Tags.Language = "chi"
 		}
+		if ffStreams.Streams[n].isHdr() {
+			probeFrameSideData(path, &ffStreams.Streams[n])
+		}
 		streams = append(streams, &ffStreams.Streams[n])
 	}
 	return nil, streams
@@ -632,16 +760,29 @@ func (j *Job) parseStreams() {
 
 	for n, s := range j.streams {
 		if s.CodecType == "video" && !isAny(s.CodecName, "mjpeg", "bmp", "png") {
+			if s.isHdr() {
+				p("video stream is HDR: %s", s.hdrFormat())
+			}
 			if !isAny(s.CodecName, allowedVideo...) {
 				p("convert reason, video stream is '%s' ", s.CodecName)
 				s.convert = true
 				j.convert = true
-				s.elementaryStream = fmt.Sprintf("%s.%d.h264", j.baseWithPath, n)
+				ext := "h264"
+				if s.keepHdr() {
+					p("HDR video will be converted to 10-bit HEVC")
+					if s.isDolbyVision() || s.isHdr10Plus() {
+						p("dynamic HDR metadata can't be kept through conversion, only static HDR10 metadata is kept")
+					}
+					ext = "hevc"
+				} else if s.isHdr() {
+					p("-sdr is set, HDR video will be tone mapped to SDR")
+				}
+				s.elementaryStream = fmt.Sprintf("%s.%d.%s", j.baseWithPath, n, ext)
 				j.mux = true
 			}
 			j.vidStream = append(j.vidStream, s)
 		}
-		if s.CodecType == "audio" {
+		if s.CodecType == "audio" && !s.compat {
 			if !isAny(s.CodecName, allowedAudio...) {
 				p("convert reason, audio stream is '%s' ", s.CodecName)
 				s.convert = true
@@ -666,6 +807,7 @@ func (j *Job) parseStreams() {
 			}
 		}
 	}
+	j.addCompatAudio()
 
 	var allStreams []*Stream
 	for _, streams := range [][]*Stream{j.vidStream, j.audioStream, j.subStreamForced, j.subStream} {
@@ -697,20 +839,34 @@ func (j *Job) convertStreams() {
 				"-i", j.video, "-map", fmt.Sprintf("0:%d", s.Index)}
 
 			if s.CodecType == "video" {
-				if !isAny(s.FieldOrder, "progressive", "unknown", "") {
-					add("-vf", "yadif")
+				var filters []string
+				j.analyzeFields(s)
+				if f := s.fieldFilter(); f != "" {
+					filters = append(filters, f)
 				}
 				if s.Height%2 != 0 || s.Width%2 != 0 {
 					x := math.Ceil(float64(s.Width)/2) * 2
 					y := math.Ceil(float64(s.Height)/2) * 2
-					add("-vf", fmt.Sprintf("pad=%d:%d", int(x), int(y)))
+					filters = append(filters, fmt.Sprintf("pad=%d:%d", int(x), int(y)))
+				}
+				if s.isHdr() && !s.keepHdr() {
+					filters = append(filters, tonemapFilter)
+				}
+				if len(filters) > 0 {
+					add("-vf", strings.Join(filters, ","))
 				}
-				add("-c:v", "h264", "-preset", "slow", "-crf", "17", "-movflags", "+faststart", "-pix_fmt",
-					"yuv420p", s.elementaryStream)
+				if qualityCheck && s.crf == 0 {
+					j.qualityCrf(s, filters)
+				}
+				add(s.videoEncodeArgs(s.videoCrf())...)
+				add(s.elementaryStream)
 			}
 			if s.CodecType == "audio" {
 				sampleRate, _ := strconv.ParseInt(s.SampleRate, 10, 64)
-				if sampleRate < 44100 {
+				if s.compat {
+					add(s.compatArgs()...)
+					add(s.elementaryStream)
+				} else if sampleRate < 44100 {
 					add("-c:a", "ac3", s.elementaryStream)
 				} else {
 					add("-c:a", "eac3", s.elementaryStream)
@@ -730,6 +886,15 @@ func (j *Job) convertStreams() {
 		}
 	}
 }
+
+// videoEncodeArgs returns the ffmpeg encoder arguments for converted video
+func (s *Stream) videoEncodeArgs(crf int) []string {
+	if s.keepHdr() {
+		return s.hdrEncodeArgs(crf)
+	}
+	return []string{"-c:v", "h264", "-preset", "slow", "-crf", strconv.Itoa(crf), "-movflags", "+faststart",
+		"-pix_fmt", "yuv420p"}
+}
 func (j *Job) buildCmdLine() {
 	cmd := []string{"mkvmerge", "--abort-on-warnings", "-o", j.tmpVideo}
 	add := func(str ...string) {
@@ -739,36 +904,67 @@ func (j *Job) buildCmdLine() {
 	}
 	for _, s := range j.vidStream {
 		if s.elementaryStream != "" {
+			if s.keepHdr() {
+				add(s.hdrMkvmergeArgs()...)
+			}
 			add(s.elementaryStream)
 		} else {
+			add(j.trackArgs(s.Index)...)
 			add("-A", "-S", "-d", fmt.Sprintf("%d", s.Index), j.video)
 		}
 	}
 
 	for _, s := range j.audioStream {
 		if s.elementaryStream != "" {
+			if s.compat {
+				add("--track-name", fmt.Sprintf("0:%s", compatFormats[s.compatFormat].title(s.Channels)))
+				add("--default-track-flag", "0:no")
+			} else if s.Tags.Title != "" {
+				add("--track-name", fmt.Sprintf("0:%s", s.Tags.Title))
+			}
 			if s.Tags.Language == "" {
 				add(s.elementaryStream)
 			} else {
 				add("--language", fmt.Sprintf("0:%s", s.Tags.Language), s.elementaryStream)
 			}
 		} else {
+			add(j.trackArgs(s.Index)...)
 			add("-S", "-D", "-a", fmt.Sprintf("%d", s.Index), j.video)
 		}
 	}
-	allSubs := append(j.subStreamForced, j.subStreamForced...)
+	// forced subtitles first, then the rest. this used to list the forced ones twice and drop every other subtitle
+	allSubs := append(append([]*Stream{}, j.subStreamForced...), j.subStream...)
 
 	for _, s := range allSubs {
 		if s.elementaryStream != "" {
+			if !s.external {
+				// elementary streams of source tracks keep the name and flags they had in the source
+				if s.Tags.Title != "" && !j.meta.junkNames[s.Index] {
+					add("--track-name", fmt.Sprintf("0:%s", s.Tags.Title))
+				}
+				if s.Disposition.Default == 1 {
+					add("--default-track-flag", "0:yes")
+				} else {
+					add("--default-track-flag", "0:no")
+				}
+			}
+			if s.Disposition.Forced == 1 {
+				add("--forced-display-flag", "0:yes")
+			}
 			if s.Tags.Language == "" {
 				add(s.elementaryStream)
 			} else {
 				add("--language", fmt.Sprintf("0:%s", s.Tags.Language), s.elementaryStream)
 			}
 		} else {
+			if s.Tags.Language != "" {
+				add("--language", fmt.Sprintf("%d:%s", s.Index, s.Tags.Language))
+			}
+			add(j.trackArgs(s.Index)...)
 			add("-D", "-A", "-s", fmt.Sprintf("%d", s.Index), j.video)
 		}
 	}
+	add(j.metaArgs()...)
 	j.cmdLine = cmd
 }
 func (j *Job) printStreams() {
@@ -912,72 +1108,20 @@ func (j *Job) runJob() {
 						}
 					}
 				}
+				for _, f := range j.tmpFiles {
+					if fileExists(f) {
+						p("removing temporary file: %s", f)
+						e := removeFile(f)
+						chk(e)
+					}
+				}
 			} else {
 				j.failed = true
 			}
 		}
 	} else {
 		p("remux failed for '%s'", j.video)
-
-		trackRequestedNotFound := regexp.MustCompile(`A track with the ID \d+ was requested but not found in the file. The corresponding option will be ignored.`)
-		if trackRequestedNotFound.MatchString(w.warning) && isVideo(w.filename) {
-			p("fix needed: remux with ffmpeg")
-			e := j.remuxWithFfmpeg()
-			if e == nil {
-				restart = true
-			} else {
-				chk(e)
-			}
-		}
-
-		qtReaderNoChunk := regexp.MustCompile(`Quicktime/MP4 reader: Could not read chunk number \d+/\d+ with size \d+ from position \d+. Aborting.`)
-		if qtReaderNoChunk.MatchString(w.warning) {
-			p("failed to read corrupt video file: %s", j.video)
-			j.failed = true
-		}
-
-		noHeaderAtoms := "Have not found any header atoms"
-		if strings.Contains(w.warning, noHeaderAtoms) {
-			p("fix needed: remux with ffmpeg")
-			e := j.remuxWithFfmpeg()
-			if e == nil {
-				restart = true
-			} else {
-				chk(e)
-			}
-		}
-
-		matroskaFileStructure := "Error in the Matroska file structure at position"
-		if strings.Contains(w.warning, matroskaFileStructure) {
-			p("fix needed: rewrite mkv container")
-			e := j.rewriteMkvContainer()
-			if e == nil {
-				restart = true
-			} else {
-				chk(e)
-			}
-		}
-
-		invalidChars := "text subtitle track contains invalid 8-bit characters"
-		if strings.Contains(w.warning, invalidChars) && isVideo(w.filename) {
-			p("fix needed: extract all internal subtitles")
-			j.extractSubs()
-			restart = true
-		}
-
-		audioInvalidData := regexp.MustCompile(`audio track contains \d+ bytes of invalid data`)
-		if audioInvalidData.MatchString(w.warning) && isVideo(w.filename) {
-			p("fix needed: extract all internal audio streams")
-			j.extractAudio(true)
-			restart = true
-		}
-
-		noAc3Header := "No AC-3 header found in first frame"
-		if strings.Contains(w.warning, noAc3Header) && isVideo(w.filename) {
-			p("fix needed: extract all internal audio streams")
-			j.extractAudio(true)
-			restart = true
-		}
+		restart = j.remedy(w)
 
 		_, err := os.Stat(j.tmpVideo)
 		if !errors.Is(err, os.ErrNotExist) {
@@ -1007,8 +1151,9 @@ func (j *Job) runJob() {
 func (j *Job) move(path string) {
 	files := []string{j.video}
 	for _, s := range j.streams {
-		files = append(files, s.elementaryStream)
+		files = append(files, s.elementaryStream, s.subFile)
 	}
+	files = append(files, j.tmpFiles...)
 	for _, f := range files {
 		if !fileExists(f) {
 			continue
@@ -1198,28 +1343,55 @@ type Stream struct {
 	converted        bool
 	subFile          string
 	elementaryStream string
-	Width            int    `json:"width"`
-	Height           int    `json:"height"`
-	CodecName        string `json:"codec_name"`
-	CodecType        string `json:"codec_type"`
-	FieldOrder       string `json:"field_order"`
-	SampleRate       string `json:"sample_rate"`
+	normalized       bool
+	external         bool       // subtitle file next to the video
+	compat           bool       // compatibility track added by mux
+	compatFormat     string     // key in compatFormats
+	compatSource     *Stream    // stream the compatibility track is encoded from
+	fieldMode        string     // progressive, interlaced or telecined, from analysis or override
+	crf              int        // crf chosen by the quality check, 0 for the default
+	Width            int        `json:"width"`
+	Height           int        `json:"height"`
+	CodecName        string     `json:"codec_name"`
+	CodecType        string     `json:"codec_type"`
+	FieldOrder       string     `json:"field_order"`
+	SampleRate       string     `json:"sample_rate"`
+	Channels         int        `json:"channels"`
+	ChannelLayout    string     `json:"channel_layout"`
+	Profile          string     `json:"profile"`
+	PixFmt           string     `json:"pix_fmt"`
+	ColorRange       string     `json:"color_range"`
+	ColorSpace       string     `json:"color_space"`
+	ColorTransfer    string     `json:"color_transfer"`
+	ColorPrimaries   string     `json:"color_primaries"`
+	SideDataList     []SideData `json:"side_data_list"`
 	Disposition      struct {
 		Default int `json:"default"`
 		Forced  int `json:"forced"`
 	} `json:"disposition"`
 	Tags struct {
 		Language string `json:"language"`
+		Title    string `json:"title"`
 	} `json:"tags"`
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "queue" {
+		queueCmd(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		auditCmd(os.Args[2:])
+		return
+	}
 	getArgs()
+	loadConfig()
 	var m Muxer
 	if argW {
 		p("starting watcher. scanning for new files every 60 seconds")
+		q := NewQueue(queueFile)
 		for {
-			m.start()
+			m.watch(q)
 			time.Sleep(60 * time.Second)
 		}
 	} else {
@@ -1238,6 +1410,7 @@ var (
 	fileExists     = base.FileExists
 	isAny          = base.IsAny
 	mvFile         = base.MvFile
+	humanSize      = base.HumanSize
 )
 
 type Warning struct {
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	chapters, attachments and container metadata
+		each track is taken from the source with --no-chapters --no-attachments --no-global-tags, and chapters,
+		attachments and global tags are taken once from the source with a separate metadata-only input.
+			chapters      kept. if the source has none and chapter_interval is set, chapters are generated every
+			              chapter_interval minutes
+			attachments   fonts (needed by ass subtitles) and cover art are kept, anything else (nfo, txt, jpgs
+			              from release groups) is dropped
+			global tags   kept, except tags named in junk_tag or with values matching junk_title. tags added by
+			              mux (quality check results) are written with them
+			title         source title is kept unless it matches junk_title (urls, codec and resolution tags).
+			              missing or junk titles are replaced according to title_source
+			                filename  title from the file name [default]
+			                tmdb      title and year from a TMDB lookup of the file name, filename if not found.
+			                          needs tmdb_key in mux.conf or TMDB_KEY environment variable
+			                none      no title
+			track names   names matching junk_title are removed
+		junk titles, junk track names, unwanted attachments and missing chapters (with chapter_interval set) are
+		remux reasons. title_source is only applied when the file is remuxed for some reason.
+*/
+
+var (
+	chapterInterval int
+	titleSource     = "filename"
+	tmdbKey         string
+	junkTitles      = []*regexp.Regexp{
+		// only urls and codec and resolution tags, which real titles don't have. release groups go in junk_title
+		regexp.MustCompile(`(?i)(www\.|https?://|\.(com|net|org|to|me|cc)\b)`),
+		regexp.MustCompile(`(?i)\b(x26[45]|h\.?26[45]|hevc|xvid|divx|bluray|blu-ray|web-?dl|webrip|hdtv|dvdrip|brrip|remux)\b`),
+		regexp.MustCompile(`(?i)\b(480|576|720|1080|2160)[pi]\b`),
+	}
+	junkTags = []string{"RELEASE_GROUP", "RIPPED_BY", "ENCODED_BY", "URL", "PURL", "COMMENT"}
+)
+
+type MkvIdentify struct {
+	Attachments []MkvAttachment `json:"attachments"`
+	Chapters    []struct {
+		NumEntries int `json:"num_entries"`
+	} `json:"chapters"`
+	GlobalTags []struct {
+		NumEntries int `json:"num_entries"`
+	} `json:"global_tags"`
+	Container struct {
+		Properties struct {
+			Title    string `json:"title"`
+			Duration int64  `json:"duration"`
+		} `json:"properties"`
+	} `json:"container"`
+	Tracks []struct {
+		Id         int    `json:"id"`
+		Type       string `json:"type"`
+		Properties struct {
+			TrackName string `json:"track_name"`
+		} `json:"properties"`
+	} `json:"tracks"`
+}
+type MkvAttachment struct {
+	Id          int    `json:"id"`
+	FileName    string `json:"file_name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+func (a MkvAttachment) isFont() bool {
+	ct := strings.ToLower(a.ContentType)
+	ext := strings.ToLower(filepath.Ext(a.FileName))
+	return strings.Contains(ct, "font") || strings.Contains(ct, "truetype") || strings.Contains(ct, "opentype") ||
+		isAny(ext, ".ttf", ".otf", ".ttc")
+}
+func (a MkvAttachment) isCover() bool {
+	name := strings.ToLower(a.FileName)
+	return strings.HasPrefix(strings.ToLower(a.ContentType), "image/") &&
+		(strings.HasPrefix(name, "cover") || strings.HasPrefix(name, "small_cover"))
+}
+
+// Metadata is what the job takes from the source besides tracks
+type Metadata struct {
+	info        *MkvIdentify
+	title       string // title written with --title
+	attachments []int  // ids of attachments to keep
+	chapterFile string // generated chapters, used when the source has none
+	tagsFile    string // global tags with junk removed, used when junk tags were found
+	junkNames   map[int]bool
+	prepared    bool
+}
+
+func identify(path string) (*MkvIdentify, error) {
+	out, e := exec.Command("mkvmerge", "-J", path).Output()
+	if e != nil {
+		return nil, e
+	}
+	var info MkvIdentify
+	e = json.Unmarshal(out, &info)
+	if e != nil {
+		return nil, e
+	}
+	return &info, nil
+}
+
+func isJunkTitle(s string) bool {
+	for _, re := range junkTitles {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// readMeta reads chapters, attachments, title and track names from the source with mkvmerge -J
+func (j *Job) readMeta() {
+	j.meta = Metadata{junkNames: make(map[int]bool)}
+	info, e := identify(j.video)
+	if e != nil {
+		p("could not read container metadata, chapters and attachments will not be checked: %s", e)
+		return
+	}
+	j.meta.info = info
+}
+
+// checkMeta finds junk metadata and missing chapters and marks the job for remux if anything needs changing
+func (j *Job) checkMeta() {
+	info := j.meta.info
+	if info == nil {
+		return
+	}
+	if t := info.Container.Properties.Title; t != "" && isJunkTitle(t) {
+		p("remux reason, junk container title: %s", t)
+		j.mux = true
+	}
+	j.meta.attachments = nil
+	for _, a := range info.Attachments {
+		if a.isFont() || a.isCover() {
+			j.meta.attachments = append(j.meta.attachments, a.Id)
+		} else {
+			p("remux reason, unwanted attachment: %s (%s)", a.FileName, a.ContentType)
+			j.mux = true
+		}
+	}
+	for _, t := range info.Tracks {
+		if t.Properties.TrackName != "" && isJunkTitle(t.Properties.TrackName) {
+			p("remux reason, junk %s track name: %s", t.Type, t.Properties.TrackName)
+			j.meta.junkNames[t.Id] = true
+			j.mux = true
+		}
+	}
+	if chapterInterval > 0 && len(info.Chapters) == 0 &&
+		j.duration() > time.Duration(chapterInterval)*time.Minute {
+		p("remux reason, no chapters")
+		j.mux = true
+	}
+}
+
+// prepareMeta works out the title and writes the generated chapter and filtered tag files for the remux
+func (j *Job) prepareMeta() {
+	if j.meta.prepared {
+		return
+	}
+	j.meta.prepared = true
+	info := j.meta.info
+	if info == nil {
+		// the tags added by mux don't need the source metadata
+		j.filterGlobalTags()
+		return
+	}
+	j.meta.title = info.Container.Properties.Title
+	if j.meta.title == "" || isJunkTitle(j.meta.title) {
+		old := j.meta.title
+		j.meta.title = j.newTitle()
+		if j.meta.title != "" {
+			if old == "" {
+				j.record("set container title: %s", j.meta.title)
+			} else {
+				j.record("replaced junk container title '%s' with '%s'", old, j.meta.title)
+			}
+		} else if old != "" {
+			j.record("removed junk container title: %s", old)
+		}
+	}
+	if n := len(info.Attachments) - len(j.meta.attachments); n > 0 {
+		j.record("dropped %d attachments that are not fonts or cover art", n)
+	}
+	for id := range j.meta.junkNames {
+		j.record("removed junk name from track %d", id)
+	}
+
+	if chapterInterval > 0 && len(info.Chapters) == 0 {
+		if d := j.duration(); d > time.Duration(chapterInterval)*time.Minute {
+			j.meta.chapterFile = j.baseWithPath + ".chapters.txt"
+			e := writeChapters(j.meta.chapterFile, d, time.Duration(chapterInterval)*time.Minute)
+			if e != nil {
+				p("could not write chapters: %s", e)
+				j.meta.chapterFile = ""
+			} else {
+				j.tmpFiles = append(j.tmpFiles, j.meta.chapterFile)
+				j.record("generated chapters every %d minutes", chapterInterval)
+			}
+		}
+	}
+
+	j.filterGlobalTags()
+}
+
+// newTitle returns the title used when the source has no title or a junk title, according to title_source
+func (j *Job) newTitle() string {
+	title, year := nameYear(j.basename)
+	name := title
+	if year != "" {
+		name = fmt.Sprintf("%s (%s)", title, year)
+	}
+	switch titleSource {
+	case "none":
+		return ""
+	case "tmdb":
+		if t := tmdbTitle(title, year); t != "" {
+			return t
+		}
+		p("no TMDB match for '%s', using title from file name", title)
+	}
+	return name
+}
+
+// nameYear cleans a file name into a title and year, cutting scene style names at the year or the first junk word
+func nameYear(basename string) (title, year string) {
+	name := strings.TrimSpace(regexp.MustCompile(`[._]+`).ReplaceAllString(basename, " "))
+	reTitleYear := regexp.MustCompile(`^(.+) \((\d{4})\)`)
+	if m := reTitleYear.FindStringSubmatch(name); m != nil {
+		return strings.TrimSpace(m[1]), m[2]
+	}
+	reYear := regexp.MustCompile(`^(.+?)\s*[(\[]?((?:19|20)\d{2})[)\]]?(\s|$)`)
+	if m := reYear.FindStringSubmatch(name); m != nil {
+		return strings.TrimSpace(m[1]), m[2]
+	}
+	cut := len(name)
+	for _, re := range junkTitles {
+		if loc := re.FindStringIndex(name); loc != nil && loc[0] > 0 && loc[0] < cut {
+			cut = loc[0]
+		}
+	}
+	return strings.Trim(name[:cut], " -"), ""
+}
+
+type tmdbResults struct {
+	Results []struct {
+		Title       string `json:"title"`
+		ReleaseDate string `json:"release_date"`
+	} `json:"results"`
+}
+
+// tmdbTitle looks up a movie title on TMDB and returns "Title (Year)" for the first match
+func tmdbTitle(title, year string) string {
+	key := tmdbKey
+	if key == "" {
+		key = os.Getenv("TMDB_KEY")
+	}
+	if key == "" {
+		p("title_source is tmdb but no key found in tmdb_key or TMDB_KEY env var")
+		return ""
+	}
+	req, e := http.NewRequest("GET", "https://api.themoviedb.org/3/search/movie", nil)
+	if e != nil {
+		chk(e)
+		return ""
+	}
+	q := req.URL.Query()
+	q.Add("api_key", key)
+	q.Add("query", title)
+	if year != "" {
+		q.Add("year", year)
+	}
+	req.URL.RawQuery = q.Encode()
+	client := http.Client{Timeout: 15 * time.Second}
+	rsp, e := client.Do(req)
+	if e != nil {
+		chk(e)
+		return ""
+	}
+	defer rsp.Body.Close()
+	body, e := io.ReadAll(rsp.Body)
+	if e != nil {
+		chk(e)
+		return ""
+	}
+	var trs tmdbResults
+	e = json.Unmarshal(body, &trs)
+	if e != nil || len(trs.Results) == 0 {
+		return ""
+	}
+	r := trs.Results[0]
+	if len(r.ReleaseDate) >= 4 {
+		return fmt.Sprintf("%s (%s)", r.Title, r.ReleaseDate[:4])
+	}
+	return r.Title
+}
+
+// duration of the source from mkvmerge, or ffprobe if mkvmerge doesn't report one
+func (j *Job) duration() time.Duration {
+	if j.meta.info != nil && j.meta.info.Container.Properties.Duration > 0 {
+		return time.Duration(j.meta.info.Container.Properties.Duration)
+	}
+	out, e := exec.Command("ffprobe", "-v", "quiet", "-show_entries", "format=duration", "-of", "csv=p=0",
+		j.video).Output()
+	if e != nil {
+		return 0
+	}
+	secs, e := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if e != nil {
+		return 0
+	}
+	return time.Duration(secs * float64(time.Second))
+}
+
+// writeChapters writes an OGM style chapter file with a chapter every interval. a last chapter shorter than a
+// third of the interval is merged into the one before it.
+func writeChapters(path string, d, interval time.Duration) error {
+	var sb strings.Builder
+	n := 0
+	for t := time.Duration(0); t < d; t += interval {
+		if t > 0 && d-t < interval/3 {
+			break
+		}
+		n++
+		h := t / time.Hour
+		m := (t % time.Hour) / time.Minute
+		s := (t % time.Minute) / time.Second
+		sb.WriteString(fmt.Sprintf("CHAPTER%02d=%02d:%02d:%02d.000\n", n, h, m, s))
+		sb.WriteString(fmt.Sprintf("CHAPTER%02dNAME=Chapter %02d\n", n, n))
+	}
+	return os.WriteFile(path, []byte(sb.String()), 0644)
+}
+
+type mkvTags struct {
+	Tags []struct {
+		Targets struct {
+			Inner string `xml:",innerxml"`
+		} `xml:"Targets"`
+		Simple []struct {
+			Name   string `xml:"Name"`
+			String string `xml:"String"`
+			Inner  string `xml:",innerxml"`
+		} `xml:"Simple"`
+	} `xml:"Tag"`
+}
+
+// filterGlobalTags writes a tags file that replaces the source's global tags if any global tag is junk or mux has
+// tags of its own to add. track tags stay with their tracks.
+func (j *Job) filterGlobalTags() {
+	var kept, dropped []string
+	if j.meta.info != nil && len(j.meta.info.GlobalTags) > 0 {
+		kept, dropped = j.sourceGlobalTags()
+	}
+	if len(dropped) == 0 && len(j.tags) == 0 {
+		return
+	}
+	var names []string
+	for name := range j.tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var v strings.Builder
+		_ = xml.EscapeText(&v, []byte(j.tags[name]))
+		kept = append(kept, fmt.Sprintf("<Tag><Targets><TargetTypeValue>50</TargetTypeValue></Targets>"+
+			"<Simple><Name>%s</Name><String>%s</String></Simple></Tag>", name, v.String()))
+	}
+
+	j.meta.tagsFile = j.baseWithPath + ".global_tags.xml"
+	xmlTags := "<?xml version=\"1.0\"?>\n<!DOCTYPE Tags SYSTEM \"matroskatags.dtd\">\n<Tags>\n" +
+		strings.Join(kept, "\n") + "\n</Tags>\n"
+	e := os.WriteFile(j.meta.tagsFile, []byte(xmlTags), 0644)
+	if e != nil {
+		chk(e)
+		j.meta.tagsFile = ""
+		return
+	}
+	j.tmpFiles = append(j.tmpFiles, j.meta.tagsFile)
+	if len(dropped) > 0 {
+		j.record("dropped junk global tags: %s", strings.Join(dropped, ", "))
+	}
+}
+
+// sourceGlobalTags extracts the tags from the source and returns the global tags to keep as xml and the names and
+// values of the junk tags left out
+func (j *Job) sourceGlobalTags() (kept, dropped []string) {
+	src := j.baseWithPath + ".tags.xml"
+	e := run("mkvextract", j.video, "tags", src)
+	if e != nil {
+		p("could not extract tags: %s", e)
+		return
+	}
+	j.tmpFiles = append(j.tmpFiles, src)
+	b, e := os.ReadFile(src)
+	if e != nil {
+		chk(e)
+		return
+	}
+	var tags mkvTags
+	e = xml.Unmarshal(b, &tags)
+	if e != nil {
+		p("could not parse tags: %s", e)
+		return
+	}
+	for _, tag := range tags.Tags {
+		// tags with a UID target belong to a track, chapter or attachment
+		if strings.Contains(tag.Targets.Inner, "UID>") {
+			continue
+		}
+		var simple []string
+		for _, s := range tag.Simple {
+			if isAny(strings.ToUpper(s.Name), junkTags...) || isJunkTitle(s.String) {
+				dropped = append(dropped, fmt.Sprintf("%s=%s", s.Name, s.String))
+				continue
+			}
+			simple = append(simple, fmt.Sprintf("<Simple>%s</Simple>", s.Inner))
+		}
+		if len(simple) == 0 {
+			continue
+		}
+		kept = append(kept, fmt.Sprintf("<Tag><Targets>%s</Targets>%s</Tag>", tag.Targets.Inner,
+			strings.Join(simple, "")))
+	}
+	return
+}
+
+// metaArgs returns the mkvmerge arguments for the metadata-only input and the global options for generated
+// chapters, tags and title
+func (j *Job) metaArgs() []string {
+	if j.meta.info == nil {
+		// couldn't identify the source, let mkvmerge carry what it can from the track inputs
+		if j.meta.tagsFile != "" {
+			return []string{"--global-tags", j.meta.tagsFile}
+		}
+		return nil
+	}
+	args := []string{"--title", j.meta.title}
+	if j.meta.chapterFile != "" {
+		args = append(args, "--chapters", j.meta.chapterFile)
+	}
+	if j.meta.tagsFile != "" {
+		args = append(args, "--global-tags", j.meta.tagsFile)
+	}
+	// only add the metadata input if there is something to take from it
+	info := j.meta.info
+	if len(info.Chapters) == 0 && len(j.meta.attachments) == 0 && (len(info.GlobalTags) == 0 || j.meta.tagsFile != "") {
+		return args
+	}
+	args = append(args, "-D", "-A", "-S", "-B", "--no-track-tags")
+	if j.meta.tagsFile != "" {
+		args = append(args, "--no-global-tags")
+	}
+	if len(j.meta.attachments) == 0 {
+		args = append(args, "--no-attachments")
+	} else {
+		var ids []string
+		for _, id := range j.meta.attachments {
+			ids = append(ids, strconv.Itoa(id))
+		}
+		args = append(args, "--attachments", strings.Join(ids, ","))
+	}
+	return append(args, j.video)
+}
+
+// trackArgs returns the options added before each track input taken from the source
+func (j *Job) trackArgs(id int) []string {
+	if j.meta.info == nil {
+		return nil
+	}
+	args := []string{"--no-chapters", "--no-attachments", "--no-global-tags"}
+	if j.meta.junkNames[id] {
+		args = append(args, "--track-name", fmt.Sprintf("%d:", id))
+	}
+	return args
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	quality check
+		optional check of converted video, configured in mux.conf. before the full encode, quality_samples samples of
+		quality_sample_seconds seconds are encoded and scored against the source with the same filters applied.
+		crf is binary searched between quality_crf_min and quality_crf_max for the highest crf (smallest file) that
+		still reaches quality_target, with at most quality_max_tries sample encodes per crf.
+			quality_metric  vmaf (needs ffmpeg built with libvmaf), ssim or psnr. default vmaf if available, else ssim
+			quality_target  score to reach. default vmaf 95, ssim 0.985, psnr 42
+		the chosen crf and score are kept in the job result and written to the output as global tags
+		MUX_QUALITY_METRIC, MUX_QUALITY_SCORE, MUX_QUALITY_TARGET and MUX_CRF.
+*/
+
+var (
+	qualityCheck         bool
+	qualityMetric        string
+	qualityTarget        float64
+	qualitySamples       = 3
+	qualitySampleSeconds = 10
+	qualityCrfMin        = 14
+	qualityCrfMax        = 28
+	qualityMaxTries      = 5
+	qualityMetrics       = []string{"vmaf", "ssim", "psnr"}
+	qualityDefaults      = map[string]float64{"vmaf": 95, "ssim": 0.985, "psnr": 42}
+	hasVmaf              *bool
+)
+
+// videoCrf returns the crf chosen by the quality check or the default crf for the encoder
+func (s *Stream) videoCrf() int {
+	if s.crf > 0 {
+		return s.crf
+	}
+	if s.keepHdr() {
+		return 18
+	}
+	return 17
+}
+
+// vmafAvailable reports whether ffmpeg was built with the libvmaf filter
+func vmafAvailable() bool {
+	if hasVmaf == nil {
+		out, _ := exec.Command("ffmpeg", "-hide_banner", "-filters").Output()
+		ok := regexp.MustCompile(`\slibvmaf\s`).Match(out)
+		hasVmaf = &ok
+	}
+	return *hasVmaf
+}
+
+func (j *Job) addTag(name, value string) {
+	if j.tags == nil {
+		j.tags = make(map[string]string)
+	}
+	j.tags[name] = value
+}
+
+// qualityCrf searches for the crf that reaches the quality target on samples and sets it on the stream
+func (j *Job) qualityCrf(s *Stream, filters []string) {
+	metric := qualityMetric
+	if metric == "" || (metric == "vmaf" && !vmafAvailable()) {
+		if metric == "vmaf" {
+			p("quality_metric is vmaf but ffmpeg has no libvmaf filter, using ssim")
+		}
+		metric = "ssim"
+		if qualityMetric == "" && vmafAvailable() {
+			metric = "vmaf"
+		}
+	}
+	target := qualityTarget
+	if target == 0 {
+		target = qualityDefaults[metric]
+	}
+	p("checking quality of video stream %d with %s, target %g", s.Index, metric, target)
+
+	scores := make(map[int]float64)
+	score := func(crf int) (float64, error) {
+		if sc, ok := scores[crf]; ok {
+			return sc, nil
+		}
+		sc, e := j.sampleScore(s, filters, crf, metric)
+		if e == nil {
+			p("crf %d: %s %.4f", crf, metric, sc)
+			scores[crf] = sc
+		}
+		return sc, e
+	}
+
+	lo, hi, best := qualityCrfMin, qualityCrfMax, 0
+	for try := 0; try < qualityMaxTries && lo <= hi; try++ {
+		crf := (lo + hi) / 2
+		sc, e := score(crf)
+		if e != nil {
+			p("quality check failed, using crf %d: %s", s.videoCrf(), e)
+			return
+		}
+		if sc >= target {
+			best = crf
+			lo = crf + 1
+		} else {
+			hi = crf - 1
+		}
+	}
+	if best == 0 {
+		best = qualityCrfMin
+		if _, e := score(best); e != nil {
+			p("quality check failed, using crf %d: %s", s.videoCrf(), e)
+			return
+		}
+		j.record("video stream %d did not reach %s %g at any crf tried, using crf %d", s.Index, metric, target,
+			best)
+	}
+	s.crf = best
+	j.record("video stream %d quality check: crf %d, %s %.4f (target %g)", s.Index, best, metric, scores[best],
+		target)
+	j.addTag("MUX_QUALITY_METRIC", metric)
+	j.addTag("MUX_QUALITY_SCORE", fmt.Sprintf("%.4f", scores[best]))
+	j.addTag("MUX_QUALITY_TARGET", fmt.Sprintf("%g", target))
+	j.addTag("MUX_CRF", strconv.Itoa(best))
+}
+
+// sampleScore encodes samples at crf and returns the average score against the filtered source
+func (j *Job) sampleScore(s *Stream, filters []string, crf int, metric string) (float64, error) {
+	length := time.Duration(qualitySampleSeconds) * time.Second
+	d := j.duration()
+	n := qualitySamples
+	if n < 1 || d <= length*time.Duration(n+1) {
+		n = 1
+	}
+	pixFmt := "yuv420p"
+	if s.keepHdr() {
+		pixFmt = "yuv420p10le"
+	}
+	pre := ""
+	if len(filters) > 0 {
+		pre = strings.Join(filters, ",") + ","
+	}
+	metricFilter := map[string]string{"vmaf": "libvmaf", "ssim": "ssim", "psnr": "psnr"}[metric]
+	reScore := map[string]*regexp.Regexp{
+		"vmaf": regexp.MustCompile(`VMAF score[:=]\s*([\d.]+)`),
+		"ssim": regexp.MustCompile(`SSIM .*All:([\d.]+)`),
+		"psnr": regexp.MustCompile(`PSNR .*average:([\d.]+|inf)`),
+	}[metric]
+
+	sample := j.baseWithPath + ".sample.mkv"
+	defer os.Remove(sample)
+	var total float64
+	for i := 1; i <= n; i++ {
+		var start time.Duration
+		if n > 1 {
+			start = d * time.Duration(i) / time.Duration(n+1)
+		}
+		ss := fmt.Sprintf("%.3f", start.Seconds())
+		t := fmt.Sprintf("%d", qualitySampleSeconds)
+
+		cmd := []string{"ffmpeg", "-hide_banner", "-loglevel", "error", "-y", "-ss", ss, "-t", t, "-i", j.video,
+			"-map", fmt.Sprintf("0:%d", s.Index)}
+		if len(filters) > 0 {
+			cmd = append(cmd, "-vf", strings.Join(filters, ","))
+		}
+		cmd = append(cmd, s.videoEncodeArgs(crf)...)
+		cmd = append(cmd, "-an", "-sn", sample)
+		e := run(cmd...)
+		if e != nil {
+			return 0, e
+		}
+
+		graph := fmt.Sprintf("[0:v]setpts=PTS-STARTPTS,format=%s[dist];[1:%d]%ssetpts=PTS-STARTPTS,format=%s[ref];"+
+			"[dist][ref]%s", pixFmt, s.Index, pre, pixFmt, metricFilter)
+		out, e := exec.Command("ffmpeg", "-hide_banner", "-nostats", "-i", sample, "-ss", ss, "-t", t, "-i",
+			j.video, "-lavfi", graph, "-f", "null", "-").CombinedOutput()
+		if e != nil {
+			return 0, fmt.Errorf("%s: %s", e, strings.TrimSpace(string(out)))
+		}
+		m := reScore.FindStringSubmatch(string(out))
+		if m == nil {
+			return 0, fmt.Errorf("no %s score in ffmpeg output", metric)
+		}
+		if m[1] == "inf" {
+			// identical frames
+			total += 100
+			continue
+		}
+		sc, e := strconv.ParseFloat(m[1], 64)
+		if e != nil {
+			return 0, e
+		}
+		total += sc
+	}
+	return total / float64(n), nil
+}
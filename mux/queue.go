@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+	watch queue
+		-w keeps every video it has seen in a queue file so files are only probed and muxed once.
+			pending  seen, still being written. queued once size and modified time are unchanged between two scans
+			         and the file hasn't been modified for queue_settle_seconds
+			queued   waiting to be muxed
+			done     muxed or didn't need muxing. skipped until the size or modified time changes
+			failed   job failed. queued again after queue_retry_minutes, doubling with every attempt
+			parked   failed queue_max_attempts times. skipped until retried with mux queue retry
+		entries for files that no longer exist are dropped on the next scan.
+		the queue file is re-read before every change so edits made with mux queue while a watcher is running are kept.
+		every read, change and save happens under a lock on queue file.lock, so watchers sharing the queue file and
+		mux queue never save over each other's changes.
+*/
+
+const (
+	statePending = "pending"
+	stateQueued  = "queued"
+	stateDone    = "done"
+	stateFailed  = "failed"
+	stateParked  = "parked"
+	maxBackoff   = 24 * time.Hour
+)
+
+var (
+	queueFile          string
+	queueMaxAttempts   = 5
+	queueRetryMinutes  = 10
+	queueSettleSeconds = 60
+	queueStates        = []string{statePending, stateQueued, stateDone, stateFailed, stateParked}
+)
+
+type QueueEntry struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	State    string    `json:"state"`
+	Attempts int       `json:"attempts"`
+	NextTry  time.Time `json:"next_try"`
+	Updated  time.Time `json:"updated"`
+	Result   []string  `json:"result,omitempty"`
+}
+
+// changed reports whether the file on disk no longer matches the size and modified time in the entry
+func (qe *QueueEntry) changed(st os.FileInfo) bool {
+	return st.Size() != qe.Size || !st.ModTime().Equal(qe.ModTime)
+}
+func (qe *QueueEntry) set(state string) {
+	qe.State = state
+	qe.Updated = time.Now()
+}
+
+type Queue struct {
+	file    string
+	Entries map[string]*QueueEntry `json:"entries"`
+}
+
+func NewQueue(file string) *Queue {
+	if file == "" {
+		dir, e := os.UserConfigDir()
+		chkFatal(e)
+		file = filepath.Join(dir, "mux", "queue.json")
+	}
+	q := Queue{file: file}
+	q.load()
+	return &q
+}
+func (q *Queue) load() {
+	q.Entries = make(map[string]*QueueEntry)
+	b, e := os.ReadFile(q.file)
+	if errors.Is(e, os.ErrNotExist) {
+		return
+	}
+	chkFatal(e)
+	e = json.Unmarshal(b, q)
+	if e != nil {
+		p("queue file %s is not valid, starting with empty queue: %s", q.file, e)
+		q.Entries = make(map[string]*QueueEntry)
+	}
+}
+
+// lock takes an exclusive lock on the queue until the returned func is called
+func (q *Queue) lock() func() {
+	e := os.MkdirAll(filepath.Dir(q.file), 0755)
+	chkFatal(e)
+	f, e := os.OpenFile(q.file+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	chkFatal(e)
+	e = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	chkFatal(e)
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		_ = f.Close()
+	}
+}
+func (q *Queue) save() {
+	e := os.MkdirAll(filepath.Dir(q.file), 0755)
+	chkFatal(e)
+	b, e := json.MarshalIndent(q, "", "  ")
+	chkFatal(e)
+	tmp := q.file + ".tmp"
+	e = os.WriteFile(tmp, b, 0644)
+	chkFatal(e)
+	e = os.Rename(tmp, q.file)
+	chkFatal(e)
+}
+
+// update re-reads the queue file, applies fn to the entry for path and saves the queue
+func (q *Queue) update(path string, fn func(qe *QueueEntry)) {
+	unlock := q.lock()
+	defer unlock()
+	q.load()
+	qe, ok := q.Entries[path]
+	if !ok {
+		qe = &QueueEntry{Path: path}
+		q.Entries[path] = qe
+	}
+	fn(qe)
+	q.save()
+}
+
+// scan adds new videos to the queue, moves stable files and failed files that are due for retry to queued, and
+// drops entries for files that are gone. returns the queued files under start path.
+func (q *Queue) scan(videos []string) []string {
+	unlock := q.lock()
+	defer unlock()
+	q.load()
+	now := time.Now()
+	settle := time.Duration(queueSettleSeconds) * time.Second
+
+	for _, vid := range videos {
+		st, e := os.Stat(vid)
+		if e != nil {
+			continue
+		}
+		qe, ok := q.Entries[vid]
+		if !ok {
+			p("new file found: %s", vid)
+			qe = &QueueEntry{Path: vid, Size: st.Size(), ModTime: st.ModTime()}
+			qe.set(statePending)
+			q.Entries[vid] = qe
+		}
+		switch qe.State {
+		case statePending:
+			if qe.changed(st) {
+				qe.Size, qe.ModTime = st.Size(), st.ModTime()
+				qe.Updated = now
+			} else if now.Sub(st.ModTime()) >= settle && now.Sub(qe.Updated) >= settle {
+				p("file is stable, queueing: %s", vid)
+				qe.set(stateQueued)
+			}
+		case stateDone, stateFailed, stateParked:
+			if qe.changed(st) {
+				p("file changed since it was last processed, watching it again: %s", vid)
+				qe.Size, qe.ModTime = st.Size(), st.ModTime()
+				qe.Attempts = 0
+				qe.Result = nil
+				qe.set(statePending)
+			} else if qe.State == stateFailed && now.After(qe.NextTry) {
+				p("retrying failed file, attempt %d of %d: %s", qe.Attempts+1, queueMaxAttempts, vid)
+				qe.set(stateQueued)
+			}
+		}
+	}
+
+	var queued []string
+	for path, qe := range q.Entries {
+		if !isWatched(path) {
+			continue
+		}
+		if !fileExists(path) {
+			delete(q.Entries, path)
+			continue
+		}
+		if qe.State == stateQueued {
+			queued = append(queued, path)
+		}
+	}
+	sort.Strings(queued)
+	q.save()
+	return queued
+}
+
+// finish records the outcome of a job for the file it was started with and for the mkv it produced
+func (q *Queue) finish(j *Job) {
+	q.update(j.video, func(qe *QueueEntry) {
+		qe.Result = j.result
+		if !j.failed {
+			qe.Attempts = 0
+			qe.set(stateDone)
+		} else {
+			qe.Attempts++
+			if qe.Attempts >= queueMaxAttempts {
+				p("job failed %d times, parking file: %s", qe.Attempts, j.video)
+				qe.set(stateParked)
+			} else {
+				backoff := time.Duration(queueRetryMinutes) * time.Minute << (qe.Attempts - 1)
+				if backoff > maxBackoff || backoff <= 0 {
+					backoff = maxBackoff
+				}
+				qe.NextTry = time.Now().Add(backoff)
+				p("job failed, retrying after %s: %s", qe.NextTry.Format(time.Stamp), j.video)
+				qe.set(stateFailed)
+			}
+		}
+		if st, e := os.Stat(j.video); e == nil {
+			qe.Size, qe.ModTime = st.Size(), st.ModTime()
+		}
+	})
+	if !j.failed && j.finalVideo != j.video {
+		if st, e := os.Stat(j.finalVideo); e == nil {
+			q.update(j.finalVideo, func(qe *QueueEntry) {
+				qe.Size, qe.ModTime = st.Size(), st.ModTime()
+				qe.Result = j.result
+				qe.set(stateDone)
+			})
+		}
+	}
+}
+
+// isWatched reports whether path is handled by this watcher, so entries from other watchers sharing the queue
+// file are left alone
+func isWatched(path string) bool {
+	if argF {
+		return path == singleFile
+	}
+	rel, e := filepath.Rel(startPath, path)
+	if e != nil || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	return argR || !strings.Contains(rel, string(filepath.Separator))
+}
+
+// watch runs one scan of the watch loop and muxes every queued file
+func (m *Muxer) watch(q *Queue) {
+	queued := q.scan(findVideos())
+	for n, vid := range queued {
+		if n > 0 {
+			fmt.Println("--------------------------------------------------")
+		}
+		job := newJob(vid)
+		p("checking remux candidate: %s", job.video)
+		job.start()
+		job.printResult()
+		q.finish(job)
+	}
+}
+
+func queueCmd(args []string) {
+	usage := func() {
+		fmt.Println(`mux queue [-queue <path>] [-conf <path>] <command>
+  list [state]          list entries, optionally only those in state pending, queued, done, failed or parked
+  retry <path|all>      queue failed or parked files again
+  park <path>           stop watch mode from processing a file
+  remove <path>         forget a file
+  clear <state|all>     forget all entries in a state, or all entries`)
+		os.Exit(1)
+	}
+	for _, opt := range []string{"-queue", "-conf"} {
+		if i := arrayIdx(args, opt); i != -1 {
+			if len(args) < i+2 {
+				fmt.Printf("must specify path with %s.\n", opt)
+				os.Exit(1)
+			}
+			v, e := filepath.Abs(args[i+1])
+			chkFatal(e)
+			if opt == "-queue" {
+				queueFile = v
+			} else {
+				confFile = v
+			}
+			args = append(args[:i], args[i+2:]...)
+		}
+	}
+	if len(args) == 0 {
+		usage()
+	}
+	loadConfig()
+	q := NewQueue(queueFile)
+	// held until the changes are saved, exiting releases it too
+	unlock := q.lock()
+	defer unlock()
+	q.load()
+
+	cmd, arg := args[0], ""
+	if len(args) > 1 {
+		arg = args[1]
+	}
+	// paths are stored absolute
+	path := arg
+	if arg != "" && arg != "all" && !isAny(arg, queueStates...) {
+		var e error
+		path, e = filepath.Abs(arg)
+		chkFatal(e)
+	}
+	entry := func() *QueueEntry {
+		qe, ok := q.Entries[path]
+		if !ok {
+			fmt.Printf("no queue entry for %s\n", path)
+			os.Exit(1)
+		}
+		return qe
+	}
+
+	switch cmd {
+	case "list":
+		if arg != "" && !isAny(arg, queueStates...) {
+			usage()
+		}
+		q.list(arg)
+	case "retry":
+		if arg == "" {
+			usage()
+		}
+		n := 0
+		for _, qe := range q.Entries {
+			if (arg == "all" && isAny(qe.State, stateFailed, stateParked)) || qe.Path == path {
+				qe.Attempts = 0
+				qe.NextTry = time.Time{}
+				qe.set(stateQueued)
+				n++
+			}
+		}
+		if n == 0 && arg != "all" {
+			entry()
+		}
+		fmt.Printf("queued %d files\n", n)
+	case "park":
+		if arg == "" {
+			usage()
+		}
+		entry().set(stateParked)
+		fmt.Printf("parked %s\n", path)
+	case "remove":
+		if arg == "" {
+			usage()
+		}
+		entry()
+		delete(q.Entries, path)
+		fmt.Printf("removed %s\n", path)
+	case "clear":
+		if arg != "all" && !isAny(arg, queueStates...) {
+			usage()
+		}
+		n := 0
+		for k, qe := range q.Entries {
+			if arg == "all" || qe.State == arg {
+				delete(q.Entries, k)
+				n++
+			}
+		}
+		fmt.Printf("removed %d entries\n", n)
+	default:
+		usage()
+	}
+	q.save()
+}
+func (q *Queue) list(state string) {
+	var entries []*QueueEntry
+	for _, qe := range q.Entries {
+		if state == "" || qe.State == state {
+			entries = append(entries, qe)
+		}
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].Path < entries[b].Path
+	})
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "STATE\tTRIES\tNEXT TRY\tUPDATED\tSIZE\tPATH")
+	for _, qe := range entries {
+		next := ""
+		if qe.State == stateFailed {
+			next = qe.NextTry.Format("Jan 02 15:04")
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", qe.State, qe.Attempts, next,
+			qe.Updated.Format("Jan 02 15:04"), humanSize(qe.Size), qe.Path)
+	}
+	_ = w.Flush()
+	fmt.Printf("%d entries in %s\n", len(entries), q.file)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+	remedies
+		when mkvmerge fails, the warning is matched against a list of remedies. the first remedy that matches and
+		hasn't used up its attempts is applied and the job is restarted.
+			remux_ffmpeg       remux the source with ffmpeg and read its streams again
+			rewrite_container  rewrite the source mkv with mkvmerge
+			extract_subs       extract internal subtitles to files and mux those instead
+			extract_audio      extract internal audio, dropping corrupt frames, and mux that instead
+			fail               give up on the file
+		remedies from mux.conf are checked before the built-in ones, so a built-in remedy can be replaced by adding
+		one with the same pattern.
+			remedy = <action> <max attempts> <regex matched against the mkvmerge warning>
+		a job is restarted at most remedy_max_restarts times, whatever remedies are used.
+*/
+
+type Remedy struct {
+	name        string
+	pattern     *regexp.Regexp
+	videoOnly   bool // only match warnings about the source video, not external files
+	action      string
+	maxAttempts int
+}
+
+var (
+	remedyActions = map[string]func(j *Job) (bool, error){
+		"remux_ffmpeg": func(j *Job) (bool, error) {
+			e := j.remuxWithFfmpeg()
+			return e == nil, e
+		},
+		"rewrite_container": func(j *Job) (bool, error) {
+			e := j.rewriteMkvContainer()
+			return e == nil, e
+		},
+		"extract_subs": func(j *Job) (bool, error) {
+			j.extractSubs()
+			return true, nil
+		},
+		"extract_audio": func(j *Job) (bool, error) {
+			j.extractAudio(true)
+			return true, nil
+		},
+		"fail": func(j *Job) (bool, error) {
+			return false, nil
+		},
+	}
+	builtinRemedies = []*Remedy{
+		{name: "track requested but not found", videoOnly: true, action: "remux_ffmpeg", maxAttempts: 1,
+			pattern: regexp.MustCompile(`A track with the ID \d+ was requested but not found in the file. The corresponding option will be ignored.`)},
+		{name: "corrupt quicktime chunk", action: "fail", maxAttempts: 1,
+			pattern: regexp.MustCompile(`Quicktime/MP4 reader: Could not read chunk number \d+/\d+ with size \d+ from position \d+. Aborting.`)},
+		{name: "no header atoms", action: "remux_ffmpeg", maxAttempts: 1,
+			pattern: regexp.MustCompile(regexp.QuoteMeta("Have not found any header atoms"))},
+		{name: "matroska file structure", action: "rewrite_container", maxAttempts: 1,
+			pattern: regexp.MustCompile(regexp.QuoteMeta("Error in the Matroska file structure at position"))},
+		{name: "invalid 8-bit characters", videoOnly: true, action: "extract_subs", maxAttempts: 1,
+			pattern: regexp.MustCompile(regexp.QuoteMeta("text subtitle track contains invalid 8-bit characters"))},
+		{name: "invalid audio data", videoOnly: true, action: "extract_audio", maxAttempts: 1,
+			pattern: regexp.MustCompile(`audio track contains \d+ bytes of invalid data`)},
+		{name: "no AC-3 header", videoOnly: true, action: "extract_audio", maxAttempts: 1,
+			pattern: regexp.MustCompile(regexp.QuoteMeta("No AC-3 header found in first frame"))},
+	}
+	confRemedies      []*Remedy
+	remedyMaxRestarts = 5
+)
+
+// parseRemedy parses the value of a remedy line in mux.conf
+func parseRemedy(v string) (*Remedy, error) {
+	f := strings.SplitN(v, " ", 3)
+	if len(f) != 3 {
+		return nil, fmt.Errorf("remedy must be '<action> <max attempts> <regex>'")
+	}
+	if _, ok := remedyActions[f[0]]; !ok {
+		return nil, fmt.Errorf("unknown remedy action: %s", f[0])
+	}
+	max, e := strconv.Atoi(f[1])
+	if e != nil || max < 1 {
+		return nil, fmt.Errorf("remedy max attempts must be a number above 0: %s", f[1])
+	}
+	re, e := regexp.Compile(strings.TrimSpace(f[2]))
+	if e != nil {
+		return nil, e
+	}
+	return &Remedy{name: re.String(), pattern: re, action: f[0], maxAttempts: max}, nil
+}
+
+func (r *Remedy) matches(w *Warning) bool {
+	if r.videoOnly && !isVideo(w.filename) {
+		return false
+	}
+	return r.pattern.MatchString(w.warning)
+}
+
+// remedy applies the first usable remedy for the warning and returns true if the job should be restarted
+func (j *Job) remedy(w *Warning) bool {
+	if j.restarts >= remedyMaxRestarts {
+		j.record("job restarted %d times, not trying any more remedies", j.restarts)
+		return false
+	}
+	if j.remedyAttempts == nil {
+		j.remedyAttempts = make(map[string]int)
+	}
+	for _, r := range append(append([]*Remedy{}, confRemedies...), builtinRemedies...) {
+		if !r.matches(w) {
+			continue
+		}
+		if j.remedyAttempts[r.name] >= r.maxAttempts {
+			p("remedy '%s' already used %d times, skipping", r.name, j.remedyAttempts[r.name])
+			continue
+		}
+		j.remedyAttempts[r.name]++
+		if r.action == "fail" {
+			j.record("remedy '%s': giving up on file", r.name)
+			return false
+		}
+		j.record("remedy '%s': %s", r.name, strings.ReplaceAll(r.action, "_", " "))
+		restart, e := remedyActions[r.action](j)
+		if e != nil {
+			chk(e)
+		}
+		if restart {
+			j.restarts++
+		}
+		return restart
+	}
+	p("no remedy found for warning: %s", w.warning)
+	return false
+}
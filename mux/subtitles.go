@@ -0,0 +1,535 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/*
+	subtitle normalization
+		runs on every subtitle stream of a job that is being remuxed, after streams have been converted.
+		internal subtitles are only extracted when one of the enabled steps needs the text, and only muxed from the
+		extracted file when the text changed.
+		settings come from mux.conf
+			sub_ass_to_srt       convert ass/ssa subtitles to srt
+			sub_strip_styling    remove html and ass override tags from srt subtitles
+			sub_fix_timing       drop or clamp negative timestamps, merge and trim overlapping entries [default off]
+			sub_detect_language  guess language from subtitle text when tag is missing or 'und' [default off]
+			sub_ocr_cmd          command to convert image subtitles (pgs, vobsub) to srt.
+			                     {in}, {out} and {lang} are replaced with the image subtitle, srt output and language
+			                     sub_ocr_cmd = pgsrip --language {lang} {in} {out}
+		every change is recorded in the job result
+*/
+
+var (
+	textSubCodecs  = []string{"subrip", "ass", "ssa", "mov_text", "text"}
+	assSubCodecs   = []string{"ass", "ssa"}
+	imageSubCodecs = []string{"hdmv_pgs_subtitle", "dvd_subtitle"}
+)
+
+type SrtEntry struct {
+	start, end time.Duration
+	lines      []string
+}
+
+func (j *Job) normalizeSubs() {
+	for _, s := range append(append([]*Stream{}, j.subStreamForced...), j.subStream...) {
+		if s.normalized {
+			continue
+		}
+		s.normalized = true
+		j.normalizeSub(s)
+	}
+}
+func (j *Job) normalizeSub(s *Stream) {
+	undefinedLang := isAny(s.Tags.Language, "", "und")
+
+	if isAny(s.CodecName, imageSubCodecs...) {
+		if len(subOcrCmd) > 0 {
+			j.ocrSub(s)
+		}
+		if !isAny(s.CodecName, imageSubCodecs...) {
+			j.normalizeSub(s)
+		}
+		return
+	}
+	if !isAny(s.CodecName, textSubCodecs...) {
+		return
+	}
+
+	isAss := isAny(s.CodecName, assSubCodecs...)
+	if isAss && subAssToSrt {
+		src := s.elementaryStream
+		if src == "" {
+			src = j.video
+		}
+		srt := fmt.Sprintf("%s.%d.srt", j.baseWithPath, s.Index)
+		cmd := []string{"ffmpeg", "-hide_banner", "-loglevel", "warning", "-y", "-i", src}
+		if s.elementaryStream == "" {
+			cmd = append(cmd, "-map", fmt.Sprintf("0:%d", s.Index))
+		}
+		cmd = append(cmd, "-c:s", "srt", srt)
+		printCmd(cmd)
+		e := run(cmd...)
+		if e != nil || !fileExists(srt) {
+			p("failed to convert %s subtitle stream %d to srt", s.CodecName, s.Index)
+			chk(e)
+		} else {
+			j.record("converted %s subtitle stream %d to srt", s.CodecName, s.Index)
+			j.replaceElementaryStream(s, srt)
+			s.CodecName = "subrip"
+			isAss = false
+		}
+	}
+
+	needText := (!isAss && (subFixTiming || subStripStyling)) || (undefinedLang && subDetectLang)
+	if !needText {
+		return
+	}
+
+	changed := false
+	if s.elementaryStream == "" {
+		ext := ".srt"
+		codec := "srt"
+		if isAss {
+			ext = ".ass"
+			codec = "ass"
+		}
+		elm := fmt.Sprintf("%s.%d%s", j.baseWithPath, s.Index, ext)
+		cmd := []string{"ffmpeg", "-hide_banner", "-loglevel", "warning", "-y", "-i", j.video,
+			"-map", fmt.Sprintf("0:%d", s.Index), "-c:s", codec, elm}
+		printCmd(cmd)
+		e := run(cmd...)
+		if e != nil || !fileExists(elm) {
+			p("failed to extract subtitle stream %d for normalization", s.Index)
+			chk(e)
+			return
+		}
+		s.elementaryStream = elm
+		srcCodec := s.CodecName
+		if !isAss {
+			s.CodecName = "subrip"
+		}
+		// a subtitle that was only read is copied from the source as before
+		defer func() {
+			if changed {
+				return
+			}
+			_ = os.Remove(elm)
+			s.elementaryStream = ""
+			s.CodecName = srcCodec
+		}()
+	}
+
+	var text []string
+	if isAss {
+		text = readAssText(s.elementaryStream)
+	} else {
+		entries, e := readSrt(s.elementaryStream)
+		if e != nil {
+			p("could not parse srt %s: %s", s.elementaryStream, e)
+			return
+		}
+		var fixes []string
+		if subFixTiming {
+			entries, fixes = fixSrtTiming(entries)
+		}
+		if subStripStyling {
+			var stripped int
+			entries, stripped = stripSrtStyling(entries)
+			if stripped > 0 {
+				fixes = append(fixes, fmt.Sprintf("removed styling from %d entries", stripped))
+			}
+		}
+		if len(fixes) > 0 {
+			e = writeSrt(s.elementaryStream, entries)
+			if e != nil {
+				p("could not write srt %s: %s", s.elementaryStream, e)
+				return
+			}
+			changed = true
+			for _, fix := range fixes {
+				j.record("subtitle stream %d: %s", s.Index, fix)
+			}
+		}
+		for _, entry := range entries {
+			text = append(text, entry.lines...)
+		}
+	}
+
+	if undefinedLang && subDetectLang {
+		lang := detectLanguage(strings.Join(text, "\n"))
+		if lang != "" {
+			j.record("subtitle stream %d: detected language '%s'", s.Index, lang)
+			s.Tags.Language = lang
+		}
+	}
+}
+
+// ocrSub runs the configured ocr command against an image subtitle and swaps the stream for the srt it produces
+func (j *Job) ocrSub(s *Stream) {
+	in := s.elementaryStream
+	if in == "" {
+		ext := ".sup"
+		if s.CodecName == "dvd_subtitle" {
+			ext = ".idx"
+		}
+		in = fmt.Sprintf("%s.%d%s", j.baseWithPath, s.Index, ext)
+		var cmd []string
+		if s.CodecName == "dvd_subtitle" {
+			// ffmpeg can't write vobsub, mkvextract writes the idx and sub pair
+			cmd = []string{"mkvextract", "tracks", j.video, fmt.Sprintf("%d:%s", s.Index, in)}
+		} else {
+			cmd = []string{"ffmpeg", "-hide_banner", "-loglevel", "warning", "-y", "-i", j.video,
+				"-map", fmt.Sprintf("0:%d", s.Index), "-c:s", "copy", in}
+		}
+		printCmd(cmd)
+		e := run(cmd...)
+		if e != nil || !fileExists(in) {
+			p("failed to extract image subtitle stream %d for ocr", s.Index)
+			chk(e)
+			return
+		}
+		j.tmpFiles = append(j.tmpFiles, in)
+		if s.CodecName == "dvd_subtitle" {
+			j.tmpFiles = append(j.tmpFiles, strings.TrimSuffix(in, ".idx")+".sub")
+		}
+	}
+
+	lang := s.Tags.Language
+	if isAny(lang, "", "und") {
+		lang = "eng"
+	}
+	out := fmt.Sprintf("%s.%d.ocr.srt", j.baseWithPath, s.Index)
+	r := strings.NewReplacer("{in}", in, "{out}", out, "{lang}", lang)
+	var cmd []string
+	for _, arg := range subOcrCmd {
+		cmd = append(cmd, r.Replace(arg))
+	}
+	printCmd(cmd)
+	e := run(cmd...)
+	if e != nil || !fileExists(out) {
+		p("ocr of subtitle stream %d failed, keeping image subtitle", s.Index)
+		chk(e)
+		return
+	}
+	if st, e := os.Stat(out); e != nil || st.Size() == 0 {
+		p("ocr of subtitle stream %d produced no text, keeping image subtitle", s.Index)
+		_ = os.Remove(out)
+		return
+	}
+	j.record("subtitle stream %d: converted %s to srt with ocr", s.Index, s.CodecName)
+	j.replaceElementaryStream(s, out)
+	s.CodecName = "subrip"
+}
+
+// replaceElementaryStream points the stream at a new file. an external file or elementary stream it replaces is kept
+// with the job so it is cleaned up or moved along with everything else
+func (j *Job) replaceElementaryStream(s *Stream, f string) {
+	if s.elementaryStream != "" {
+		j.tmpFiles = append(j.tmpFiles, s.elementaryStream)
+	}
+	if s.subFile != "" {
+		j.tmpFiles = append(j.tmpFiles, s.subFile)
+		s.subFile = ""
+	}
+	s.elementaryStream = f
+	j.mux = true
+}
+
+func readSrt(f string) ([]*SrtEntry, error) {
+	b, e := os.ReadFile(f)
+	if e != nil {
+		return nil, e
+	}
+	txt := strings.TrimPrefix(string(b), "\ufeff")
+	txt = strings.ReplaceAll(txt, "\r\n", "\n")
+	reTime := regexp.MustCompile(`^\s*(-?\d+:\d{2}:\d{2}[,.]\d{1,3})\s*-->\s*(-?\d+:\d{2}:\d{2}[,.]\d{1,3})`)
+
+	var entries []*SrtEntry
+	var cur *SrtEntry
+	lines := strings.Split(txt, "\n")
+	for n, line := range lines {
+		if reTime.MatchString(line) {
+			m := reTime.FindStringSubmatch(line)
+			cur = &SrtEntry{start: parseSrtTime(m[1]), end: parseSrtTime(m[2])}
+			entries = append(entries, cur)
+			// the index line before the timestamp was added to the previous entry
+			if len(entries) > 1 && n > 0 {
+				prev := entries[len(entries)-2]
+				if l := len(prev.lines); l > 0 && strings.TrimSpace(prev.lines[l-1]) == strings.TrimSpace(lines[n-1]) {
+					if _, e := strconv.Atoi(strings.TrimSpace(lines[n-1])); e == nil {
+						prev.lines = prev.lines[:l-1]
+					}
+				}
+			}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		cur.lines = append(cur.lines, line)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no subtitle entries found")
+	}
+	return entries, nil
+}
+func parseSrtTime(t string) time.Duration {
+	neg := strings.HasPrefix(t, "-")
+	t = strings.TrimPrefix(t, "-")
+	t = strings.Replace(t, ",", ".", 1)
+	parts := strings.Split(t, ":")
+	h, _ := strconv.Atoi(parts[0])
+	m, _ := strconv.Atoi(parts[1])
+	secMs := strings.Split(parts[2], ".")
+	sec, _ := strconv.Atoi(secMs[0])
+	ms, _ := strconv.Atoi((secMs[1] + "00")[:3])
+	d := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second +
+		time.Duration(ms)*time.Millisecond
+	if neg {
+		return -d
+	}
+	return d
+}
+
+// formatSrtTime writes negative times as 0, srt has no sign
+func formatSrtTime(d time.Duration) string {
+	ms := d.Milliseconds()
+	if ms < 0 {
+		ms = 0
+	}
+	return fmt.Sprintf("%02d:%02d:%02d,%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+func writeSrt(f string, entries []*SrtEntry) error {
+	var sb strings.Builder
+	for n, entry := range entries {
+		sb.WriteString(fmt.Sprintf("%d\n%s --> %s\n%s\n\n", n+1, formatSrtTime(entry.start),
+			formatSrtTime(entry.end), strings.Join(entry.lines, "\n")))
+	}
+	st, e := os.Stat(f)
+	if e != nil {
+		return e
+	}
+	return os.WriteFile(f, []byte(sb.String()), st.Mode())
+}
+
+// fixSrtTiming drops entries that end before zero, clamps negative start times, merges entries that start at the
+// same time and trims entries that run into the next one. returns a description of each kind of fix made.
+func fixSrtTiming(entries []*SrtEntry) ([]*SrtEntry, []string) {
+	var fixes []string
+	var dropped, clamped, merged, trimmed, lengthened int
+
+	var kept []*SrtEntry
+	for _, entry := range entries {
+		if entry.end <= 0 {
+			dropped++
+			continue
+		}
+		if entry.start < 0 {
+			entry.start = 0
+			clamped++
+		}
+		kept = append(kept, entry)
+	}
+	sort.SliceStable(kept, func(a, b int) bool {
+		return kept[a].start < kept[b].start
+	})
+
+	var out []*SrtEntry
+	for _, entry := range kept {
+		if n := len(out); n > 0 && out[n-1].start == entry.start {
+			prev := out[n-1]
+			prev.lines = append(prev.lines, entry.lines...)
+			if entry.end > prev.end {
+				prev.end = entry.end
+			}
+			merged++
+			continue
+		}
+		out = append(out, entry)
+	}
+	for n, entry := range out {
+		if entry.end <= entry.start {
+			entry.end = entry.start + time.Second
+			lengthened++
+		}
+		if n+1 < len(out) && entry.end > out[n+1].start {
+			entry.end = out[n+1].start
+			trimmed++
+		}
+	}
+
+	if dropped > 0 {
+		fixes = append(fixes, fmt.Sprintf("dropped %d entries with negative timestamps", dropped))
+	}
+	if clamped > 0 {
+		fixes = append(fixes, fmt.Sprintf("moved %d entries with negative start to 0", clamped))
+	}
+	if merged > 0 {
+		fixes = append(fixes, fmt.Sprintf("merged %d entries with identical start times", merged))
+	}
+	if trimmed > 0 {
+		fixes = append(fixes, fmt.Sprintf("trimmed %d overlapping entries", trimmed))
+	}
+	if lengthened > 0 {
+		fixes = append(fixes, fmt.Sprintf("fixed %d entries that ended before they started", lengthened))
+	}
+	return out, fixes
+}
+
+// stripSrtStyling removes html tags and ass override blocks, dropping entries left with no text
+func stripSrtStyling(entries []*SrtEntry) ([]*SrtEntry, int) {
+	reTags := regexp.MustCompile(`</?[a-zA-Z][^>]*>|\{\\[^}]*}`)
+	var out []*SrtEntry
+	stripped := 0
+	for _, entry := range entries {
+		changed := false
+		var lines []string
+		for _, line := range entry.lines {
+			clean := reTags.ReplaceAllString(line, "")
+			if clean != line {
+				changed = true
+			}
+			if strings.TrimSpace(clean) != "" {
+				lines = append(lines, clean)
+			}
+		}
+		if changed {
+			stripped++
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		entry.lines = lines
+		out = append(out, entry)
+	}
+	return out, stripped
+}
+
+func readAssText(f string) []string {
+	b, e := os.ReadFile(f)
+	if e != nil {
+		return nil
+	}
+	reTags := regexp.MustCompile(`\{[^}]*}`)
+	var text []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "Dialogue:") {
+			continue
+		}
+		// Dialogue: Layer,Start,End,Style,Name,MarginL,MarginR,MarginV,Effect,Text
+		parts := strings.SplitN(line, ",", 10)
+		if len(parts) == 10 {
+			t := reTags.ReplaceAllString(parts[9], "")
+			t = strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, " ").Replace(t)
+			text = append(text, strings.TrimSpace(t))
+		}
+	}
+	return text
+}
+
+var (
+	scriptLangs = []struct {
+		table *unicode.RangeTable
+		lang  string
+	}{
+		{unicode.Hangul, "kor"}, {unicode.Hiragana, "jpn"}, {unicode.Katakana, "jpn"}, {unicode.Han, "chi"},
+		{unicode.Cyrillic, "rus"}, {unicode.Greek, "gre"}, {unicode.Arabic, "ara"}, {unicode.Hebrew, "heb"},
+		{unicode.Thai, "tha"},
+	}
+	stopWords = map[string][]string{
+		"eng": {"the", "and", "you", "that", "what", "this", "have", "with", "are", "not", "don't", "it's", "was"},
+		"spa": {"que", "de", "no", "la", "el", "es", "y", "en", "lo", "por", "qué", "una", "para", "está"},
+		"fre": {"le", "la", "les", "et", "est", "pas", "je", "vous", "que", "une", "c'est", "pour", "qui", "ne"},
+		"ger": {"der", "die", "und", "ich", "das", "ist", "nicht", "sie", "du", "ein", "zu", "was", "wir", "mit"},
+		"ita": {"che", "non", "di", "il", "è", "la", "per", "un", "sono", "mi", "ma", "cosa", "questo", "ho"},
+		"por": {"que", "não", "de", "o", "é", "a", "um", "para", "você", "eu", "se", "com", "uma", "está"},
+		"dut": {"de", "het", "een", "en", "ik", "je", "niet", "is", "dat", "van", "wat", "zijn", "we", "met"},
+		"swe": {"och", "att", "det", "är", "jag", "inte", "du", "som", "en", "på", "har", "vi", "med", "för"},
+		"dan": {"og", "det", "er", "jeg", "ikke", "du", "at", "en", "har", "til", "vi", "på", "med", "der"},
+		"nor": {"og", "det", "er", "jeg", "ikke", "du", "å", "en", "har", "til", "vi", "på", "som", "hva"},
+		"fin": {"ja", "on", "ei", "se", "että", "en", "mitä", "hän", "minä", "sinä", "oli", "olen", "kun", "no"},
+		"pol": {"nie", "to", "się", "w", "na", "jest", "i", "że", "co", "z", "jak", "tak", "mnie", "ale"},
+		"tur": {"bir", "ve", "bu", "ne", "de", "da", "için", "ben", "sen", "mi", "çok", "var", "değil", "o"},
+	}
+)
+
+// detectLanguage guesses the ISO 639-2 code of subtitle text. non-latin scripts are identified by their
+// unicode range and latin languages by how often their most common words appear. returns "" when unsure.
+func detectLanguage(text string) string {
+	counts := map[string]int{}
+	letters := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		for _, sl := range scriptLangs {
+			if unicode.Is(sl.table, r) {
+				counts[sl.lang]++
+				break
+			}
+		}
+	}
+	if letters == 0 {
+		return ""
+	}
+	// kana is mixed with kanji in japanese, so any meaningful amount of kana decides it
+	if counts["jpn"]*10 > letters {
+		return "jpn"
+	}
+	for _, sl := range scriptLangs {
+		if counts[sl.lang]*2 > letters {
+			return sl.lang
+		}
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+	if len(words) < 50 {
+		return ""
+	}
+	wordCounts := map[string]int{}
+	for _, w := range words {
+		wordCounts[w]++
+	}
+	best, second := "", ""
+	scores := map[string]int{}
+	for lang, sw := range stopWords {
+		for _, w := range sw {
+			scores[lang] += wordCounts[w]
+		}
+		if best == "" || scores[lang] > scores[best] {
+			second = best
+			best = lang
+		} else if second == "" || scores[lang] > scores[second] {
+			second = lang
+		}
+	}
+	// need stop words to be a real share of the text and a clear winner
+	if scores[best]*10 < len(words) || scores[best] < scores[second]*3/2 {
+		return ""
+	}
+	return best
+}
+
+// ocrAvailable reports whether the command configured with sub_ocr_cmd can be found
+func ocrAvailable() bool {
+	if len(subOcrCmd) == 0 {
+		return false
+	}
+	_, e := exec.LookPath(subOcrCmd[0])
+	return e == nil
+}